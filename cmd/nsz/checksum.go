@@ -0,0 +1,34 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// writeChecksum writes <path>.sha256 in the format of sha256sum, so the
+// output can be checked with "sha256sum -c" after a transfer.
+//
+// The hash is taken by reading the finished file back rather than while the
+// Pfs0Writer writes, as the README notes: the PFS0 header and the NCZ block
+// size tables are written after the data they precede, a member that does not
+// compress is stored over its discarded NCZ, and a resumed output was partly
+// written by an earlier run. The file was just written, so this read is
+// normally served from the page cache.
+func writeChecksum(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	line := fmt.Sprintf("%s  %s\n", hex.EncodeToString(h.Sum(nil)), filepath.Base(path))
+	return os.WriteFile(path+".sha256", []byte(line), 0o644)
+}
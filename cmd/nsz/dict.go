@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/falk/nsz-go/pkg/fs"
+	github_zstd "github.com/falk/nsz-go/pkg/zstd"
+)
+
+const (
+	dictMaxSize    = 110 << 10 // zstd's default dictionary size
+	dictSampleSize = 64 << 10
+)
+
+// loadDict returns the dictionary named by -dict: the contents of a file, or
+// with "auto" one built from the start of every NCA that will be compressed.
+func loadDict(spec string, f io.ReaderAt, files []fs.Pfs0File, headerSize int64, shouldCompress []bool, titleKeys [][]byte, opts fs.CompressOptions) ([]byte, error) {
+	if spec != "auto" {
+		return os.ReadFile(spec)
+	}
+
+	var samples [][]byte
+	for i, file := range files {
+		if !shouldCompress[i] {
+			continue
+		}
+		size := int64(file.Entry.DataSize)
+		sr := io.NewSectionReader(f, int64(file.Entry.DataOffset)+headerSize, size)
+		sample, err := fs.DictSample(sr, size, titleKeys[i], dictSampleSize, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name, err)
+		}
+		samples = append(samples, sample)
+	}
+	return github_zstd.BuildRawDict(samples, dictMaxSize), nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/falk/nsz-go/pkg/fs"
+	"github.com/falk/nsz-go/pkg/nsz"
+)
+
+// extractNsp writes every member of an NSP/NSZ to dir as a loose file,
+// decompressing .ncz members to .nca. It reports whether all were written.
+func extractNsp(f io.ReaderAt, size int64, files []fs.Pfs0File, headerSize int64, dir string, force bool) bool {
+	if _, err := os.Stat(dir); err == nil && !force {
+		fmt.Printf("Error: %s already exists (use -f to extract into it)\n", dir)
+		return false
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		fmt.Printf("Error creating %s: %v\n", dir, err)
+		return false
+	}
+
+	dict, err := nsz.ReadDictTrailer(f, size)
+	if err != nil {
+		fmt.Printf("Error reading dictionary: %v\n", err)
+		return false
+	}
+
+	for i, file := range files {
+		// Member names come from the container; never let them leave dir
+		if file.Name != filepath.Base(file.Name) || file.Name == ".." || file.Name == "." {
+			fmt.Printf("Error: refusing to extract member %q\n", file.Name)
+			return false
+		}
+
+		name := file.Name
+		ext := filepath.Ext(name)
+		decompress := strings.ToLower(ext) == ".ncz"
+		if decompress {
+			name = strings.TrimSuffix(name, ext) + ".nca"
+		}
+
+		fmt.Printf("[%d/%d] %s -> %s... ", i+1, len(files), file.Name, name)
+
+		offset := int64(file.Entry.DataOffset) + headerSize
+		sr := io.NewSectionReader(f, offset, int64(file.Entry.DataSize))
+
+		if err := extractFile(sr, filepath.Join(dir, name), decompress, dict); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			return false
+		}
+		fmt.Println("Done.")
+	}
+	fmt.Println("Extraction Complete.")
+	return true
+}
+
+// extractFile writes sr to path, decompressing it first if it is an NCZ.
+func extractFile(sr *io.SectionReader, path string, decompress bool, dict []byte) error {
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if decompress {
+		_, err = fs.DecompressNcaWithDict(sr, out, dict)
+	} else {
+		_, err = io.Copy(out, sr)
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// packDir builds <dir>.nsz from the loose files in dir, compressing its NCAs.
+func packDir(dir string, cfg cliOptions) {
+	outputPath := filepath.Clean(dir) + ".nsz"
+	fmt.Printf("Creating %s...\n", outputPath)
+
+	opts := fs.PackOptions{Compress: true, CompressOptions: cfg.compress}
+	if err := fs.PackDir(dir, outputPath, opts); err != nil {
+		fmt.Printf("Packing failed: %v\n", err)
+		return
+	}
+	cfg.stats.merge(batchStats{succeeded: 1})
+	fmt.Println("Done!")
+}
@@ -1,168 +1,565 @@
 package main
 
 import (
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/falk/nsz-go/pkg/fs"
 	"github.com/falk/nsz-go/pkg/keys"
+	"github.com/falk/nsz-go/pkg/nsz"
+	github_zstd "github.com/falk/nsz-go/pkg/zstd"
 )
 
 func main() {
 	keysPath := flag.String("k", "", "Path to prod.keys")
+	strictKeys := flag.Bool("strict-keys", false, "Reject keys files that define a key twice with different values")
 	level := flag.Int("l", fs.DefaultCompressionLevel, "Compression level (1-22, higher = slower but smaller)")
+	blockSizeExp := flag.Int("b", fs.DefaultBlockSizeEx, "Block size exponent (14-31, block size = 2^b bytes)")
+	workers := flag.Int("j", envInt("NSZ_WORKERS"), "Number of compression workers per file (0 = GOMAXPROCS shared by the parallel files, env NSZ_WORKERS)")
+	flag.IntVar(workers, "threads-per-file", *workers, "Same as -j")
+	filesInParallel := flag.Int("files-in-parallel", 1, "Number of inputs processed at the same time")
+	maxMemory := flag.Int64("max-memory", 0, "Refuse settings whose block buffers need more than this many MB (0 = GOMEMLIMIT, if set)")
+	minSize := flag.Int64("min-size", fs.DefaultMinCompressSize, "Smallest NCA size in bytes worth compressing (0 = no minimum)")
+	decompress := flag.Bool("d", false, "Decompress an .nsz/.ncz back to .nsp/.nca")
+	canonicalNames := flag.Bool("canonical-names", false, "Rename NCA members to <contentid>.nca/.ncz (hashes every NCA)")
+	manifest := flag.Bool("manifest", false, "Write a JSON manifest of the compressed members next to the output")
+	extractDir := flag.String("extract", "", "Write every member of an .nsz/.nsp to this directory, decompressing .ncz to .nca")
+	force := flag.Bool("f", false, "With -extract, write into an existing directory")
+	syncOutput := flag.Bool("sync", false, "Flush the output to disk before exiting")
+	forceEncrypted := flag.Bool("force-encrypted", false, "Compress NCAs even when they cannot be decrypted (no key, or a wrong one)")
+	dict := flag.String("dict", "", "Compress against a shared zstd dictionary: a file, or \"auto\" to build one from the NSP (only nsz-go can decompress the result)")
+	verify := flag.Bool("verify", false, "Decompress every NCZ after compressing an NSP and check it against the original")
+	blockHashes := flag.Bool("block-hashes", false, "Store a CRC-32C of every NCZ block, for -verify-blocks and decompression to find damaged blocks")
+	verifyBlocksOnly := flag.Bool("verify-blocks", false, "Check the block hashes of an .ncz or of the NCZs in an .nsz/.xcz, without decompressing")
+	deleteOriginal := flag.Bool("delete-original", false, "With -verify, delete the input NSP once its NSZ has been verified (default keeps it)")
+	keepDecrypted := flag.Bool("keep-decrypted", false, "With -verify, also write each restored NCA decrypted to <name>.decrypted.nca")
+	noDecrypt := flag.Bool("no-decrypt", false, "Compress NCAs as stored, without decrypting them: no keys needed, but much less saving")
+	minSavings := flag.Float64("min-savings", 0, "Keep the original instead of writing the output unless it saves at least this many percent")
+	blockBudget := flag.Duration("block-budget", 0, "Compress a block at level 1 instead when the requested level takes longer than this (e.g. 2s; 0 = no limit)")
+	checksum := flag.Bool("sha256", false, "Write the SHA-256 of each output to <output>.sha256, hashed by reading the finished output back")
+	types := flag.String("types", "", "Comma-separated content types to compress (default program,publicdata)")
+	rename := flag.Bool("rename", false, "Name the .nsz after the title, as given by -rename-template")
+	renameTemplate := flag.String("rename-template", defaultRenameTemplate, "Output name for -rename; {name}, {titleid}, {version} and {type} are replaced ({name} is empty if unknown)")
+	loose := flag.Bool("loose", false, "Compress each .nca of a directory input to its own .ncz (with -d, decompress each .ncz) instead of packing the directory")
+	skipPatches := flag.Bool("skip-patches", false, "Keep update (patch) NCAs as they are instead of compressing them")
 	flag.Parse()
 
-	compressionLevel := *level
-	if compressionLevel < 1 || compressionLevel > 22 {
-		compressionLevel = fs.DefaultCompressionLevel
+	// With "-" the NCZ (or NCA) goes to stdout, so every message goes to stderr
+	stdout := os.Stdout
+	readStdin := slices.Contains(flag.Args(), stdinArg)
+	if readStdin {
+		os.Stdout = os.Stderr
+	}
+
+	opts := fs.CompressOptions{
+		Level:           *level,
+		Workers:         *workers,
+		BlockSizeExp:    *blockSizeExp,
+		MinSize:         *minSize,
+		AllowEncrypted:  *forceEncrypted,
+		NoDecrypt:       *noDecrypt,
+		BlockHashes:     *blockHashes,
+		BlockTimeBudget: *blockBudget,
+	}
+	if opts.Level < 1 || opts.Level > 22 {
+		opts.Level = fs.DefaultCompressionLevel
+	}
+	if opts.BlockSizeExp < 14 || opts.BlockSizeExp > fs.MaxBlockSizeEx {
+		opts.BlockSizeExp = fs.DefaultBlockSizeEx
+	}
+	if opts.Workers < 0 {
+		opts.Workers = 0
+	}
+	if *types != "" {
+		opts.CompressContentTypes = make(map[byte]bool)
+		for _, name := range strings.Split(*types, ",") {
+			ct, err := fs.ParseContentType(name)
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			opts.CompressContentTypes[ct] = true
+		}
+	}
+
+	cfg := cliOptions{
+		compress:       opts,
+		manifest:       *manifest,
+		canonicalNames: *canonicalNames,
+		sync:           *syncOutput,
+		dict:           *dict,
+		verify:         *verify,
+		keepDecrypted:  *keepDecrypted,
+		deleteOriginal: *deleteOriginal,
+		decompress:     *decompress,
+		extractDir:     *extractDir,
+		verifyBlocks:   *verifyBlocksOnly,
+		force:          *force,
+		minSavings:     *minSavings,
+		checksum:       *checksum,
+		skipPatches:    *skipPatches,
+		stats:          &sharedStats{},
+	}
+	if *rename {
+		cfg.renameTemplate = *renameTemplate
+	}
+	if cfg.deleteOriginal && !cfg.verify {
+		fmt.Println("Error: -delete-original requires -verify")
+		return
 	}
 
 	fmt.Println("NSZ Go Port")
+	if eff := github_zstd.EffectiveLevel(opts.Level); eff != opts.Level && !*decompress {
+		fmt.Printf("Requested level %d; this zstd encoder compresses about like level %d.\n", opts.Level, eff)
+	}
 
+	path := *keysPath
 	var err error
-	if *keysPath != "" {
-		err = keys.Load(*keysPath)
-	} else {
-		err = keys.LoadDefault()
+	if path == "" {
+		path, err = keys.FindDefault()
+	}
+	var stats keys.LoadStats
+	if err == nil {
+		stats, err = keys.LoadWithOptions(path, keys.LoadOptions{Strict: *strictKeys})
 	}
 
 	if err != nil {
 		fmt.Printf("Warning: Could not load keys: %v\n", err)
-		fmt.Println("Please provide keys file with -k or place in ~/.switch/prod.keys")
+		fmt.Println("Please provide keys file with -k or $NSZ_KEYS, or place in ~/.switch/prod.keys")
 	} else {
-		fmt.Println("Keys loaded successfully.")
+		fmt.Printf("Keys loaded successfully from %s (%d keys).\n", path, stats.Loaded)
+		for _, w := range stats.Warnings {
+			fmt.Printf("Warning: %s: skipped %s\n", path, w)
+		}
+		if stats.Conflicts > 0 {
+			fmt.Printf("Warning: %d conflicting key definitions; the last one was used (use -strict-keys to reject)\n", stats.Conflicts)
+		}
 		keys.DeriveKeys()
 	}
 
 	args := flag.Args()
 	if len(args) == 0 {
-		fmt.Println("Usage: nsz-go [options] <file>")
+		fmt.Println("Usage: nsz-go [options] <file>...")
+		fmt.Println("       nsz-go [options] - < in.nca > out.ncz")
+		return
+	}
+	if readStdin {
+		if len(args) > 1 {
+			fmt.Println("Error: - (stdin) must be the only input")
+			return
+		}
+		processStdin(stdout, cfg)
 		return
 	}
+	if *loose {
+		ext := ".nca"
+		if cfg.decompress {
+			ext = ".ncz"
+		}
+		if args = expandLooseDirs(args, ext); len(args) == 0 {
+			return
+		}
+	}
 
-	inputFile := args[0]
+	if *filesInParallel < 1 {
+		*filesInParallel = 1
+	}
+	if *filesInParallel > len(args) {
+		*filesInParallel = len(args)
+	}
+	if cfg.compress.Workers == 0 && *filesInParallel > 1 {
+		// Split the CPUs between the files rather than oversubscribing them
+		cfg.compress.Workers = max(1, runtime.GOMAXPROCS(0) / *filesInParallel)
+	}
+	if err := checkMemoryBudget(*filesInParallel, cfg.compress, *maxMemory); err != nil {
+		fmt.Printf("Error: %v\n", err)
+		return
+	}
+
+	start := time.Now()
+	sem := make(chan struct{}, *filesInParallel)
+	var wg sync.WaitGroup
+	for _, inputFile := range args {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			processInput(inputFile, cfg)
+		}()
+	}
+	wg.Wait()
+	if len(args) > 1 {
+		cfg.stats.print(len(args), time.Since(start))
+	}
+}
+
+// expandLooseDirs replaces every directory in args with the files directly
+// in it that have the extension ext, in name order, so that each is
+// processed as an input of its own.
+func expandLooseDirs(args []string, ext string) []string {
+	var expanded []string
+	for _, arg := range args {
+		if info, err := os.Stat(arg); err != nil || !info.IsDir() {
+			expanded = append(expanded, arg)
+			continue
+		}
+		entries, err := os.ReadDir(arg)
+		if err != nil {
+			fmt.Printf("Error reading %s: %v\n", arg, err)
+			continue
+		}
+		found := 0
+		for _, e := range entries {
+			if e.Type().IsRegular() && strings.EqualFold(filepath.Ext(e.Name()), ext) {
+				expanded = append(expanded, filepath.Join(arg, e.Name()))
+				found++
+			}
+		}
+		if found == 0 {
+			fmt.Printf("No %s files in %s.\n", ext, arg)
+		}
+	}
+	return expanded
+}
+
+// processInput compresses, decompresses or extracts one input as the options say.
+func processInput(inputFile string, cfg cliOptions) {
 	fmt.Printf("Processing %s...\n", inputFile)
 
-	f, err := os.Open(inputFile)
+	// A directory of loose files is packed into an NSZ
+	if info, err := os.Stat(inputFile); err == nil && info.IsDir() {
+		packDir(inputFile, cfg)
+		return
+	}
+
+	f, size, closer, err := openInput(inputFile)
 	if err != nil {
 		fmt.Printf("Error opening file: %v\n", err)
 		return
 	}
-	defer f.Close()
+	defer closer.Close()
 
-	// Try parsing as PFS0 (NSP)
-	pfsFiles, pfsHeaderSize, err := fs.OpenPfs0(f)
-	if err == nil {
-		processNsp(inputFile, f, pfsFiles, pfsHeaderSize, compressionLevel)
-	} else {
-		// Try parsing as NCA
-		processSingleNca(inputFile, f, compressionLevel)
+	// Outputs of remote inputs go to the current directory
+	if isURL(inputFile) {
+		u, _ := url.Parse(inputFile)
+		inputFile = filepath.Base(u.Path)
+		cfg.deleteOriginal = false
 	}
-}
 
-func processNsp(inputPath string, f *os.File, files []fs.Pfs0File, headerSize int64, compressionLevel int) {
-	fmt.Printf("Found Valid PFS0 (NSP) with %d files.\n", len(files))
+	// The container type comes from the magic, since files are often misnamed
+	container, err := fs.DetectContainer(f)
+	if err != nil && strings.EqualFold(filepath.Ext(inputFile), ".nca") {
+		// NCA headers cannot be read without keys, which -no-decrypt does
+		// not need; trust the extension then
+		container, err = fs.ContainerNCA, nil
+	}
+	if err != nil {
+		fmt.Printf("Unrecognized input: %v\n", err)
+		return
+	}
 
-	// 1. Find Title Key in Ticket (.tik)
-	var titleKey []byte
-	for _, file := range files {
-		if strings.ToLower(filepath.Ext(file.Name)) == ".tik" {
-			fmt.Printf("Found Ticket: %s\n", file.Name)
-			// Read encrypted title key from ticket (offset 0x180, size 0x10)
-			tikBuf := make([]byte, 0x190)
-			offset := int64(file.Entry.DataOffset) + headerSize
-			if _, err := f.ReadAt(tikBuf, offset); err != nil {
-				fmt.Printf("Warning: Failed to read ticket: %v\n", err)
-				break
-			}
-			encryptedKey := tikBuf[0x180 : 0x180+0x10]
-
-			// We need Master Key Gen to decrypt.
-			// We'll peek at the first NCA to find it.
-			// (Simplification: assume all NCAs use same MK Gen)
-			for _, ncaFile := range files {
-				if strings.ToLower(filepath.Ext(ncaFile.Name)) == ".nca" {
-					sr := io.NewSectionReader(f, int64(ncaFile.Entry.DataOffset)+headerSize, int64(ncaFile.Entry.DataSize))
-					nca, err := fs.NewNCA(sr)
-					if err == nil {
-						keyGen := int(nca.Header.KeyGeneration)
-						if nca.Header.KeyGeneration2 > nca.Header.KeyGeneration {
-							keyGen = int(nca.Header.KeyGeneration2)
-						}
-						keyGen = keyGen - 1
-						if keyGen < 0 {
-							keyGen = 0
-						}
-
-						dec, err := keys.DecryptTitleKey(encryptedKey, keyGen)
-						if err == nil {
-							titleKey = dec
-							fmt.Printf("Successfully decrypted Title Key: %x...\n", titleKey[:4])
-						} else {
-							fmt.Printf("Failed to decrypt title key: %v\n", err)
-						}
-						break
-					}
-				}
+	if cfg.verifyBlocks {
+		if verifyBlocks(f, container) {
+			cfg.stats.merge(batchStats{succeeded: 1})
+		}
+		return
+	}
+
+	if cfg.extractDir != "" {
+		if container != fs.ContainerPFS0 {
+			fmt.Printf("Not a PFS0 container: %s\n", container)
+			return
+		}
+		pfsFiles, pfsHeaderSize, err := fs.OpenPfs0(f)
+		if err != nil {
+			fmt.Printf("Not a PFS0 container: %v\n", err)
+			return
+		}
+		if extractNsp(f, size, pfsFiles, pfsHeaderSize, cfg.extractDir, cfg.force) {
+			cfg.stats.merge(batchStats{succeeded: 1})
+		}
+		return
+	}
+
+	switch container {
+	case fs.ContainerPFS0:
+		pfsFiles, pfsHeaderSize, err := fs.OpenPfs0(f)
+		if err != nil {
+			fmt.Printf("Invalid PFS0: %v\n", err)
+			return
+		}
+		// Some store-format dumps wrap the NSP in a second PFS0
+		for len(pfsFiles) == 1 && fs.IsNestedPfs0(f, pfsFiles[0], pfsHeaderSize) {
+			fmt.Printf("Descending into nested PFS0 %s.\n", pfsFiles[0].Name)
+			var nested *io.SectionReader
+			nested, pfsFiles, pfsHeaderSize, err = fs.OpenNested(f, pfsFiles[0], pfsHeaderSize)
+			if err != nil {
+				fmt.Printf("Invalid PFS0: %v\n", err)
+				return
 			}
-			break
+			f, size = nested, nested.Size()
+		}
+		if cfg.decompress {
+			decompressNsp(inputFile, f, size, pfsFiles, pfsHeaderSize, cfg)
+		} else if ncz := fs.NczMembers(f, pfsFiles, pfsHeaderSize); len(ncz) > 0 {
+			// Compressing again would fail on the NCZ members, or worse, read them as NCAs
+			fmt.Printf("This NSP is already compressed (%s is an NCZ); use -d to decompress it.\n", ncz[0])
+		} else {
+			processNsp(inputFile, f, size, pfsFiles, pfsHeaderSize, cfg)
 		}
+	case fs.ContainerXCI:
+		// Gamecard images go through the HFS0 path
+		if cfg.decompress {
+			decompressXci(inputFile, f, size, cfg)
+		} else {
+			processXci(inputFile, f, size, cfg)
+		}
+	case fs.ContainerNCZ:
+		if !cfg.decompress {
+			fmt.Println("Input is already an NCZ; use -d to decompress it.")
+			return
+		}
+		decompressSingleNcz(inputFile, f, cfg)
+	case fs.ContainerNCA:
+		if cfg.decompress {
+			fmt.Println("Input is an uncompressed NCA; nothing to decompress.")
+			return
+		}
+		processSingleNca(inputFile, f, size, cfg)
+	default:
+		fmt.Printf("%s input is not supported on its own.\n", container)
 	}
+}
 
-	outputPath := inputPath
-	if strings.HasSuffix(outputPath, ".nsp") {
-		outputPath = outputPath[:len(outputPath)-4] + ".nsz"
-	} else {
-		outputPath += ".nsz"
+// containerExts are the extensions replaced when naming an output.
+var containerExts = map[string]bool{
+	".nsp": true, ".nsz": true, ".xci": true, ".xcz": true, ".nca": true, ".ncz": true,
+}
+
+// outputPathFor returns inputPath with its container extension, if any,
+// replaced by ext (otherwise ext is appended). The result never equals
+// inputPath, even for a misnamed input.
+func outputPathFor(inputPath, ext string) string {
+	out := inputPath + ext
+	if old := filepath.Ext(inputPath); containerExts[strings.ToLower(old)] {
+		out = strings.TrimSuffix(inputPath, old) + ext
+	}
+	if out == inputPath {
+		out = inputPath + ext
+	}
+	return out
+}
+
+// isURL reports whether name is an http(s) URL rather than a local path.
+func isURL(name string) bool {
+	return strings.HasPrefix(name, "http://") || strings.HasPrefix(name, "https://")
+}
+
+// openInput opens a local file or an http(s) URL for random access.
+func openInput(name string) (io.ReaderAt, int64, io.Closer, error) {
+	if isURL(name) {
+		rr, err := fs.NewRangeReaderAt(name)
+		if err != nil {
+			return nil, 0, nil, err
+		}
+		return rr, rr.Size(), io.NopCloser(nil), nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, nil, err
+	}
+	return f, info.Size(), f, nil
+}
+
+// cliOptions holds the command line settings shared by the processing modes.
+type cliOptions struct {
+	compress       fs.CompressOptions
+	manifest       bool
+	canonicalNames bool
+	sync           bool
+	dict           string
+	verify         bool
+	keepDecrypted  bool
+	deleteOriginal bool
+	decompress     bool
+	extractDir     string
+	verifyBlocks   bool
+	force          bool
+	checksum       bool
+	skipPatches    bool
+	renameTemplate string       // Empty unless -rename
+	minSavings     float64      // Percent; 0 writes every output
+	stats          *sharedStats // Shared by all inputs of a run
+}
+
+// envInt returns the integer value of an environment variable, or 0 if unset or invalid.
+func envInt(name string) int {
+	n, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+func processNsp(inputPath string, f io.ReaderAt, inputSize int64, files []fs.Pfs0File, headerSize int64, cfg cliOptions) {
+	opts := cfg.compress
+	fmt.Printf("Found Valid PFS0 (NSP) with %d files.\n", len(files))
+
+	// 1. Collect tickets (.tik) by rights ID
+	tickets := readTickets(f, files, headerSize)
+	titleKeys := make(map[[16]byte][]byte)
+	checkTicketCerts(files)
+
+	outputPath := outputPathFor(inputPath, ".nsz")
+	if cfg.renameTemplate != "" {
+		name, err := titleOutputName(f, files, headerSize, tickets, titleKeys, cfg.renameTemplate)
+		if err != nil {
+			fmt.Printf("Warning: Cannot rename the output: %v\n", err)
+		} else {
+			outputPath = filepath.Join(filepath.Dir(inputPath), name+".nsz")
+		}
 	}
 
 	fmt.Printf("Creating %s...\n", outputPath)
 
-	// Prepare output file list (names might change .nca -> .ncz)
+	// Prepare output file list (names might change .nca -> .ncz). Members keep
+	// their input order, and everything that is not compressed (tickets, certs,
+	// .cnmt.xml, icons, small NCAs) is copied byte for byte under its own name.
 	outputNames := make([]string, len(files))
 	shouldCompress := make([]bool, len(files))
+	fileTitleKeys := make([][]byte, len(files))
+	ncas := make([]*fs.NCA, len(files)) // Parsed once, reused when compressing
+	entries := make([]manifestEntry, len(files))
 
 	for i, file := range files {
+		entries[i] = manifestEntry{Name: file.Name, OriginalSize: int64(file.Entry.DataSize)}
 		ext := strings.ToLower(filepath.Ext(file.Name))
-		if ext == ".nca" {
+		switch ext {
+		case ".tik", ".cert":
+			// Installers verify tickets against their certs, so both stay untouched
+			outputNames[i] = file.Name
+		case ".nca":
 			// Check if compressible
 			offset := int64(file.Entry.DataOffset) + headerSize
 			sr := io.NewSectionReader(f, offset, int64(file.Entry.DataSize))
 
 			nca, err := fs.NewNCA(sr)
 			if err == nil {
-				// Inject Title Key if we found one
-				if titleKey != nil {
-					nca.Header.TitleKey = titleKey
+				ncas[i] = nca
+				// Inject the title key of the matching ticket; NCAs without a
+				// rights ID use their key area instead.
+				fileTitleKeys[i] = titleKeyFor(nca.Header, tickets, titleKeys)
+				entries[i].setNca(nca.Header)
+
+				name := file.Name
+				if cfg.canonicalNames {
+					name = canonicalName(nca, sr, file.Name)
 				}
 
-				ct := nca.Header.ContentType
-				// Compress Program (0) or PublicData (5)
-				if (ct == 0 || ct == 5) && file.Entry.DataSize > 0x4000 {
+				if opts.ShouldCompressType(nca.Header.ContentType) && opts.ShouldCompressSize(int64(file.Entry.DataSize)) && !skipPatch(file.Name, nca, cfg) {
 					shouldCompress[i] = true
-					outputNames[i] = strings.TrimSuffix(file.Name, ext) + ".ncz"
+					outputNames[i] = strings.TrimSuffix(name, filepath.Ext(name)) + ".ncz"
 				} else {
-					outputNames[i] = file.Name
+					outputNames[i] = name
 				}
+			} else if opts.NoDecrypt && opts.ShouldCompressSize(int64(file.Entry.DataSize)) {
+				// The header is unreadable without keys, so the type filter cannot apply
+				shouldCompress[i] = true
+				outputNames[i] = strings.TrimSuffix(file.Name, filepath.Ext(file.Name)) + ".ncz"
 			} else {
 				outputNames[i] = file.Name
 			}
-		} else {
+		default:
 			outputNames[i] = file.Name
 		}
 	}
 
-	writer, err := fs.NewPfs0Writer(outputPath, outputNames)
+	if cfg.dict != "" {
+		dict, err := loadDict(cfg.dict, f, files, headerSize, shouldCompress, fileTitleKeys, opts)
+		if err != nil {
+			fmt.Printf("Error loading dictionary: %v\n", err)
+			return
+		}
+		fmt.Printf("Using a %d byte dictionary.\n", len(dict))
+		opts.Dict = dict
+	}
+
+	// The output is written to a .part file, with a journal of the progress
+	// next to it, and renamed once complete. An interrupted run for the same
+	// input and settings is continued from its last checkpoint.
+	partPath := outputPath + ".part"
+	jPath := journalPath(partPath)
+	fresh, err := newJournal(inputPath, f, inputSize, files, headerSize, cfg)
+	if err != nil {
+		fmt.Printf("Error reading input: %v\n", err)
+		return
+	}
+	journal, err := loadJournal(jPath)
+	if err != nil {
+		fmt.Printf("Warning: Ignoring unreadable journal %s: %v\n", jPath, err)
+		journal = nil
+	}
+	if journal != nil && !journal.matches(fresh) {
+		fmt.Printf("Warning: Ignoring journal %s written for a different input or settings.\n", jPath)
+		journal = nil
+	}
+
+	var writer *fs.Pfs0Writer
+	resumeFrom := 0
+	if journal != nil {
+		resumeFrom = len(journal.Writer.Entries)
+		fmt.Printf("Resuming %s after %d of %d files.\n", partPath, resumeFrom, len(files))
+		writer, err = fs.ResumePfs0Writer(partPath, journal.Writer)
+	} else {
+		journal = fresh
+		writer, err = fs.NewPfs0Writer(partPath, outputNames)
+	}
 	if err != nil {
 		fmt.Printf("Error creating output: %v\n", err)
 		return
 	}
-	defer writer.Close()
+	// On failure keep the partial output for the next run
+	defer writer.Abort()
+	writer.SetSync(cfg.sync)
+	if opts.Dict != nil {
+		writer.SetTrailer(nsz.DictTrailer(opts.Dict))
+	}
+
+	var st batchStats
+
+	// saveProgress flushes the output, then records the first done members and
+	// the block sizes of the next one in the journal.
+	saveProgress := func(done int, blocks []uint32) error {
+		if err := writer.Sync(); err != nil {
+			return err
+		}
+		journal.Writer = writer.State(done)
+		journal.Blocks = blocks
+		if err := journal.save(jPath); err != nil {
+			return err
+		}
+		return checkpointSaved(journal)
+	}
 
 	// Processing Loop
 	for i, file := range files {
@@ -170,52 +567,487 @@ func processNsp(inputPath string, f *os.File, files []fs.Pfs0File, headerSize in
 		size := int64(file.Entry.DataSize)
 		sr := io.NewSectionReader(f, offset, size)
 
+		if i < resumeFrom {
+			outputNames[i] = writer.Name(i)
+			entries[i].OutputName = outputNames[i]
+			entries[i].OutputSize = int64(journal.Writer.Entries[i].DataSize)
+			entries[i].Compressed = strings.EqualFold(filepath.Ext(outputNames[i]), ".ncz")
+			if shouldCompress[i] {
+				st.addCompressed(entries[i].ContentType, size, entries[i].OutputSize, !entries[i].Compressed)
+			} else {
+				st.addSkipped(size)
+			}
+			fmt.Printf("[%d/%d] %s -> %s... Already done.\n", i+1, len(files), file.Name, outputNames[i])
+			continue
+		}
+
 		fmt.Printf("[%d/%d] %s -> %s... ", i+1, len(files), file.Name, outputNames[i])
 
 		if shouldCompress[i] {
 			fmt.Printf("Compressing... ")
 
-			if err := writer.AddCompressedFile(i, sr, size, titleKey, compressionLevel); err != nil {
+			fileOpts := opts
+			fileOpts.CheckpointBlocks = resumeCheckpointBlocks
+			fileOpts.Checkpoint = func(sizes []uint32) error {
+				return saveProgress(i, sizes)
+			}
+			if i == resumeFrom {
+				fileOpts.Resume = journal.Blocks
+			}
+
+			var res *fs.CompressResult
+			if ncas[i] != nil {
+				res, err = writer.AddCompressedNca(i, ncas[i], size, fileTitleKeys[i], fileOpts)
+			} else {
+				res, err = writer.AddCompressedFile(i, sr, size, nil, fileOpts)
+			}
+			if err != nil {
 				fmt.Printf("Error: %v\n", err)
+				if errors.Is(err, fs.ErrNoDecryptionKey) || errors.Is(err, fs.ErrWrongKey) {
+					printMissingKeys(sr)
+					if ncas[i] != nil {
+						printWarnings(ncas[i].Header.Warnings)
+					}
+					fmt.Println("Check the ticket and keys, or pass -force-encrypted to compress it anyway.")
+				}
 				return
 			}
-			fmt.Println("Done.")
+			printWarnings(res.Warnings)
+			outputNames[i] = writer.Name(i)
+			entries[i].Compressed = !res.Stored
+			st.addCompressed(entries[i].ContentType, size, res.OutputSize, res.Stored)
+			entries[i].OutputSize = res.OutputSize
+			if res.Stored {
+				fmt.Printf("Not compressible, stored as %s.\n", outputNames[i])
+			} else {
+				fmt.Printf("Done (%d/%d blocks stored).\n", res.StoredBlocks, res.Blocks)
+				printSlowBlocks(res)
+			}
 		} else {
 			if err := writer.AddFile(i, sr, size); err != nil {
 				fmt.Printf("Error: %v\n", err)
 				return
 			}
+			entries[i].OutputSize = size
+			st.addSkipped(size)
 			fmt.Println("Added.")
 		}
+		entries[i].OutputName = outputNames[i]
+
+		if err := saveProgress(i+1, nil); err != nil {
+			fmt.Printf("Error saving progress: %v\n", err)
+			return
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		fmt.Printf("Error finalizing output: %v\n", err)
+		return
+	}
+	if info, err := os.Stat(partPath); err == nil && belowMinSavings(inputSize, info.Size(), cfg) {
+		os.Remove(partPath)
+		os.Remove(jPath)
+		cfg.stats.merge(batchStats{inputBytes: inputSize, outputBytes: inputSize, succeeded: 1})
+		return
+	}
+	if err := os.Rename(partPath, outputPath); err != nil {
+		fmt.Printf("Error finalizing output: %v\n", err)
+		return
+	}
+	os.Remove(jPath)
+
+	if cfg.verify {
+		if err := verifyNsp(outputPath, f, files, headerSize, fileTitleKeys, cfg.keepDecrypted); err != nil {
+			fmt.Printf("Verification failed: %v\n", err)
+			return
+		}
 	}
+
+	if cfg.manifest {
+		if err := writeManifest(inputPath, outputPath, opts, entries); err != nil {
+			fmt.Printf("Warning: Failed to write manifest: %v\n", err)
+		}
+	}
+	if cfg.checksum {
+		if err := writeChecksum(outputPath); err != nil {
+			fmt.Printf("Warning: Failed to write checksum: %v\n", err)
+		}
+	}
+
+	// Only reached once every NCZ has been verified against the input
+	if cfg.deleteOriginal && cfg.verify {
+		if err := os.Remove(inputPath); err != nil {
+			fmt.Printf("Warning: Failed to delete %s: %v\n", inputPath, err)
+		} else {
+			fmt.Printf("Deleted %s.\n", inputPath)
+		}
+	}
+	st.succeeded++
+	cfg.stats.merge(st)
 	fmt.Println("Done!")
 }
 
-func processSingleNca(inputFile string, f *os.File, compressionLevel int) {
-	nca, err := fs.NewNCA(f)
+// checkTicketCerts warns about tickets without a matching <rightsid>.cert.
+func checkTicketCerts(files []fs.Pfs0File) {
+	names := make(map[string]bool, len(files))
+	for _, file := range files {
+		names[strings.ToLower(file.Name)] = true
+	}
+	for _, file := range files {
+		if ext := filepath.Ext(file.Name); strings.ToLower(ext) == ".tik" {
+			cert := strings.ToLower(strings.TrimSuffix(file.Name, ext)) + ".cert"
+			if !names[cert] {
+				fmt.Printf("Warning: %s has no matching .cert\n", file.Name)
+			}
+		}
+	}
+}
+
+// canonicalName returns the canonical <contentid>.nca name of an NCA member
+// (<contentid>.cnmt.nca for meta NCAs), or name if hashing fails.
+func canonicalName(nca *fs.NCA, sr *io.SectionReader, name string) string {
+	id, err := nca.ContentID(sr, sr.Size())
 	if err != nil {
-		fmt.Printf("Not a valid NCA: %v\n", err)
-		return
+		fmt.Printf("Warning: Failed to hash %s: %v\n", name, err)
+		return name
+	}
+
+	canonical := hex.EncodeToString(id[:])
+	if nca.Header.ContentType == fs.ContentTypeMeta {
+		canonical += ".cnmt"
+	}
+	canonical += ".nca"
+	if canonical != name {
+		fmt.Printf("Renaming %s -> %s\n", name, canonical)
+	}
+	return canonical
+}
+
+// readTickets parses every ticket in the NSP, keyed by rights ID.
+func readTickets(f io.ReaderAt, files []fs.Pfs0File, headerSize int64) map[[16]byte]*fs.Ticket {
+	tickets := make(map[[16]byte]*fs.Ticket)
+	for _, file := range files {
+		if strings.ToLower(filepath.Ext(file.Name)) != ".tik" {
+			continue
+		}
+		fmt.Printf("Found Ticket: %s\n", file.Name)
+		tikReader := io.NewSectionReader(f, int64(file.Entry.DataOffset)+headerSize, int64(file.Entry.DataSize))
+		tik, err := fs.ParseTicket(tikReader)
+		if err != nil {
+			fmt.Printf("Warning: Failed to read ticket %s: %v\n", file.Name, err)
+			continue
+		}
+		if tik.TitleKeyType != fs.TitleKeyTypeCommon {
+			fmt.Printf("Warning: %s is a personalized ticket; its title key cannot be decrypted\n", file.Name)
+			continue
+		}
+		tickets[tik.RightsID] = tik
+	}
+	return tickets
+}
+
+// titleKeyFor returns the decrypted title key for an NCA from its matching
+// ticket, caching decrypted keys by rights ID. It returns nil for NCAs without
+// a rights ID or without a matching ticket.
+func titleKeyFor(h *fs.NcaHeader, tickets map[[16]byte]*fs.Ticket, cache map[[16]byte][]byte) []byte {
+	if !h.HasRightsID() {
+		return nil
+	}
+	if key, ok := cache[h.RightsID]; ok {
+		return key
 	}
 
-	fmt.Printf("Valid NCA3 found. Content Size: %d\n", nca.Header.ContentSize)
-	outFile := inputFile + ".nsz"
-	out, err := os.Create(outFile)
+	tik, ok := tickets[h.RightsID]
+	if !ok {
+		fmt.Printf("Warning: No ticket for rights ID %x\n", h.RightsID)
+		cache[h.RightsID] = nil
+		return nil
+	}
+
+	masterKey := h.TitleKeyMasterKeyIndex()
+	if tik.MasterKeyIndex() != masterKey {
+		fmt.Printf("Warning: Ticket for %x says master key %d, its rights ID %d; using the rights ID's.\n", h.RightsID, tik.MasterKeyIndex(), masterKey)
+	}
+	key, err := keys.DecryptTitleKey(tik.EncryptedTitleKey(), masterKey)
+	if err != nil {
+		fmt.Printf("Failed to decrypt title key for rights ID %x: %v\n", h.RightsID, err)
+		cache[h.RightsID] = nil
+		return nil
+	}
+	fmt.Printf("Successfully decrypted Title Key for %x: %x...\n", h.RightsID, key[:4])
+	cache[h.RightsID] = key
+	return key
+}
+
+func processSingleNca(inputFile string, f io.ReaderAt, size int64, cfg cliOptions) {
+	opts := cfg.compress
+	var nca *fs.NCA
+	if !opts.NoDecrypt {
+		var err error
+		nca, err = fs.NewNCA(f)
+		if err != nil {
+			fmt.Printf("Not a valid NCA: %v\n", err)
+			return
+		}
+		fmt.Printf("Valid NCA3 found. Content Size: %d\n", nca.Header.ContentSize)
+		if skipPatch(inputFile, nca, cfg) {
+			st := batchStats{succeeded: 1}
+			st.addCompressed(ncaContentType(nca), size, size, true)
+			cfg.stats.merge(st)
+			return
+		}
+	}
+
+	outFile := outputPathFor(inputFile, ".ncz")
+	out, err := createPartial(outFile)
 	if err != nil {
 		fmt.Printf("Error creating output file: %v\n", err)
 		return
 	}
-	defer out.Close()
+	defer out.discard()
 
-	fileInfo, err := f.Stat()
+	var res *fs.CompressResult
+	if nca != nil {
+		res, err = fs.CompressParsedNca(nca, out, size, nil, opts)
+	} else {
+		res, err = fs.CompressNca(f, out, size, nil, opts)
+	}
 	if err != nil {
-		fmt.Printf("Error getting file info: %v\n", err)
+		if errors.Is(err, fs.ErrNotCompressible) {
+			fmt.Println("NCA is not compressible; keeping the original.")
+			st := batchStats{succeeded: 1}
+			st.addCompressed(ncaContentType(nca), size, size, true)
+			cfg.stats.merge(st)
+			return
+		}
+		fmt.Printf("Compression failed: %v\n", err)
+		if errors.Is(err, fs.ErrNoDecryptionKey) || errors.Is(err, fs.ErrWrongKey) {
+			printMissingKeys(f)
+			if nca != nil {
+				printWarnings(nca.Header.Warnings)
+			}
+			fmt.Println("Check the keys, or pass -force-encrypted to compress it anyway.")
+		}
+		return
+	}
+	printWarnings(res.Warnings)
+	if belowMinSavings(size, res.OutputSize, cfg) {
+		st := batchStats{succeeded: 1}
+		st.addCompressed(ncaContentType(nca), size, size, true)
+		cfg.stats.merge(st)
 		return
 	}
+	if err := out.commit(cfg.sync); err != nil {
+		fmt.Printf("Error finalizing output: %v\n", err)
+		return
+	}
+	if cfg.checksum {
+		if err := writeChecksum(outFile); err != nil {
+			fmt.Printf("Warning: Failed to write checksum: %v\n", err)
+		}
+	}
+	st := batchStats{succeeded: 1}
+	st.addCompressed(ncaContentType(res.NCA), size, res.OutputSize, false)
+	cfg.stats.merge(st)
+	fmt.Printf("Compression Complete (%d/%d blocks stored).\n", res.StoredBlocks, res.Blocks)
+	printSlowBlocks(res)
+}
 
-	if _, err := fs.CompressNca(f, out, fileInfo.Size(), nil, compressionLevel); err != nil {
-		fmt.Printf("Compression failed: %v\n", err)
+// skipPatch reports whether nca is an update NCA to keep as is because of
+// -skip-patches, and warns about update NCAs that will be compressed.
+func skipPatch(name string, nca *fs.NCA, cfg cliOptions) bool {
+	if !nca.IsPatch() {
+		return false
+	}
+	if cfg.skipPatches {
+		fmt.Printf("%s is an update NCA; keeping it as is (-skip-patches).\n", name)
+		return true
+	}
+	fmt.Printf("Warning: %s is an update NCA; BKTR support is experimental (-skip-patches keeps update NCAs as they are).\n", name)
+	return false
+}
+
+// printSlowBlocks reports the blocks compressed at the fallback level for
+// going over -block-budget.
+func printSlowBlocks(res *fs.CompressResult) {
+	if res.SlowBlocks > 0 {
+		fmt.Printf("%d blocks went over the time budget and were compressed at level %d.\n", res.SlowBlocks, fs.FallbackLevel)
+	}
+}
+
+// ncaContentType returns the name of the content type of nca, or "" if its
+// header was not read.
+func ncaContentType(nca *fs.NCA) string {
+	if nca == nil {
+		return ""
+	}
+	return fs.ContentTypeName(nca.Header.ContentType)
+}
+
+// checkMemoryBudget returns an error if files compressed in parallel with
+// opts would need more than maxMB megabytes of block buffers: every worker
+// holds a read buffer and a compressed block, about 2^b * 2 bytes, and as
+// much again for an attempt abandoned over -block-budget. With maxMB zero,
+// the limit is GOMEMLIMIT, if set.
+func checkMemoryBudget(files int, opts fs.CompressOptions, maxMB int64) error {
+	workers := opts.Workers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	perWorker := int64(2)
+	if opts.BlockTimeBudget > 0 {
+		perWorker = 4
+	}
+	need := int64(files) * int64(workers) * (int64(1) << opts.BlockSizeExp) * perWorker
+
+	limit := maxMB << 20
+	if maxMB == 0 {
+		limit = debug.SetMemoryLimit(-1)
+	}
+	if need > limit {
+		return fmt.Errorf("%d files x %d workers x %d MB blocks need about %d MB, over the %d MB limit; lower -files-in-parallel, -j or -b",
+			files, workers, (int64(1)<<opts.BlockSizeExp)>>20, need>>20, limit>>20)
+	}
+	return nil
+}
+
+// belowMinSavings reports whether an output of out bytes for in input bytes
+// saves less than -min-savings, in which case the original is kept instead.
+func belowMinSavings(in, out int64, cfg cliOptions) bool {
+	if cfg.minSavings <= 0 || in <= 0 {
+		return false
+	}
+	saved := 100 * float64(in-out) / float64(in)
+	if saved >= cfg.minSavings {
+		return false
+	}
+	fmt.Printf("Saved only %.1f%%, below -min-savings %.1f%%; keeping the original.\n", saved, cfg.minSavings)
+	return true
+}
+
+// printWarnings prints the warnings collected while parsing an NCA.
+func printWarnings(warnings []string) {
+	for _, w := range warnings {
+		fmt.Printf("Warning: %s\n", w)
+	}
+}
+
+// printMissingKeys names the keys the NCA r needs that are not loaded.
+func printMissingKeys(r io.ReaderAt) {
+	required, _ := fs.RequiredKeys(r)
+	var missing []string
+	for _, name := range required {
+		if keys.Get(name) == nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Printf("Missing keys: %s\n", strings.Join(missing, ", "))
+	}
+}
+
+// closeOutput optionally syncs out to disk, then closes it.
+func closeOutput(out *os.File, sync bool) error {
+	if sync {
+		if err := out.Sync(); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+func decompressNsp(inputPath string, f io.ReaderAt, size int64, files []fs.Pfs0File, headerSize int64, cfg cliOptions) {
+	fmt.Printf("Found Valid PFS0 (NSZ) with %d files.\n", len(files))
+
+	outputPath := outputPathFor(inputPath, ".nsp")
+
+	fmt.Printf("Creating %s...\n", outputPath)
+
+	outputNames := make([]string, len(files))
+	for i, file := range files {
+		outputNames[i] = file.Name
+		if ext := filepath.Ext(file.Name); strings.ToLower(ext) == ".ncz" {
+			outputNames[i] = strings.TrimSuffix(file.Name, ext) + ".nca"
+		}
+	}
+
+	dict, err := nsz.ReadDictTrailer(f, size)
+	if err != nil {
+		fmt.Printf("Error reading dictionary: %v\n", err)
+		return
+	}
+
+	// Written as .part and renamed once complete, like compressed NSPs
+	partPath := outputPath + ".part"
+	writer, err := fs.NewPfs0Writer(partPath, outputNames)
+	if err != nil {
+		fmt.Printf("Error creating output: %v\n", err)
+		return
+	}
+	complete := false
+	defer func() {
+		if !complete {
+			writer.Close()
+			os.Remove(partPath)
+		}
+	}()
+	writer.SetSync(cfg.sync)
+
+	for i, file := range files {
+		offset := int64(file.Entry.DataOffset) + headerSize
+		size := int64(file.Entry.DataSize)
+		sr := io.NewSectionReader(f, offset, size)
+
+		fmt.Printf("[%d/%d] %s -> %s... ", i+1, len(files), file.Name, outputNames[i])
+
+		if outputNames[i] != file.Name {
+			fmt.Printf("Decompressing... ")
+			if err := writer.AddDecompressedFileWithDict(i, sr, dict); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			fmt.Println("Done.")
+		} else {
+			if err := writer.AddFile(i, sr, size); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				return
+			}
+			fmt.Println("Added.")
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		fmt.Printf("Error finalizing output: %v\n", err)
+		return
+	}
+	if err := os.Rename(partPath, outputPath); err != nil {
+		fmt.Printf("Error finalizing output: %v\n", err)
+		return
+	}
+	complete = true
+	cfg.stats.merge(batchStats{succeeded: 1})
+	fmt.Println("Done!")
+}
+
+func decompressSingleNcz(inputFile string, f io.ReaderAt, cfg cliOptions) {
+	outFile := outputPathFor(inputFile, ".nca")
+
+	out, err := createPartial(outFile)
+	if err != nil {
+		fmt.Printf("Error creating output file: %v\n", err)
+		return
+	}
+	defer out.discard()
+
+	if _, err := fs.DecompressNca(f, out); err != nil {
+		fmt.Printf("Decompression failed: %v\n", err)
+		return
+	}
+	if err := out.commit(cfg.sync); err != nil {
+		fmt.Printf("Error finalizing output: %v\n", err)
 		return
 	}
-	fmt.Println("Compression Complete.")
+	cfg.stats.merge(batchStats{succeeded: 1})
+	fmt.Println("Decompression Complete.")
 }
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/falk/nsz-go/internal/testutil"
+	"github.com/falk/nsz-go/pkg/fs"
+)
+
+// testMember is a file of a synthetic NSP.
+type testMember struct {
+	name string
+	data []byte
+}
+
+// testNspMembers returns a compressible standard crypto program NCA between
+// the metadata an NSP carries next to its NCAs.
+func testNspMembers(t *testing.T) []testMember {
+	t.Helper()
+	if err := testutil.SetKeys(); err != nil {
+		t.Fatal(err)
+	}
+	nca, err := testutil.NewStandardCryptoNCA([]testutil.SectionSpec{
+		{Size: 0x20000, FsType: fs.FsTypePfs0, Counter: 1},
+		{Size: 0x30000, FsType: fs.FsTypeRomFs, Counter: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []testMember{
+		{"01000000000010000000000000000001.tik", bytes.Repeat([]byte("ticket "), 0x60)},
+		{"0123456789abcdef0123456789abcdef.nca", nca},
+		{"0123456789abcdef0123456789abcdef.cnmt.xml", []byte("<?xml version=\"1.0\"?>\n<ContentMeta />\n")},
+		{"01000000000010000000000000000001.cert", bytes.Repeat([]byte("cert"), 0x1c0)},
+		{"icon_AmericanEnglish.dat.jpg", []byte{0xff, 0xd8, 0xff, 0xe0, 0x00, 0x10, 'J', 'F', 'I', 'F', 0x00}},
+	}
+}
+
+// testCliOptions compresses with small blocks and no precheck, like the fs tests.
+func testCliOptions() cliOptions {
+	return cliOptions{
+		compress: fs.CompressOptions{Level: 3, BlockSizeExp: 16, PrecheckBlocks: -1},
+		stats:    &sharedStats{},
+	}
+}
+
+func writeTestNsp(t *testing.T, path string, members []testMember) {
+	t.Helper()
+	names := make([]string, len(members))
+	for i, m := range members {
+		names[i] = m.name
+	}
+	w, err := fs.NewPfs0Writer(path, names)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, m := range members {
+		if err := w.AddFile(i, bytes.NewReader(m.data), int64(len(m.data))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestNsp(t *testing.T, path string) []testMember {
+	t.Helper()
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, headerSize, err := fs.OpenPfs0(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("%s: %v", path, err)
+	}
+	members := make([]testMember, len(files))
+	for i, file := range files {
+		start := headerSize + int64(file.Entry.DataOffset)
+		members[i] = testMember{file.Name, b[start : start+int64(file.Entry.DataSize)]}
+	}
+	return members
+}
+
+// runNsp compresses (or with cfg.decompress, decompresses) the NSP at path
+// as processInput would, and fails unless it succeeded.
+func runNsp(t *testing.T, path string, cfg cliOptions) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r io.ReaderAt = f
+	files, headerSize, err := fs.OpenPfs0(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.decompress {
+		decompressNsp(path, r, info.Size(), files, headerSize, cfg)
+	} else {
+		processNsp(path, r, info.Size(), files, headerSize, cfg)
+	}
+	if cfg.stats.succeeded != 1 {
+		t.Fatalf("processing %s failed", path)
+	}
+}
+
+func TestNspRoundTripKeepsMembers(t *testing.T) {
+	dir := t.TempDir()
+	members := testNspMembers(t)
+	nspPath := filepath.Join(dir, "game.nsp")
+	writeTestNsp(t, nspPath, members)
+
+	runNsp(t, nspPath, testCliOptions())
+	nszPath := filepath.Join(dir, "game.nsz")
+	nsz := readTestNsp(t, nszPath)
+	if len(nsz) != len(members) || nsz[1].name != "0123456789abcdef0123456789abcdef.ncz" {
+		t.Fatalf("NSZ members: %v", nsz)
+	}
+
+	// Decompressed elsewhere, so game.nsp is not overwritten
+	outDir := filepath.Join(dir, "out")
+	if err := os.Mkdir(outDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(nszPath, filepath.Join(outDir, "game.nsz")); err != nil {
+		t.Fatal(err)
+	}
+	cfg := testCliOptions()
+	cfg.decompress = true
+	runNsp(t, filepath.Join(outDir, "game.nsz"), cfg)
+
+	got := readTestNsp(t, filepath.Join(outDir, "game.nsp"))
+	if len(got) != len(members) {
+		t.Fatalf("got %d members, want %d", len(got), len(members))
+	}
+	for i, m := range members {
+		if got[i].name != m.name {
+			t.Errorf("member %d is %s, want %s", i, got[i].name, m.name)
+		}
+		if !bytes.Equal(got[i].data, m.data) {
+			t.Errorf("%s changed in the round trip", m.name)
+		}
+	}
+}
+
+func TestCompressKeepsTicketAndCert(t *testing.T) {
+	dir := t.TempDir()
+	members := testNspMembers(t)
+	nspPath := filepath.Join(dir, "game.nsp")
+	writeTestNsp(t, nspPath, members)
+
+	runNsp(t, nspPath, testCliOptions())
+	nsz := readTestNsp(t, filepath.Join(dir, "game.nsz"))
+
+	want := map[string][]byte{}
+	for _, m := range members {
+		if ext := filepath.Ext(m.name); ext == ".tik" || ext == ".cert" {
+			want[m.name] = m.data
+		}
+	}
+	for _, m := range nsz {
+		if data, ok := want[m.name]; ok {
+			if !bytes.Equal(m.data, data) {
+				t.Errorf("%s was altered in the NSZ", m.name)
+			}
+			delete(want, m.name)
+		}
+	}
+	for name := range want {
+		t.Errorf("%s is missing from the NSZ", name)
+	}
+}
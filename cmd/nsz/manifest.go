@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+
+	"github.com/falk/nsz-go/pkg/fs"
+)
+
+// manifest records what was done to each member of a compressed NSP.
+type manifest struct {
+	Source  string          `json:"source"`
+	Output  string          `json:"output"`
+	Level   int             `json:"level"`
+	Entries []manifestEntry `json:"files"`
+}
+
+type manifestEntry struct {
+	Name         string `json:"name"`
+	OutputName   string `json:"output_name"`
+	OriginalSize int64  `json:"original_size"`
+	OutputSize   int64  `json:"output_size"`
+	ContentType  string `json:"content_type,omitempty"`
+	RightsID     string `json:"rights_id,omitempty"`
+	Distribution string `json:"distribution,omitempty"`
+	SdkVersion   string `json:"sdk_version,omitempty"`
+	Compressed   bool   `json:"compressed"`
+}
+
+// setNca fills in the NCA metadata of an entry.
+func (e *manifestEntry) setNca(h *fs.NcaHeader) {
+	e.ContentType = fs.ContentTypeName(h.ContentType)
+	if h.HasRightsID() {
+		e.RightsID = hex.EncodeToString(h.RightsID[:])
+	}
+	e.Distribution = "download"
+	if h.DistributionType == fs.DistributionTypeGameCard {
+		e.Distribution = "gamecard"
+	}
+	e.SdkVersion = h.SdkVersion()
+}
+
+// writeManifest writes the manifest for outputPath to outputPath + ".json".
+func writeManifest(inputPath, outputPath string, opts fs.CompressOptions, entries []manifestEntry) error {
+	level := opts.Level
+	if level <= 0 {
+		level = fs.DefaultCompressionLevel
+	}
+
+	data, err := json.MarshalIndent(manifest{
+		Source:  inputPath,
+		Output:  outputPath,
+		Level:   level,
+		Entries: entries,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(outputPath+".json", append(data, '\n'), 0o644)
+}
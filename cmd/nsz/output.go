@@ -0,0 +1,49 @@
+package main
+
+import (
+	"os"
+)
+
+// partialOutput is an output file written as <path>.part and renamed to
+// path only once complete, so that a run that fails midway never leaves a
+// truncated output under the final name for a later run to take as valid.
+type partialOutput struct {
+	*os.File
+	path string
+	done bool
+}
+
+// createPartial creates <path>.part, replacing any left by an earlier run.
+func createPartial(path string) (*partialOutput, error) {
+	f, err := os.OpenFile(path+".part", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0o666)
+	if err != nil {
+		return nil, err
+	}
+	return &partialOutput{File: f, path: path}, nil
+}
+
+// commit closes the output, syncing it first if asked, and renames it to
+// its final path.
+func (p *partialOutput) commit(sync bool) error {
+	p.done = true
+	if err := closeOutput(p.File, sync); err != nil {
+		os.Remove(p.Name())
+		return err
+	}
+	if err := os.Rename(p.Name(), p.path); err != nil {
+		os.Remove(p.Name())
+		return err
+	}
+	return nil
+}
+
+// discard closes and deletes the output unless it was committed. Deferring
+// it cleans up after every early return.
+func (p *partialOutput) discard() {
+	if p.done {
+		return
+	}
+	p.done = true
+	p.Close()
+	os.Remove(p.Name())
+}
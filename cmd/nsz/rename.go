@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/falk/nsz-go/pkg/fs"
+)
+
+// defaultRenameTemplate is the common <TitleName>[<TitleID>][v<Version>].
+const defaultRenameTemplate = "{name}[{titleid}][v{version}]"
+
+// titleOutputName returns the output name, without extension, that template
+// gives the NSP f: {titleid}, {version} and {type} come from its content meta
+// and {name} from its control NCA, left empty if there is none or it cannot
+// be read.
+func titleOutputName(f io.ReaderAt, files []fs.Pfs0File, headerSize int64, tickets map[[16]byte]*fs.Ticket, titleKeys map[[16]byte][]byte, template string) (string, error) {
+	cnmt, err := fs.ReadCnmt(f)
+	if err != nil {
+		return "", err
+	}
+	name := strings.NewReplacer(
+		"{name}", sanitizeName(titleName(f, files, headerSize, tickets, titleKeys)),
+		"{titleid}", fmt.Sprintf("%016X", cnmt.TitleID),
+		"{version}", strconv.FormatUint(uint64(cnmt.Version), 10),
+		"{type}", cnmt.TypeName(),
+	).Replace(template)
+
+	name = strings.TrimSpace(name)
+	if name == "" || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("template %q gives the name %q", template, name)
+	}
+	return name, nil
+}
+
+// titleName returns the title name from the control NCA of the NSP f, or ""
+// if it has none or the name cannot be read.
+func titleName(f io.ReaderAt, files []fs.Pfs0File, headerSize int64, tickets map[[16]byte]*fs.Ticket, titleKeys map[[16]byte][]byte) string {
+	for _, file := range files {
+		if !strings.EqualFold(filepath.Ext(file.Name), ".nca") {
+			continue
+		}
+		sr := io.NewSectionReader(f, headerSize+int64(file.Entry.DataOffset), int64(file.Entry.DataSize))
+		nca, err := fs.NewNCA(sr)
+		if err != nil || nca.Header.ContentType != fs.ContentTypeControl {
+			continue
+		}
+		nca.Header.TitleKey = titleKeyFor(nca.Header, tickets, titleKeys)
+		name, err := nca.ReadTitleName()
+		if err != nil {
+			fmt.Printf("Warning: Cannot read the title name from %s: %v\n", file.Name, err)
+			return ""
+		}
+		return name
+	}
+	return ""
+}
+
+// sanitizeName drops the characters that are not allowed in file names on
+// some systems.
+func sanitizeName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return -1
+		}
+		return r
+	}, name)
+	return strings.TrimSpace(name)
+}
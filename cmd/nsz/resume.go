@@ -0,0 +1,120 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/falk/nsz-go/pkg/fs"
+)
+
+// resumeCheckpointBlocks is how often, in blocks, compression of an NCA
+// records a checkpoint in the journal. A variable so tests can checkpoint
+// small NCAs.
+var resumeCheckpointBlocks uint32 = 256
+
+// checkpointSaved is called after each journal save. Tests stop a run there
+// to interrupt it.
+var checkpointSaved = func(*resumeJournal) error { return nil }
+
+// resumeJournal is saved next to a .part output while an NSP is being
+// compressed, so an interrupted run can continue where it stopped. The
+// fields before Writer identify the input and the settings that change the
+// output bytes; a journal is only used when they all match.
+type resumeJournal struct {
+	InputSize      int64
+	InputModTime   int64    `json:",omitempty"` // Unix nanoseconds, 0 if unknown
+	InputHeader    string   // SHA-256 of the input PFS0 header, in hex
+	InputNames     []string // Member names of the input
+	Level          int
+	BlockSizeExp   int
+	Dict           string
+	NoDecrypt      bool `json:",omitempty"`
+	BlockHashes    bool `json:",omitempty"`
+	ForceEncrypted bool `json:",omitempty"`
+	Writer         fs.Pfs0WriterState
+	Blocks         []uint32 `json:",omitempty"` // Block sizes of member len(Writer.Entries) so far
+}
+
+// newJournal returns an empty journal for the NSP f of the given size at
+// inputPath, whose PFS0 header is headerSize bytes, compressed with cfg.
+func newJournal(inputPath string, f io.ReaderAt, inputSize int64, files []fs.Pfs0File, headerSize int64, cfg cliOptions) (*resumeJournal, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(f, 0, headerSize)); err != nil {
+		return nil, fmt.Errorf("hash input header: %w", err)
+	}
+	j := &resumeJournal{
+		InputSize:      inputSize,
+		InputHeader:    hex.EncodeToString(h.Sum(nil)),
+		InputNames:     make([]string, len(files)),
+		Level:          cfg.compress.Level,
+		BlockSizeExp:   cfg.compress.BlockSizeExp,
+		Dict:           cfg.dict,
+		NoDecrypt:      cfg.compress.NoDecrypt,
+		BlockHashes:    cfg.compress.BlockHashes,
+		ForceEncrypted: cfg.compress.AllowEncrypted,
+	}
+	for i, file := range files {
+		j.InputNames[i] = file.Name
+	}
+	if info, err := os.Stat(inputPath); err == nil {
+		j.InputModTime = info.ModTime().UnixNano()
+	}
+	return j, nil
+}
+
+// journalPath returns the journal path for a .part output.
+func journalPath(partPath string) string {
+	return partPath + ".json"
+}
+
+// loadJournal reads the journal at path. It returns nil if there is none.
+func loadJournal(path string) (*resumeJournal, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var j resumeJournal
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// matches reports whether the journal was written for the same input and
+// settings as the empty journal fresh, and for as many output members.
+func (j *resumeJournal) matches(fresh *resumeJournal) bool {
+	return j.InputSize == fresh.InputSize &&
+		j.InputModTime == fresh.InputModTime &&
+		j.InputHeader == fresh.InputHeader &&
+		slices.Equal(j.InputNames, fresh.InputNames) &&
+		j.Level == fresh.Level &&
+		j.BlockSizeExp == fresh.BlockSizeExp &&
+		j.Dict == fresh.Dict &&
+		j.NoDecrypt == fresh.NoDecrypt &&
+		j.BlockHashes == fresh.BlockHashes &&
+		j.ForceEncrypted == fresh.ForceEncrypted &&
+		len(j.Writer.Names) == len(fresh.InputNames) &&
+		len(j.Writer.Entries) <= len(fresh.InputNames)
+}
+
+// save writes the journal to path, replacing the previous one atomically.
+func (j *resumeJournal) save(path string) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
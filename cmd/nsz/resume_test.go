@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/falk/nsz-go/pkg/fs"
+)
+
+var errInterrupted = errors.New("interrupted")
+
+// interruptAt makes the nth journal save of the following runs stop them,
+// and checkpoints NCAs every two blocks.
+func interruptAt(t *testing.T, n int) {
+	t.Helper()
+	blocks, saved := resumeCheckpointBlocks, checkpointSaved
+	t.Cleanup(func() { resumeCheckpointBlocks, checkpointSaved = blocks, saved })
+	resumeCheckpointBlocks = 2
+	count := 0
+	checkpointSaved = func(j *resumeJournal) error {
+		if count++; count == n {
+			return errInterrupted
+		}
+		return nil
+	}
+}
+
+// openTestNsp returns the members and header size of the NSP at path, and a
+// journal for compressing it with cfg.
+func openTestNsp(t *testing.T, path string, cfg cliOptions) (*os.File, []fs.Pfs0File, int64, *resumeJournal) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { f.Close() })
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files, headerSize, err := fs.OpenPfs0(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := newJournal(path, f, info.Size(), files, headerSize, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, files, headerSize, j
+}
+
+func TestResumeMatchesUninterruptedRun(t *testing.T) {
+	members := testNspMembers(t)
+
+	// Uninterrupted
+	refDir := t.TempDir()
+	writeTestNsp(t, filepath.Join(refDir, "game.nsp"), members)
+	runNsp(t, filepath.Join(refDir, "game.nsp"), testCliOptions())
+	want, err := os.ReadFile(filepath.Join(refDir, "game.nsz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Stopped at a checkpoint in the middle of the NCA
+	dir := t.TempDir()
+	nspPath := filepath.Join(dir, "game.nsp")
+	writeTestNsp(t, nspPath, members)
+	interruptAt(t, 2)
+	cfg := testCliOptions()
+	f, files, headerSize, fresh := openTestNsp(t, nspPath, cfg)
+	processNsp(nspPath, f, fresh.InputSize, files, headerSize, cfg)
+	if cfg.stats.succeeded != 0 {
+		t.Fatal("the interrupted run succeeded")
+	}
+	partPath := filepath.Join(dir, "game.nsz.part")
+	journal, err := loadJournal(journalPath(partPath))
+	if err != nil || journal == nil {
+		t.Fatalf("no journal after the interrupted run: %v", err)
+	}
+	if len(journal.Writer.Entries) != 1 || len(journal.Blocks) == 0 {
+		t.Fatalf("interrupted after %d files and %d blocks, want inside the NCA", len(journal.Writer.Entries), len(journal.Blocks))
+	}
+
+	// Resumed from there
+	var first *resumeJournal
+	checkpointSaved = func(j *resumeJournal) error {
+		if first == nil {
+			first = &resumeJournal{Writer: j.Writer, Blocks: j.Blocks}
+		}
+		return nil
+	}
+	runNsp(t, nspPath, testCliOptions())
+	if first == nil || len(first.Writer.Entries) != 1 || len(first.Blocks) <= len(journal.Blocks) {
+		t.Fatal("the second run did not resume from the journal")
+	}
+	got, err := os.ReadFile(filepath.Join(dir, "game.nsz"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("resumed NSZ (%d bytes) differs from an uninterrupted run (%d bytes)", len(got), len(want))
+	}
+	for _, path := range []string{partPath, journalPath(partPath)} {
+		if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s was left behind", path)
+		}
+	}
+}
+
+func TestResumeJournalIdentifiesInput(t *testing.T) {
+	dir := t.TempDir()
+	members := testNspMembers(t)
+	nspPath := filepath.Join(dir, "game.nsp")
+	writeTestNsp(t, nspPath, members)
+	interruptAt(t, 1)
+	cfg := testCliOptions()
+	f, files, headerSize, fresh := openTestNsp(t, nspPath, cfg)
+	processNsp(nspPath, f, fresh.InputSize, files, headerSize, cfg)
+	journal, err := loadJournal(journalPath(filepath.Join(dir, "game.nsz.part")))
+	if err != nil || journal == nil {
+		t.Fatalf("no journal after the interrupted run: %v", err)
+	}
+	if !journal.matches(fresh) {
+		t.Fatal("the journal does not match its own input")
+	}
+
+	// Another NSP of the same size with as many members
+	other := filepath.Join(t.TempDir(), "game.nsp")
+	renamed := append([]testMember(nil), members...)
+	renamed[4].name = "icon_EnglishAmerican.dat.jpg"
+	writeTestNsp(t, other, renamed)
+	if _, _, _, fresh := openTestNsp(t, other, cfg); fresh.InputSize != journal.InputSize || journal.matches(fresh) {
+		t.Error("the journal matches an NSP with other member names")
+	}
+
+	// The same NSP, rewritten since
+	later := time.Unix(0, journal.InputModTime).Add(time.Hour)
+	if err := os.Chtimes(nspPath, later, later); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, _, fresh := openTestNsp(t, nspPath, cfg); journal.matches(fresh) {
+		t.Error("the journal matches a modified input")
+	}
+	modTime := time.Unix(0, fresh.InputModTime)
+	if err := os.Chtimes(nspPath, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+
+	// Settings that change the output bytes
+	for name, change := range map[string]func(*cliOptions){
+		"-block-hashes":    func(c *cliOptions) { c.compress.BlockHashes = true },
+		"-force-encrypted": func(c *cliOptions) { c.compress.AllowEncrypted = true },
+		"-level":           func(c *cliOptions) { c.compress.Level++ },
+	} {
+		changed := testCliOptions()
+		change(&changed)
+		if _, _, _, fresh := openTestNsp(t, nspPath, changed); journal.matches(fresh) {
+			t.Errorf("the journal matches a run with %s", name)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/falk/nsz-go/pkg/fs"
+)
+
+// stdinArg is the input name that reads an NCA (or, with -d, an NCZ) from
+// stdin and writes the result to stdout.
+const stdinArg = "-"
+
+// processStdin compresses the NCA on stdin to an NCZ on out, or with -d
+// decompresses an NCZ. Messages go to stderr, as main redirects os.Stdout
+// there when reading stdin.
+func processStdin(out *os.File, cfg cliOptions) {
+	in, size, cleanup, err := spoolStdin()
+	if err != nil {
+		fmt.Printf("Error reading stdin: %v\n", err)
+		return
+	}
+	defer cleanup()
+
+	container, err := fs.DetectContainer(in)
+	if err != nil && !cfg.decompress {
+		// Without keys the NCA header is unreadable; assume an NCA
+		container = fs.ContainerNCA
+	}
+
+	if cfg.decompress {
+		if container != fs.ContainerNCZ {
+			fmt.Printf("Stdin is %s, not an NCZ.\n", container)
+			return
+		}
+		if _, err := fs.DecompressNca(in, out); err != nil {
+			fmt.Printf("Decompression failed: %v\n", err)
+			return
+		}
+		cfg.stats.merge(batchStats{succeeded: 1})
+		fmt.Println("Decompression Complete.")
+		return
+	}
+
+	if container != fs.ContainerNCA {
+		fmt.Printf("Stdin is %s; only a single NCA can be compressed from stdin.\n", container)
+		return
+	}
+	res, err := fs.CompressNca(in, out, size, nil, cfg.compress)
+	if errors.Is(err, fs.ErrNotCompressible) {
+		// Nothing was written yet, so pass the NCA through unchanged
+		fmt.Println("NCA is not compressible; writing the original.")
+		if _, err := io.Copy(out, io.NewSectionReader(in, 0, size)); err != nil {
+			fmt.Printf("Error writing output: %v\n", err)
+			return
+		}
+		st := batchStats{succeeded: 1}
+		st.addCompressed("", size, size, true)
+		cfg.stats.merge(st)
+		return
+	}
+	if err != nil {
+		fmt.Printf("Compression failed: %v\n", err)
+		return
+	}
+	st := batchStats{succeeded: 1}
+	st.addCompressed(ncaContentType(res.NCA), size, res.OutputSize, false)
+	cfg.stats.merge(st)
+	fmt.Printf("Compression Complete (%d/%d blocks stored).\n", res.StoredBlocks, res.Blocks)
+	printSlowBlocks(res)
+}
+
+// spoolStdin returns stdin as a ReaderAt. A redirected regular file is used
+// as is; a pipe is copied to a temporary file first, as the NCA is read out
+// of order.
+func spoolStdin() (*os.File, int64, func(), error) {
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode().IsRegular() {
+		return os.Stdin, info.Size(), func() {}, nil
+	}
+
+	tmp, err := os.CreateTemp("", "nsz-stdin-*")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	cleanup := func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}
+	size, err := io.Copy(tmp, os.Stdin)
+	if err != nil {
+		cleanup()
+		return nil, 0, nil, err
+	}
+	return tmp, size, cleanup, nil
+}
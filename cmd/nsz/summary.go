@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// batchStats adds up the outcome of every input of a run.
+type batchStats struct {
+	inputBytes  int64
+	outputBytes int64
+	compressed  int // NCAs written as NCZ
+	stored      int // NCAs that did not compress and were kept as NCA
+	skipped     int // Members copied without trying to compress them
+	succeeded   int // Inputs processed to the end
+	byType      map[string]*typeStats
+}
+
+// typeStats adds up the NCAs of one content type that compression was tried on.
+type typeStats struct {
+	count       int
+	inputBytes  int64
+	outputBytes int64
+}
+
+// addCompressed records an NCA of the named content type ("" if unknown) that
+// was compressed, or stored if it did not shrink.
+func (b *batchStats) addCompressed(contentType string, in, out int64, stored bool) {
+	b.inputBytes += in
+	b.outputBytes += out
+	b.addType(contentType, typeStats{count: 1, inputBytes: in, outputBytes: out})
+	if stored {
+		b.stored++
+	} else {
+		b.compressed++
+	}
+}
+
+// addSkipped records a member copied as is.
+func (b *batchStats) addSkipped(size int64) {
+	b.inputBytes += size
+	b.outputBytes += size
+	b.skipped++
+}
+
+// merge adds the counts of o, the stats of one input, to b.
+func (b *batchStats) merge(o batchStats) {
+	b.inputBytes += o.inputBytes
+	b.outputBytes += o.outputBytes
+	b.compressed += o.compressed
+	b.stored += o.stored
+	b.skipped += o.skipped
+	b.succeeded += o.succeeded
+	for name, t := range o.byType {
+		b.addType(name, *t)
+	}
+}
+
+// addType adds t to the totals of a content type.
+func (b *batchStats) addType(contentType string, t typeStats) {
+	if contentType == "" {
+		contentType = "unknown"
+	}
+	if b.byType == nil {
+		b.byType = make(map[string]*typeStats)
+	}
+	sum, ok := b.byType[contentType]
+	if !ok {
+		sum = &typeStats{}
+		b.byType[contentType] = sum
+	}
+	sum.count += t.count
+	sum.inputBytes += t.inputBytes
+	sum.outputBytes += t.outputBytes
+}
+
+// sharedStats is the batchStats of a whole run, which inputs processed in
+// parallel merge their own into.
+type sharedStats struct {
+	mu sync.Mutex
+	batchStats
+}
+
+// merge adds o, the stats of one input, to the run's.
+func (s *sharedStats) merge(o batchStats) {
+	s.mu.Lock()
+	s.batchStats.merge(o)
+	s.mu.Unlock()
+}
+
+// print writes the summary of a run over inputs files.
+func (b *batchStats) print(inputs int, elapsed time.Duration) {
+	fmt.Println()
+	fmt.Printf("Summary: %d of %d inputs done in %s.\n", b.succeeded, inputs, elapsed.Round(time.Second))
+	if b.inputBytes > 0 {
+		fmt.Printf("%d -> %d bytes (%.1f%%, saved %.1f MB).\n", b.inputBytes, b.outputBytes,
+			100*float64(b.outputBytes)/float64(b.inputBytes), float64(b.inputBytes-b.outputBytes)/(1<<20))
+	}
+	fmt.Printf("%d NCAs compressed, %d stored, %d files copied as is.\n", b.compressed, b.stored, b.skipped)
+
+	names := make([]string, 0, len(b.byType))
+	for name := range b.byType {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		t := b.byType[name]
+		if t.inputBytes > 0 {
+			fmt.Printf("  %s: %d NCAs, %d -> %d bytes (%.1f%%).\n", name, t.count, t.inputBytes, t.outputBytes,
+				100*float64(t.outputBytes)/float64(t.inputBytes))
+		}
+	}
+}
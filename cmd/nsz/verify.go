@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/falk/nsz-go/pkg/fs"
+	"github.com/falk/nsz-go/pkg/nsz"
+)
+
+// verifyNsp decompresses every NCZ member of the NSZ at outputPath and checks
+// it against the matching member of the original NSP f. With keepDecrypted,
+// each restored NCA is also written decrypted, through fs.DecryptNca, to
+// <name>.decrypted.nca next to the output, for diffing against a reference
+// decryptor.
+func verifyNsp(outputPath string, f io.ReaderAt, files []fs.Pfs0File, headerSize int64, titleKeys [][]byte, keepDecrypted bool) error {
+	out, err := os.Open(outputPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	info, err := out.Stat()
+	if err != nil {
+		return err
+	}
+	outFiles, outHeaderSize, err := fs.OpenPfs0(out)
+	if err != nil {
+		return err
+	}
+	if len(outFiles) != len(files) {
+		return fmt.Errorf("output has %d members, input %d", len(outFiles), len(files))
+	}
+	dict, err := nsz.ReadDictTrailer(out, info.Size())
+	if err != nil {
+		return err
+	}
+
+	for i, file := range outFiles {
+		ext := filepath.Ext(file.Name)
+		if strings.ToLower(ext) != ".ncz" {
+			continue
+		}
+		fmt.Printf("Verifying %s... ", file.Name)
+
+		sr := io.NewSectionReader(out, int64(file.Entry.DataOffset)+outHeaderSize, int64(file.Entry.DataSize))
+		var restored []byte
+		var n int64
+		if keepDecrypted {
+			decrypted := filepath.Join(filepath.Dir(outputPath), strings.TrimSuffix(file.Name, ext)+".decrypted.nca")
+			restored, n, err = restoreDecrypted(sr, dict, titleKeys[i], decrypted)
+		} else {
+			h := sha256.New()
+			n, err = fs.DecompressNcaWithDict(sr, h, dict)
+			restored = h.Sum(nil)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", file.Name, err)
+		}
+
+		if n != int64(files[i].Entry.DataSize) {
+			return fmt.Errorf("%s restores to %d bytes, the original is %d", file.Name, n, files[i].Entry.DataSize)
+		}
+		orig := sha256.New()
+		if _, err := io.Copy(orig, io.NewSectionReader(f, int64(files[i].Entry.DataOffset)+headerSize, n)); err != nil {
+			return err
+		}
+
+		if !bytes.Equal(restored, orig.Sum(nil)) {
+			return fmt.Errorf("%s does not decompress to the original %s", file.Name, files[i].Name)
+		}
+		fmt.Println("OK.")
+	}
+	return nil
+}
+
+// restoreDecrypted decompresses the NCZ sr to a temporary file and writes its
+// decrypted form to path. It returns the SHA-256 and size of the restored
+// (encrypted) NCA.
+func restoreDecrypted(sr *io.SectionReader, dict, titleKey []byte, path string) ([]byte, int64, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".nsz-verify-*")
+	if err != nil {
+		return nil, 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := fs.DecompressNcaWithDict(sr, io.MultiWriter(tmp, h), dict)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	dec, err := os.Create(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	_, err = fs.DecryptNca(tmp, dec, titleKey)
+	if cerr := dec.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("decrypt: %w", err)
+	}
+	return h.Sum(nil), n, nil
+}
+
+// verifyBlocks checks the block hashes of the NCZ f, or of every NCZ member
+// of the container f, and reports the damaged blocks. It returns whether
+// every NCZ with block hashes was intact; NCZs without them are skipped.
+func verifyBlocks(f io.ReaderAt, container fs.ContainerType) bool {
+	if container == fs.ContainerNCZ {
+		return reportBlocks("NCZ", f)
+	}
+	if container == fs.ContainerNCA {
+		fmt.Println("Input is an uncompressed NCA; it has no block hashes.")
+		return false
+	}
+
+	a, err := fs.NewArchive(f)
+	if err != nil {
+		fmt.Printf("Error opening container: %v\n", err)
+		return false
+	}
+	defer a.Close()
+
+	ok := true
+	for _, name := range a.List() {
+		if !strings.EqualFold(filepath.Ext(name), ".ncz") {
+			continue
+		}
+		rs, err := a.Open(name)
+		if err != nil {
+			fmt.Printf("%s: %v\n", name, err)
+			ok = false
+			continue
+		}
+		if !reportBlocks(name, rs.(io.ReaderAt)) {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// reportBlocks checks the block hashes of one NCZ and prints the result.
+func reportBlocks(name string, r io.ReaderAt) bool {
+	bad, err := fs.VerifyNczBlocks(r)
+	switch {
+	case errors.Is(err, fs.ErrNoBlockHashes):
+		fmt.Printf("%s: no block hashes; skipped.\n", name)
+		return true
+	case err != nil:
+		fmt.Printf("%s: %v\n", name, err)
+		return false
+	case len(bad) > 0:
+		fmt.Printf("%s: %d damaged blocks: %v\n", name, len(bad), bad)
+		return false
+	}
+	fmt.Printf("%s: all blocks OK.\n", name)
+	return true
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/falk/nsz-go/pkg/fs"
+)
+
+func processXci(inputPath string, f io.ReaderAt, size int64, cfg cliOptions) {
+	outputPath := outputPathFor(inputPath, ".xcz")
+
+	fmt.Printf("Creating %s...\n", outputPath)
+
+	out, err := createPartial(outputPath)
+	if err != nil {
+		fmt.Printf("Error creating output: %v\n", err)
+		return
+	}
+	defer out.discard()
+
+	results, err := fs.CompressXci(f, out, size, cfg.compress)
+	if err != nil {
+		fmt.Printf("Compression failed: %v\n", err)
+		return
+	}
+
+	var st batchStats
+
+	for i, res := range results {
+		status := "Added."
+		if res.Compressed {
+			status = fmt.Sprintf("Compressed %d -> %d bytes.", res.InputSize, res.OutputSize)
+			st.addCompressed(res.ContentType, res.InputSize, res.OutputSize, false)
+		} else {
+			st.addSkipped(res.InputSize)
+		}
+		fmt.Printf("[%d/%d] %s/%s -> %s... %s\n", i+1, len(results), res.Partition, res.Name, res.OutputName, status)
+	}
+
+	if info, err := out.Stat(); err == nil && belowMinSavings(size, info.Size(), cfg) {
+		cfg.stats.merge(batchStats{inputBytes: size, outputBytes: size, succeeded: 1})
+		return
+	}
+	if err := out.commit(cfg.sync); err != nil {
+		fmt.Printf("Error finalizing output: %v\n", err)
+		return
+	}
+	if cfg.checksum {
+		if err := writeChecksum(outputPath); err != nil {
+			fmt.Printf("Warning: Failed to write checksum: %v\n", err)
+		}
+	}
+	st.succeeded++
+	cfg.stats.merge(st)
+	fmt.Println("Done!")
+}
+
+func decompressXci(inputPath string, f io.ReaderAt, size int64, cfg cliOptions) {
+	outputPath := outputPathFor(inputPath, ".xci")
+
+	fmt.Printf("Creating %s...\n", outputPath)
+
+	out, err := createPartial(outputPath)
+	if err != nil {
+		fmt.Printf("Error creating output: %v\n", err)
+		return
+	}
+	defer out.discard()
+
+	results, err := fs.DecompressXci(f, out, size)
+	if errors.Is(err, fs.ErrXczNoLayout) {
+		fmt.Printf("Warning: %v; the output is complete but not identical to the original card image.\n", err)
+	} else if err != nil {
+		fmt.Printf("Decompression failed: %v\n", err)
+		return
+	}
+
+	for i, res := range results {
+		status := "Added."
+		if res.Compressed {
+			status = "Decompressed."
+		}
+		fmt.Printf("[%d/%d] %s/%s -> %s... %s\n", i+1, len(results), res.Partition, res.Name, res.OutputName, status)
+	}
+
+	if err := out.commit(cfg.sync); err != nil {
+		fmt.Printf("Error finalizing output: %v\n", err)
+		return
+	}
+	cfg.stats.merge(batchStats{succeeded: 1})
+	fmt.Println("Done!")
+}
@@ -0,0 +1,261 @@
+// Package testutil builds synthetic Switch content for exercising the
+// compressor without real game files or real keys.
+package testutil
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"slices"
+
+	"github.com/falk/nsz-go/pkg/crypto"
+	"github.com/falk/nsz-go/pkg/fs"
+	"github.com/falk/nsz-go/pkg/keys"
+)
+
+// Keys used by NewSyntheticNCA. Pass HeaderKey to fs.NewNCAWithHeaderKey and
+// TitleKey as the title key to fs.CompressNca.
+var (
+	HeaderKey = []byte("0123456789abcdef0123456789ABCDEF")
+	TitleKey  = []byte("synthetic-title!")
+	RightsID  = [16]byte{0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0, 0, 0, 0, 0, 0, 0, 0x01}
+
+	// BodyKey is the CTR key in the key area of NewStandardCryptoNCA. Its
+	// XTS key is BodyKey twice.
+	BodyKey = []byte("synthetic-body!!")
+
+	// Made-up sources from which SetKeys derives the application key area
+	// key of generation 0
+	masterKey00         = []byte("synthetic-master")
+	aesKekGeneration    = []byte("synthetic-kekgen")
+	aesKeyGeneration    = []byte("synthetic-keygen")
+	keyAreaKeyAppSource = []byte("synthetic-kaksrc")
+)
+
+// SetKeys loads HeaderKey and the sources of the key area key of
+// NewStandardCryptoNCA into the keys package, so that NewNCA, DecryptNca and
+// the key area of standard crypto NCAs work as with a real keys file.
+func SetKeys() error {
+	for name, value := range map[string][]byte{
+		"header_key":                      HeaderKey,
+		"master_key_00":                   masterKey00,
+		"aes_kek_generation_source":       aesKekGeneration,
+		"aes_key_generation_source":       aesKeyGeneration,
+		"key_area_key_application_source": keyAreaKeyAppSource,
+	} {
+		if err := keys.Set(name, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// SectionSpec describes one section of a synthetic NCA.
+type SectionSpec struct {
+	Size       int64  // Section size, rounded up to fs.MediaSize
+	CryptoType uint8  // fs.CryptoTypeCTR if zero
+	FsType     uint8  // fs.FsTypeRomFs or fs.FsTypePfs0
+	Counter    uint64 // Upper half of the CTR counter
+	Data       []byte // Plaintext, zero-padded to Size; random and zero halves if nil
+	// (PFS0 sections then start with the PFS0 magic)
+
+	// Subsections splits a BKTR section into this many subsections of equal
+	// size, each encrypted under its own counter (1, 2, ...), followed by
+	// their subsection table. Without them a BKTR section is encrypted like a
+	// CTR one.
+	Subsections int
+}
+
+// bktrTableSize is the size of a subsection table of n entries in one
+// bucket: the table header and bucket offsets, then the bucket.
+func bktrTableSize(n int) int64 {
+	size := int64(0x4000 + 0x10 + n*0x10)
+	return (size + fs.MediaSize - 1) / fs.MediaSize * fs.MediaSize
+}
+
+// NewSyntheticNCA returns an encrypted NCA3 with the given sections laid out
+// back to back from fs.NcaFullHeaderSize. The header is encrypted with
+// HeaderKey and the sections with TitleKey (the NCA has RightsID set, so no
+// key area keys are needed). The NCA ends where the last section ends.
+// sections is not modified.
+func NewSyntheticNCA(sections []SectionSpec) ([]byte, error) {
+	return newNCA(sections, false)
+}
+
+// NewStandardCryptoNCA is NewSyntheticNCA for an NCA without a rights ID:
+// the sections are encrypted with BodyKey, which the key area holds wrapped
+// with the generation 0 application key area key. Call SetKeys to read it.
+func NewStandardCryptoNCA(sections []SectionSpec) ([]byte, error) {
+	return newNCA(sections, true)
+}
+
+// newNCA builds the NCA of NewSyntheticNCA, or with standard crypto that of
+// NewStandardCryptoNCA.
+func newNCA(sections []SectionSpec, standardCrypto bool) ([]byte, error) {
+	// 1. Lay out the sections
+	if len(sections) == 0 || len(sections) > 4 {
+		return nil, fmt.Errorf("an nca has 1 to 4 sections, got %d", len(sections))
+	}
+	sections = slices.Clone(sections)
+	offsets := make([]int64, len(sections))
+	end := int64(fs.NcaFullHeaderSize)
+	for i := range sections {
+		if sections[i].CryptoType == 0 {
+			sections[i].CryptoType = fs.CryptoTypeCTR
+		}
+		sections[i].Size = (sections[i].Size + fs.MediaSize - 1) / fs.MediaSize * fs.MediaSize
+		dataSize := sections[i].Size
+		if n := sections[i].Subsections; n > 0 {
+			if sections[i].CryptoType != fs.CryptoTypeBKTR {
+				return nil, fmt.Errorf("section %d: subsections need BKTR crypto", i)
+			}
+			dataSize -= bktrTableSize(n)
+			if dataSize < int64(n)*0x10 {
+				return nil, fmt.Errorf("section %d: 0x%x bytes do not fit %d subsections and their table", i, sections[i].Size, n)
+			}
+		}
+		if int64(len(sections[i].Data)) > dataSize {
+			return nil, fmt.Errorf("section %d: %d bytes of data for 0x%x bytes", i, len(sections[i].Data), dataSize)
+		}
+		offsets[i] = end
+		end += sections[i].Size
+	}
+	nca := make([]byte, end)
+
+	// 2. Plain header
+	header := nca[:fs.NcaHeaderStructSize]
+	copy(header[0x200:], fs.MagicNCA3)
+	header[0x205] = fs.ContentTypeProgram
+	binary.LittleEndian.PutUint64(header[0x208:], uint64(end))
+	key := TitleKey
+	if standardCrypto {
+		kak, err := keys.GenerateKek(keyAreaKeyAppSource, masterKey00, aesKekGeneration, aesKeyGeneration)
+		if err != nil {
+			return nil, err
+		}
+		keyArea := make([]byte, 0x40)
+		copy(keyArea[0x00:], BodyKey)
+		copy(keyArea[0x10:], BodyKey)
+		copy(keyArea[0x20:], BodyKey)
+		wrapped, err := crypto.ECBEncrypt(keyArea, kak)
+		if err != nil {
+			return nil, err
+		}
+		copy(header[0x300:], wrapped)
+		key = BodyKey
+	} else {
+		copy(header[0x230:], RightsID[:])
+	}
+
+	for i, s := range sections {
+		entry := header[0x240+i*0x10:]
+		binary.LittleEndian.PutUint32(entry[0x0:], uint32(offsets[i]/fs.MediaSize))
+		binary.LittleEndian.PutUint32(entry[0x4:], uint32((offsets[i]+s.Size)/fs.MediaSize))
+
+		fsHeader := header[0x400+i*0x200:]
+		binary.LittleEndian.PutUint16(fsHeader[0x0:], 2)
+		fsHeader[0x2] = s.FsType
+		fsHeader[0x4] = s.CryptoType
+		binary.LittleEndian.PutUint64(fsHeader[0x140:], s.Counter)
+		if s.FsType == fs.FsTypePfs0 {
+			// HierarchicalSha256 with the PFS0 region at the start of the section
+			fsHeader[0x3] = fs.HashTypeHierarchicalSha256
+			binary.LittleEndian.PutUint64(fsHeader[0x40:], 0)
+			binary.LittleEndian.PutUint64(fsHeader[0x48:], uint64(s.Size))
+		}
+		if s.Subsections > 0 {
+			// The subsection table fills the end of the section
+			bktr := fsHeader[0x120:]
+			binary.LittleEndian.PutUint64(bktr[0x0:], uint64(s.Size-bktrTableSize(s.Subsections)))
+			binary.LittleEndian.PutUint64(bktr[0x8:], uint64(bktrTableSize(s.Subsections)))
+			copy(bktr[0x10:], "BKTR")
+			binary.LittleEndian.PutUint32(bktr[0x14:], 1)
+			binary.LittleEndian.PutUint32(bktr[0x18:], uint32(s.Subsections))
+		}
+	}
+
+	// 3. Section bodies, encrypted in place
+	rng := rand.New(rand.NewSource(1))
+	for i, s := range sections {
+		body := nca[offsets[i] : offsets[i]+s.Size]
+		if s.Data != nil {
+			copy(body, s.Data)
+		} else {
+			rng.Read(body[:len(body)/2])
+			if s.FsType == fs.FsTypePfs0 {
+				copy(body, "PFS0")
+			}
+		}
+
+		if s.CryptoType == fs.CryptoTypeXTS {
+			// XTS keys are twice as long; the sectors count from the start of the NCA
+			xts, err := crypto.NewXTS(append(append([]byte(nil), key...), key...))
+			if err != nil {
+				return nil, err
+			}
+			for off := int64(0); off < s.Size; off += fs.MediaSize {
+				b := body[off : off+fs.MediaSize]
+				if err := xts.Encrypt(b, b, uint64((offsets[i]+off)/fs.MediaSize)); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		if s.CryptoType != fs.CryptoTypeCTR && s.CryptoType != fs.CryptoTypeBKTR {
+			continue
+		}
+		iv := make([]byte, 16)
+		binary.BigEndian.PutUint64(iv, s.Counter)
+
+		// Subsections take bytes 4-7 of the counter from their entry; the
+		// table itself is under the section counter
+		var start int64
+		if n := s.Subsections; n > 0 {
+			tableOffset := s.Size - bktrTableSize(n)
+			subSize := tableOffset / int64(n) &^ 0xF
+			table := body[tableOffset:]
+			clear(table)
+			binary.LittleEndian.PutUint32(table[0x4:], 1)
+			binary.LittleEndian.PutUint64(table[0x8:], uint64(tableOffset))
+			bucket := table[0x4000:]
+			binary.LittleEndian.PutUint32(bucket[0x4:], uint32(n))
+			binary.LittleEndian.PutUint64(bucket[0x8:], uint64(tableOffset))
+			for j := 0; j < n; j++ {
+				entry := bucket[0x10+j*0x10:]
+				end := int64(j+1) * subSize
+				if j == n-1 {
+					end = tableOffset
+				}
+				binary.LittleEndian.PutUint64(entry[0x0:], uint64(start))
+				binary.LittleEndian.PutUint32(entry[0xC:], uint32(j+1))
+
+				subIV := append([]byte(nil), iv...)
+				binary.BigEndian.PutUint32(subIV[4:], uint32(j+1))
+				stream, err := crypto.NewCTRStream(key, subIV, offsets[i]+start)
+				if err != nil {
+					return nil, err
+				}
+				stream.XORKeyStream(body[start:end], body[start:end])
+				start = end
+			}
+		}
+		stream, err := crypto.NewCTRStream(key, iv, offsets[i]+start)
+		if err != nil {
+			return nil, err
+		}
+		stream.XORKeyStream(body[start:], body[start:])
+	}
+
+	// 4. Encrypt the header
+	xts, err := crypto.NewXTS(HeaderKey)
+	if err != nil {
+		return nil, err
+	}
+	for sector := 0; sector < fs.NcaHeaderStructSize/fs.MediaSize; sector++ {
+		b := header[sector*fs.MediaSize : (sector+1)*fs.MediaSize]
+		if err := xts.Encrypt(b, b, uint64(sector)); err != nil {
+			return nil, err
+		}
+	}
+	return nca, nil
+}
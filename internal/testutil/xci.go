@@ -0,0 +1,115 @@
+package testutil
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"math/rand"
+
+	"github.com/falk/nsz-go/pkg/fs"
+)
+
+// XciRootOffset is where NewSyntheticXCI puts the root HFS0, as on real
+// cards: everything before it is the gamecard header, the certificate and
+// the initial data.
+const XciRootOffset = 0xF000
+
+// xciFileAlign is the alignment of the files of a NewSyntheticXCI partition,
+// coarser than the MediaSize alignment of fs.Hfs0Writer.
+const xciFileAlign = 0x1000
+
+// XciFile is a file of a partition of a synthetic XCI.
+type XciFile struct {
+	Name string
+	Data []byte
+}
+
+// XciPartition is a partition of the root HFS0 of a synthetic XCI.
+type XciPartition struct {
+	Name  string
+	Files []XciFile
+}
+
+// NewSyntheticXCI returns a card image with the given partitions in its root
+// HFS0. It is laid out as a card dump rather than as fs.Hfs0Writer would lay
+// it out: files start on 0x1000-byte boundaries, and the image is padded with
+// 0xFF up to imageSize, if that is larger than the data. The gamecard header
+// records the root HFS0 and its hash, and the rest of the area before the
+// root HFS0 is random.
+func NewSyntheticXCI(partitions []XciPartition, imageSize int64) []byte {
+	rng := rand.New(rand.NewSource(1))
+
+	// 1. Partitions, then the root HFS0 over them
+	datas := make([][]byte, len(partitions))
+	hashed := make([]uint32, len(partitions))
+	for i, p := range partitions {
+		files := make([]fs.Hfs0File, len(p.Files))
+		contents := make([][]byte, len(p.Files))
+		for j, f := range p.Files {
+			files[j] = fs.Hfs0File{Name: f.Name, Entry: fs.HFS0FileEntry{HashedSize: uint32(min(len(f.Data), fs.MediaSize))}}
+			contents[j] = f.Data
+		}
+		datas[i] = hfs0(files, contents)
+		hashed[i] = uint32(hfs0HeaderSize(files))
+	}
+	rootFiles := make([]fs.Hfs0File, len(partitions))
+	for i, p := range partitions {
+		rootFiles[i] = fs.Hfs0File{Name: p.Name, Entry: fs.HFS0FileEntry{HashedSize: hashed[i]}}
+	}
+	root := hfs0(rootFiles, datas)
+
+	xci := make([]byte, max(XciRootOffset+int64(len(root)), imageSize))
+	rng.Read(xci[:XciRootOffset])
+	copy(xci[XciRootOffset:], root)
+	for i := XciRootOffset + len(root); i < len(xci); i++ {
+		xci[i] = 0xFF
+	}
+
+	// 2. Gamecard header
+	h := xci[0x100:]
+	copy(h, fs.MagicXciHead)
+	binary.LittleEndian.PutUint32(h[0x18:], uint32((XciRootOffset+int64(len(root)))/fs.MediaSize))
+	rootHeaderSize := hfs0HeaderSize(rootFiles)
+	binary.LittleEndian.PutUint64(h[0x30:], XciRootOffset)
+	binary.LittleEndian.PutUint64(h[0x38:], uint64(rootHeaderSize))
+	hash := sha256.Sum256(root[:rootHeaderSize])
+	copy(h[0x40:], hash[:])
+	return xci
+}
+
+// hfs0HeaderSize is the size of the header hfs0 writes for files: the
+// string table is padded so the header fills whole MediaSize sectors.
+func hfs0HeaderSize(files []fs.Hfs0File) int {
+	size := 0x10 + len(files)*0x40
+	for _, f := range files {
+		size += len(f.Name) + 1
+	}
+	return (size + fs.MediaSize - 1) / fs.MediaSize * fs.MediaSize
+}
+
+// hfs0 returns an HFS0 of files with the given contents, each starting on an
+// xciFileAlign boundary and hashed over the HashedSize of its entry.
+func hfs0(files []fs.Hfs0File, contents [][]byte) []byte {
+	headerSize := hfs0HeaderSize(files)
+	b := make([]byte, headerSize)
+	copy(b, fs.MagicHFS0)
+	binary.LittleEndian.PutUint32(b[0x4:], uint32(len(files)))
+	stringTable := b[0x10+len(files)*0x40:]
+	binary.LittleEndian.PutUint32(b[0x8:], uint32(len(stringTable)))
+
+	nameOffset := 0
+	for i, f := range files {
+		offset := (len(b) - headerSize + xciFileAlign - 1) / xciFileAlign * xciFileAlign
+		b = append(b, make([]byte, headerSize+offset-len(b))...)
+		b = append(b, contents[i]...)
+
+		entry := b[0x10+i*0x40:]
+		binary.LittleEndian.PutUint64(entry[0x0:], uint64(offset))
+		binary.LittleEndian.PutUint64(entry[0x8:], uint64(len(contents[i])))
+		binary.LittleEndian.PutUint32(entry[0x10:], uint32(nameOffset))
+		binary.LittleEndian.PutUint32(entry[0x14:], f.Entry.HashedSize)
+		hash := sha256.Sum256(contents[i][:f.Entry.HashedSize])
+		copy(entry[0x20:], hash[:])
+		nameOffset += copy(b[0x10+len(files)*0x40+nameOffset:], f.Name) + 1
+	}
+	return b
+}
@@ -5,46 +5,121 @@ import (
 	"crypto/cipher"
 	"encoding/binary"
 	"fmt"
+	"math"
 	"sync"
+	"sync/atomic"
 )
 
+// MaxCachedCiphers bounds the cipher cache; the least recently used cipher
+// is evicted when it is full.
+const MaxCachedCiphers = 256
+
+// cachedCipher is a cache entry; lastUsed is updated under the read lock.
+type cachedCipher struct {
+	block    cipher.Block
+	lastUsed atomic.Uint64
+}
+
 // Cipher cache to avoid recreating AES ciphers for the same key
 var (
-	cipherCache   = make(map[[16]byte]cipher.Block)
+	cipherCache   = make(map[[16]byte]*cachedCipher)
 	cipherCacheMu sync.RWMutex
+	cipherClock   atomic.Uint64
+
+	cipherCacheEnabled atomic.Bool
 )
 
+func init() {
+	cipherCacheEnabled.Store(true)
+}
+
+// SetCipherCacheEnabled turns the cipher cache on or off. It is on by
+// default: a cache hit costs a fraction of building the cipher, even with 32
+// goroutines asking for the same key (BenchmarkNewBlockParallel). Turning it
+// off only saves the memory of the cached ciphers. It does not affect the
+// XTS cache of CachedXTS.
+func SetCipherCacheEnabled(enabled bool) {
+	cipherCacheEnabled.Store(enabled)
+	if !enabled {
+		cipherCacheMu.Lock()
+		cipherCache = make(map[[16]byte]*cachedCipher)
+		cipherCacheMu.Unlock()
+	}
+}
+
+// NewBlock returns an AES-128 cipher for key, from the cache when enabled.
+func NewBlock(key []byte) (cipher.Block, error) {
+	return getCachedCipher(key)
+}
+
 func getCachedCipher(key []byte) (cipher.Block, error) {
 	if len(key) != 16 {
 		return nil, fmt.Errorf("key must be 16 bytes, got %d", len(key))
 	}
+	if !cipherCacheEnabled.Load() {
+		return aes.NewCipher(key)
+	}
 
 	var keyArr [16]byte
 	copy(keyArr[:], key)
 
 	cipherCacheMu.RLock()
-	block, ok := cipherCache[keyArr]
+	entry, ok := cipherCache[keyArr]
+	if ok {
+		entry.lastUsed.Store(cipherClock.Add(1))
+	}
 	cipherCacheMu.RUnlock()
 	if ok {
-		return block, nil
+		return entry.block, nil
 	}
 
 	cipherCacheMu.Lock()
 	defer cipherCacheMu.Unlock()
 
 	// Double-check after acquiring write lock
-	if block, ok = cipherCache[keyArr]; ok {
-		return block, nil
+	if entry, ok = cipherCache[keyArr]; ok {
+		entry.lastUsed.Store(cipherClock.Add(1))
+		return entry.block, nil
 	}
 
 	block, err := aes.NewCipher(key)
 	if err != nil {
 		return nil, err
 	}
-	cipherCache[keyArr] = block
+
+	if len(cipherCache) >= MaxCachedCiphers {
+		evictOldestCipher()
+	}
+	entry = &cachedCipher{block: block}
+	entry.lastUsed.Store(cipherClock.Add(1))
+	cipherCache[keyArr] = entry
 	return block, nil
 }
 
+// evictOldestCipher removes the least recently used cipher.
+// The caller must hold cipherCacheMu for writing.
+func evictOldestCipher() {
+	var oldestKey [16]byte
+	oldest := uint64(math.MaxUint64)
+	for k, e := range cipherCache {
+		if t := e.lastUsed.Load(); t < oldest {
+			oldest, oldestKey = t, k
+		}
+	}
+	delete(cipherCache, oldestKey)
+}
+
+// ClearCipherCache drops all cached ciphers, XTS ones included.
+func ClearCipherCache() {
+	cipherCacheMu.Lock()
+	cipherCache = make(map[[16]byte]*cachedCipher)
+	cipherCacheMu.Unlock()
+
+	xtsCacheMu.Lock()
+	xtsCache = make(map[[32]byte]*XTS)
+	xtsCacheMu.Unlock()
+}
+
 // ECBDecrypt decrypts data using AES-ECB.
 // Note: ECB is not secure for general purpose, but used in Switch formats.
 func ECBDecrypt(data, key []byte) ([]byte, error) {
@@ -85,22 +160,52 @@ func ECBEncrypt(data, key []byte) ([]byte, error) {
 // NewCTRStream creates an AES-CTR stream starting at a specific absolute offset.
 // The iv contains the base counter (bytes 0-7 are section-specific).
 // Bytes 8-15 are SET to the block number (offset / 16) in big-endian.
+//
+// For NCA sections absoluteOffset is the offset from the start of the NCA,
+// not from the start of the section: the section is already identified by
+// the upper counter bytes, and the lower bytes continue across the whole file
+// (this matches hactool and the reference nsz decompressor).
 func NewCTRStream(key, iv []byte, absoluteOffset int64) (cipher.Stream, error) {
 	block, err := getCachedCipher(key)
 	if err != nil {
 		return nil, err
 	}
+	return NewCTRStreamWithBlock(block, iv, absoluteOffset), nil
+}
 
+// NewCTRStreamWithBlock is NewCTRStream with a prebuilt cipher, for callers
+// that decrypt many chunks with the same key.
+func NewCTRStreamWithBlock(block cipher.Block, iv []byte, absoluteOffset int64) cipher.Stream {
 	counter := make([]byte, 16)
 	copy(counter, iv)
 	binary.BigEndian.PutUint64(counter[8:], uint64(absoluteOffset>>4))
 
-	return cipher.NewCTR(block, counter), nil
+	return cipher.NewCTR(block, counter)
 }
 
-// XTSDecrypt decrypts data using AES-XTS (Custom NSZ Tweak).
-// key must be 32 bytes (16 bytes key1 + 16 bytes key2) for AES-128-XTS.
-func XTSDecrypt(data, key []byte, sector uint64) ([]byte, error) {
+// NewCTRStreamRaw creates an AES-CTR stream using iv verbatim as the initial
+// counter block. Use it for generic CTR data such as ticket blobs; NCA
+// sections should use NewCTRStream.
+func NewCTRStreamRaw(key, iv []byte) (cipher.Stream, error) {
+	block, err := getCachedCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(iv) != block.BlockSize() {
+		return nil, fmt.Errorf("CTR iv must be %d bytes, got %d", block.BlockSize(), len(iv))
+	}
+
+	return cipher.NewCTR(block, iv), nil
+}
+
+// XTS is an AES-128-XTS cipher with the Nintendo tweak (big-endian sector
+// number). Build it once and reuse it across sectors.
+type XTS struct {
+	k1, k2 cipher.Block
+}
+
+// NewXTS creates an XTS cipher. key must be 32 bytes (16 bytes key1 + 16 bytes key2).
+func NewXTS(key []byte) (*XTS, error) {
 	if len(key) != 32 {
 		return nil, fmt.Errorf("XTS key must be 32 bytes (2x16) for AES-128")
 	}
@@ -113,6 +218,86 @@ func XTSDecrypt(data, key []byte, sector uint64) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	return &XTS{k1: c1, k2: c2}, nil
+}
+
+// XTS cipher cache, keyed by the full 32-byte key. In practice it only ever
+// holds header_key, so it is simply reset if it fills up. It is always on:
+// SetCipherCacheEnabled only switches the AES block cache.
+var (
+	xtsCache   = make(map[[32]byte]*XTS)
+	xtsCacheMu sync.RWMutex
+)
+
+// CachedXTS returns an XTS cipher for key, reusing a cached one.
+func CachedXTS(key []byte) (*XTS, error) {
+	if len(key) != 32 {
+		return NewXTS(key)
+	}
+
+	var keyArr [32]byte
+	copy(keyArr[:], key)
+
+	xtsCacheMu.RLock()
+	x, ok := xtsCache[keyArr]
+	xtsCacheMu.RUnlock()
+	if ok {
+		return x, nil
+	}
+
+	xtsCacheMu.Lock()
+	defer xtsCacheMu.Unlock()
+
+	// Double-check after acquiring write lock
+	if x, ok = xtsCache[keyArr]; ok {
+		return x, nil
+	}
+
+	x, err := NewXTS(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(xtsCache) >= MaxCachedCiphers {
+		xtsCache = make(map[[32]byte]*XTS)
+	}
+	xtsCache[keyArr] = x
+	return x, nil
+}
+
+// XTSDecrypt decrypts data using AES-XTS (Custom NSZ Tweak).
+// key must be 32 bytes (16 bytes key1 + 16 bytes key2) for AES-128-XTS.
+func XTSDecrypt(data, key []byte, sector uint64) ([]byte, error) {
+	x, err := CachedXTS(key)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]byte, len(data))
+	if err := x.Decrypt(out, data, sector); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// Decrypt decrypts src, starting at the given sector, into dst.
+// dst and src must be the same length, a multiple of 16.
+func (x *XTS) Decrypt(dst, src []byte, sector uint64) error {
+	return x.crypt(dst, src, sector, x.k1.Decrypt)
+}
+
+// Encrypt encrypts src, starting at the given sector, into dst.
+// dst and src must be the same length, a multiple of 16.
+func (x *XTS) Encrypt(dst, src []byte, sector uint64) error {
+	return x.crypt(dst, src, sector, x.k1.Encrypt)
+}
+
+// crypt runs the XTS mode around the k1 block operation op.
+func (x *XTS) crypt(dst, src []byte, sector uint64, op func(dst, src []byte)) error {
+	if len(src)%16 != 0 {
+		return fmt.Errorf("XTS data length %d is not a multiple of 16", len(src))
+	}
+	if len(dst) < len(src) {
+		return fmt.Errorf("XTS output buffer too small")
+	}
 
 	// Initial Tweak: Big Endian Sector Number
 	tweak := make([]byte, 16)
@@ -120,29 +305,28 @@ func XTSDecrypt(data, key []byte, sector uint64) ([]byte, error) {
 
 	// Encrypt Tweak
 	tweakEnc := make([]byte, 16)
-	c2.Encrypt(tweakEnc, tweak)
+	x.k2.Encrypt(tweakEnc, tweak)
 	tweak = tweakEnc
 
-	out := make([]byte, len(data))
 	buf := make([]byte, 16)
 	dec := make([]byte, 16)
 
-	for i := 0; i < len(data); i += 16 {
-		chunk := data[i : i+16]
+	for i := 0; i < len(src); i += 16 {
+		chunk := src[i : i+16]
 
 		// C ^ T
 		xor(buf, chunk, tweak)
 
-		// D(K1, ...)
-		c1.Decrypt(dec, buf)
+		// D(K1, ...) or E(K1, ...)
+		op(dec, buf)
 
 		// ... ^ T
-		xor(out[i:i+16], dec, tweak)
+		xor(dst[i:i+16], dec, tweak)
 
 		// Update Tweak
 		mul2(tweak)
 	}
-	return out, nil
+	return nil
 }
 
 func xor(dst, a, b []byte) {
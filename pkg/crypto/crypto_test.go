@@ -0,0 +1,72 @@
+package crypto
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// ctrKey and ctrIV are the key and section counter of the CTR vectors, which
+// were generated with openssl enc -aes-128-ctr.
+var (
+	ctrKey, _ = hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	ctrIV, _  = hex.DecodeString("0123456789abcdef0000000000000000")
+)
+
+func TestNewCTRStreamKnownAnswer(t *testing.T) {
+	// At offset 0xC000 the counter is 0123456789abcdef0000000000000c00: the
+	// section bytes, then the offset in 16-byte blocks from the start of the
+	// NCA. The low half of ctrIV is ignored.
+	want, _ := hex.DecodeString("d4a1e0449558442dd8887e95291c7a6f25921e954d3c9fbaeb98eec2f21e0088380246d23ebcd47691ce2380094ee9fe")
+	iv := append([]byte(nil), ctrIV...)
+	iv[15] = 0xff
+
+	stream, err := NewCTRStream(ctrKey, iv, 0xC000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, len(want))
+	stream.XORKeyStream(got, got)
+	if !bytes.Equal(got, want) {
+		t.Errorf("keystream at 0xC000:\n got %x\nwant %x", got, want)
+	}
+}
+
+// BenchmarkNewBlockParallel builds the cipher of one key from 32 goroutines
+// per CPU, as workers decrypting blocks under one title key would, with and
+// without the cipher cache.
+func BenchmarkNewBlockParallel(b *testing.B) {
+	defer SetCipherCacheEnabled(true)
+	for _, cached := range []bool{true, false} {
+		b.Run(map[bool]string{true: "cache", false: "nocache"}[cached], func(b *testing.B) {
+			SetCipherCacheEnabled(cached)
+			b.SetParallelism(32)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					if _, err := NewBlock(ctrKey); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+func TestCachedXTSIgnoresCipherCacheSwitch(t *testing.T) {
+	defer SetCipherCacheEnabled(true)
+	key := bytes.Repeat([]byte{0x42}, 32)
+
+	first, err := CachedXTS(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetCipherCacheEnabled(false)
+	second, err := CachedXTS(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != second {
+		t.Error("disabling the cipher cache dropped or bypassed the XTS cache")
+	}
+}
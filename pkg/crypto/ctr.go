@@ -0,0 +1,48 @@
+package crypto
+
+import (
+	"crypto/cipher"
+)
+
+// CTR is an AES-CTR keystream over the offsets of an NCA, laid out like
+// NewCTRStream's, that can be moved to any offset with SeekTo. A worker keeps
+// one per section and seeks it to each chunk it decrypts.
+//
+// Seeking to where the last XORKeyStream stopped keeps the current stream, so
+// sequential chunks share one. Other seeks start a new cipher.Stream: its
+// assembly keystream is several times faster than encrypting counter blocks
+// one at a time, which outweighs the allocation. A CTR is not safe for
+// concurrent use.
+type CTR struct {
+	block  cipher.Block
+	iv     []byte
+	stream cipher.Stream
+	offset int64 // Offset the stream is at, valid when stream is not nil
+}
+
+// NewCTR returns a CTR for block and the section counter iv (bytes 0-7 are
+// used). Call SeekTo before the first XORKeyStream.
+func NewCTR(block cipher.Block, iv []byte) *CTR {
+	return &CTR{block: block, iv: append([]byte(nil), iv...)}
+}
+
+// SeekTo positions the keystream at absoluteOffset, counted from the start of
+// the NCA as for NewCTRStream.
+func (c *CTR) SeekTo(absoluteOffset int64) {
+	if c.stream != nil && c.offset == absoluteOffset {
+		return
+	}
+	c.stream = NewCTRStreamWithBlock(c.block, c.iv, absoluteOffset&^15)
+	c.offset = absoluteOffset
+	if skip := absoluteOffset & 15; skip != 0 {
+		var pad [16]byte
+		c.stream.XORKeyStream(pad[:skip], pad[:skip])
+	}
+}
+
+// XORKeyStream XORs src with the keystream at the current offset into dst and
+// advances the offset by len(src). dst and src may overlap exactly.
+func (c *CTR) XORKeyStream(dst, src []byte) {
+	c.stream.XORKeyStream(dst, src)
+	c.offset += int64(len(src))
+}
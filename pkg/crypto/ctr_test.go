@@ -0,0 +1,60 @@
+package crypto
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestCTRSeekTo(t *testing.T) {
+	block, err := NewBlock(ctrKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The keystream from 0, streamed in one go
+	const size = 0x10000
+	want := make([]byte, size)
+	NewCTRStreamWithBlock(block, ctrIV, 0).XORKeyStream(want, want)
+
+	// Forward, backward, unaligned and sequential seeks
+	c := NewCTR(block, ctrIV)
+	for _, r := range []struct{ offset, n int64 }{
+		{0, 16}, {16, 100}, {116, 3}, {0x8000, 0x1000}, {5, 11}, {0x9001, 0x2fff}, {0xc000, 0x4000}, {0x7ff, 1},
+	} {
+		c.SeekTo(r.offset)
+		got := make([]byte, r.n)
+		c.XORKeyStream(got, got)
+		if !bytes.Equal(got, want[r.offset:r.offset+r.n]) {
+			t.Errorf("0x%x bytes at 0x%x differ from the streamed keystream", r.n, r.offset)
+		}
+	}
+}
+
+// BenchmarkCTR decrypts consecutive 1 MB chunks, as a compression worker
+// does, with a CTR moved by SeekTo and with a new stream for every chunk.
+func BenchmarkCTR(b *testing.B) {
+	block, err := NewBlock(ctrKey)
+	if err != nil {
+		b.Fatal(err)
+	}
+	chunk := make([]byte, 1<<20)
+
+	b.Run("seek", func(b *testing.B) {
+		b.SetBytes(int64(len(chunk)))
+		c := NewCTR(block, ctrIV)
+		var offset int64
+		for b.Loop() {
+			c.SeekTo(offset)
+			c.XORKeyStream(chunk, chunk)
+			offset += int64(len(chunk))
+		}
+	})
+	b.Run("new stream", func(b *testing.B) {
+		b.SetBytes(int64(len(chunk)))
+		var offset int64
+		for b.Loop() {
+			NewCTRStreamWithBlock(block, ctrIV, offset).XORKeyStream(chunk, chunk)
+			offset += int64(len(chunk))
+		}
+	})
+}
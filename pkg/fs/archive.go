@@ -0,0 +1,193 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/falk/nsz-go/pkg/nsz"
+)
+
+// ContainerType identifies a container format.
+type ContainerType int
+
+const (
+	ContainerUnknown ContainerType = iota
+	ContainerPFS0                  // NSP / NSZ
+	ContainerHFS0                  // Gamecard partition
+	ContainerXCI                   // Gamecard image / XCZ
+	ContainerNCA                   // Single NCA
+	ContainerNCZ                   // Single NCZ
+)
+
+func (t ContainerType) String() string {
+	switch t {
+	case ContainerPFS0:
+		return "PFS0"
+	case ContainerHFS0:
+		return "HFS0"
+	case ContainerXCI:
+		return "XCI"
+	case ContainerNCA:
+		return "NCA"
+	case ContainerNCZ:
+		return "NCZ"
+	}
+	return "unknown"
+}
+
+// ErrUnknownContainer is returned for data that is not a known container.
+var ErrUnknownContainer = errors.New("unknown container format")
+
+// Archive is a read-only view of the files in a container. Files of an XCI
+// are listed as "<partition>/<name>".
+type Archive interface {
+	List() []string
+	Open(name string) (io.ReadSeeker, error)
+	Type() ContainerType
+	Close() error
+}
+
+// OpenArchive opens the container at path, choosing the format by its magic.
+func OpenArchive(path string) (Archive, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	a, err := NewArchive(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	a.(*archive).closer = f
+	return a, nil
+}
+
+// NewArchive returns an Archive over r, choosing the format by its magic.
+// Closing it does not close r.
+func NewArchive(r io.ReaderAt) (Archive, error) {
+	typ, err := DetectContainer(r)
+	if err != nil {
+		return nil, err
+	}
+
+	a := &archive{typ: typ, files: make(map[string]*io.SectionReader)}
+	switch typ {
+	case ContainerPFS0:
+		files, headerSize, err := OpenPfs0(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			a.add(file.Name, io.NewSectionReader(r, headerSize+int64(file.Entry.DataOffset), int64(file.Entry.DataSize)))
+		}
+	case ContainerHFS0:
+		if err := a.addHfs0(r, 0, ""); err != nil {
+			return nil, err
+		}
+	case ContainerXCI:
+		h, err := ParseXciHeader(r)
+		if err != nil {
+			return nil, err
+		}
+		rootOffset := int64(h.RootHfs0Offset)
+		partitions, rootHeaderSize, err := OpenHfs0(r, rootOffset)
+		if err != nil {
+			return nil, fmt.Errorf("root partition: %w", err)
+		}
+		for _, p := range partitions {
+			if err := a.addHfs0(r, rootOffset+rootHeaderSize+int64(p.Entry.DataOffset), p.Name+"/"); err != nil {
+				return nil, fmt.Errorf("partition %s: %w", p.Name, err)
+			}
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s is not an archive", ErrUnknownContainer, typ)
+	}
+	return a, nil
+}
+
+// DetectContainer identifies the format of r by its magic rather than its
+// file name: PFS0 or HFS0 at the start, the gamecard HEAD at 0x100, the NCZ
+// section table after the NCA header, or an NCA header that decrypts with the
+// loaded header_key. Only the last needs keys.
+func DetectContainer(r io.ReaderAt) (ContainerType, error) {
+	magic := make([]byte, 4)
+	if _, err := r.ReadAt(magic, 0); err == nil {
+		switch string(magic) {
+		case MagicPFS0:
+			return ContainerPFS0, nil
+		case MagicHFS0:
+			return ContainerHFS0, nil
+		}
+	}
+	if _, err := r.ReadAt(magic, xciHeaderOffset); err == nil && string(magic) == MagicXciHead {
+		return ContainerXCI, nil
+	}
+	if IsNcz(r) {
+		return ContainerNCZ, nil
+	}
+	if _, err := ParseNcaHeader(r); err == nil {
+		return ContainerNCA, nil
+	}
+	return ContainerUnknown, ErrUnknownContainer
+}
+
+// IsNcz reports whether r has an NCZ section table after its NCA header. It
+// needs no keys, but does not check that the header itself is valid.
+func IsNcz(r io.ReaderAt) bool {
+	sectn := make([]byte, len(nsz.MagicNCZSECTN))
+	_, err := r.ReadAt(sectn, NcaFullHeaderSize)
+	return err == nil && string(sectn) == nsz.MagicNCZSECTN
+}
+
+// archive implements Archive for PFS0, HFS0 and XCI.
+type archive struct {
+	typ    ContainerType
+	names  []string
+	files  map[string]*io.SectionReader
+	closer io.Closer
+}
+
+func (a *archive) add(name string, sr *io.SectionReader) {
+	a.names = append(a.names, name)
+	a.files[name] = sr
+}
+
+// addHfs0 adds the files of the HFS0 at offset, prefixing their names.
+func (a *archive) addHfs0(r io.ReaderAt, offset int64, prefix string) error {
+	files, headerSize, err := OpenHfs0(r, offset)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		a.add(prefix+file.Name, io.NewSectionReader(r, offset+headerSize+int64(file.Entry.DataOffset), int64(file.Entry.DataSize)))
+	}
+	return nil
+}
+
+// List returns the file names in container order.
+func (a *archive) List() []string {
+	return append([]string(nil), a.names...)
+}
+
+// Open returns a reader for the named file.
+func (a *archive) Open(name string) (io.ReadSeeker, error) {
+	sr, ok := a.files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+	}
+	return io.NewSectionReader(sr, 0, sr.Size()), nil
+}
+
+func (a *archive) Type() ContainerType {
+	return a.typ
+}
+
+// Close closes the file opened by OpenArchive.
+func (a *archive) Close() error {
+	if a.closer != nil {
+		return a.closer.Close()
+	}
+	return nil
+}
@@ -2,6 +2,7 @@ package fs
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 
 	"github.com/falk/nsz-go/pkg/crypto"
@@ -50,13 +51,17 @@ func ParseBktrHeader(data []byte) *BktrHeader {
 }
 
 // ParseBktrSubsectionBuckets reads and decrypts subsection buckets from NCA data.
-// The bucket data is encrypted with the section's base counter.
+// The bucket data is encrypted with the section's base counter. It returns no
+// buckets if the section has no table, and an error if the table is malformed.
 func ParseBktrSubsectionBuckets(r io.ReaderAt, sectionOffset int64, bktrHeader *BktrHeader, titleKey []byte, baseCounter []byte) ([]BktrBucket, error) {
 	if bktrHeader == nil || bktrHeader.Size == 0 {
 		return nil, nil
 	}
-	if titleKey == nil || len(baseCounter) < 16 {
-		return nil, nil
+	if titleKey == nil {
+		return nil, fmt.Errorf("no key to decrypt the subsection table")
+	}
+	if len(baseCounter) < 16 {
+		return nil, fmt.Errorf("base counter is %d bytes, expected 16", len(baseCounter))
 	}
 
 	// Read the entire BKTR data area (it's encrypted)
@@ -76,19 +81,15 @@ func ParseBktrSubsectionBuckets(r io.ReaderAt, sectionOffset int64, bktrHeader *
 
 	// Parse decrypted bucket header
 	// Structure: padding(4) + bucketCount(4) + totalSize(8) + baseOffsets(0x3FF0)
-	if len(bktrData) < 16 {
-		return nil, nil
+	// Buckets start after header (16 bytes) + base offsets (0x3FF0 bytes)
+	headerSize := 16 + 0x3FF0
+	if len(bktrData) < headerSize {
+		return nil, fmt.Errorf("subsection table is 0x%x bytes, shorter than its 0x%x-byte header", len(bktrData), headerSize)
 	}
 
 	bucketCount := binary.LittleEndian.Uint32(bktrData[4:8])
 	if bucketCount == 0 || bucketCount > 100 {
-		return nil, nil
-	}
-
-	// Buckets start after header (16 bytes) + base offsets (0x3FF0 bytes)
-	headerSize := 16 + 0x3FF0
-	if len(bktrData) < headerSize {
-		return nil, nil
+		return nil, fmt.Errorf("implausible bucket count %d (wrong key?)", bucketCount)
 	}
 
 	buckets := make([]BktrBucket, 0, bucketCount)
@@ -96,7 +97,7 @@ func ParseBktrSubsectionBuckets(r io.ReaderAt, sectionOffset int64, bktrHeader *
 
 	for i := uint32(0); i < bucketCount; i++ {
 		if bucketPos+16 > len(bktrData) {
-			break
+			return nil, fmt.Errorf("bucket %d of %d runs past the subsection table", i, bucketCount)
 		}
 
 		bucket := BktrBucket{
@@ -106,14 +107,14 @@ func ParseBktrSubsectionBuckets(r io.ReaderAt, sectionOffset int64, bktrHeader *
 		}
 
 		if bucket.EntryCount > 0xFFFF {
-			break
+			return nil, fmt.Errorf("bucket %d: implausible entry count %d", i, bucket.EntryCount)
 		}
 
 		entriesPos := bucketPos + 16
 		for j := uint32(0); j < bucket.EntryCount; j++ {
 			entryPos := entriesPos + int(j)*16
 			if entryPos+16 > len(bktrData) {
-				break
+				return nil, fmt.Errorf("bucket %d: entry %d runs past the subsection table", i, j)
 			}
 
 			entry := BktrSubsectionEntry{
@@ -0,0 +1,179 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+// Content meta types, from the .cnmt header
+const (
+	CnmtTypeApplication  = 0x80
+	CnmtTypePatch        = 0x81
+	CnmtTypeAddOnContent = 0x82
+	CnmtTypeDelta        = 0x83
+	CnmtTypeDataPatch    = 0x84
+)
+
+// CnmtTypeNames maps content meta types to their lower-case names.
+var CnmtTypeNames = map[byte]string{
+	CnmtTypeApplication:  "application",
+	CnmtTypePatch:        "patch",
+	CnmtTypeAddOnContent: "addon",
+	CnmtTypeDelta:        "delta",
+	CnmtTypeDataPatch:    "datapatch",
+}
+
+const (
+	cnmtHeaderSize = 0x20
+	cnmtRecordSize = 0x38
+
+	// maxMetaSectionSize bounds what ReadCnmt reads into memory; meta
+	// sections are a few KB.
+	maxMetaSectionSize = 1 << 24
+)
+
+// ErrNoCnmt is returned by ReadCnmt when the NSP has no meta NCA that can be
+// read, or the meta NCA has no .cnmt file.
+var ErrNoCnmt = errors.New("no content meta found")
+
+// Cnmt is the content meta of a title: what its meta NCA lists.
+type Cnmt struct {
+	TitleID  uint64
+	Version  uint32
+	Type     byte // CnmtTypeApplication, CnmtTypePatch, ...
+	Contents []CnmtContent
+}
+
+// CnmtContent is a content record of a Cnmt: one NCA of the title.
+type CnmtContent struct {
+	Hash      [0x20]byte // SHA-256 of the NCA
+	ContentID [0x10]byte
+	Size      uint64
+	Type      byte // Content record type; 0 meta, 1 program, 2 data, 3 control, ...
+	IDOffset  byte
+}
+
+// TypeName returns the name of the meta type, or "unknown".
+func (c *Cnmt) TypeName() string {
+	if name, ok := CnmtTypeNames[c.Type]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseCnmt parses a .cnmt file: the header, the extended header, which is
+// skipped, then the content records.
+func ParseCnmt(b []byte) (*Cnmt, error) {
+	if len(b) < cnmtHeaderSize {
+		return nil, fmt.Errorf("cnmt too small: %d bytes", len(b))
+	}
+	c := &Cnmt{
+		TitleID: binary.LittleEndian.Uint64(b[0x0:]),
+		Version: binary.LittleEndian.Uint32(b[0x8:]),
+		Type:    b[0xC],
+	}
+	extendedHeaderSize := int(binary.LittleEndian.Uint16(b[0xE:]))
+	contentCount := int(binary.LittleEndian.Uint16(b[0x10:]))
+
+	start := cnmtHeaderSize + extendedHeaderSize
+	if end := start + contentCount*cnmtRecordSize; end > len(b) {
+		return nil, fmt.Errorf("cnmt has %d content records but ends at 0x%x", contentCount, len(b))
+	}
+	c.Contents = make([]CnmtContent, contentCount)
+	for i := range c.Contents {
+		rec := b[start+i*cnmtRecordSize:]
+		content := &c.Contents[i]
+		copy(content.Hash[:], rec[0x0:0x20])
+		copy(content.ContentID[:], rec[0x20:0x30])
+		// The size is 48 bits
+		content.Size = uint64(binary.LittleEndian.Uint32(rec[0x30:])) | uint64(binary.LittleEndian.Uint16(rec[0x34:]))<<32
+		content.Type = rec[0x36]
+		content.IDOffset = rec[0x37]
+	}
+	return c, nil
+}
+
+// ReadCnmt reads the content meta of a meta NCA from the .cnmt file in its
+// PFS0 section.
+func (n *NCA) ReadCnmt() (*Cnmt, error) {
+	if n.Header.ContentType != ContentTypeMeta {
+		return nil, fmt.Errorf("%w: %s NCA", ErrNoCnmt, ContentTypeName(n.Header.ContentType))
+	}
+
+	// 1. Decrypt the PFS0 of the first section, hash tables skipped
+	start, end, err := n.sectionFs(0, FsTypePfs0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoCnmt, err)
+	}
+	if end-start > maxMetaSectionSize {
+		return nil, fmt.Errorf("meta section at 0x%x is 0x%x bytes", start, end-start)
+	}
+	ciphers, err := n.bodyCiphers()
+	if err != nil {
+		return nil, err
+	}
+	buf, err := n.readDecrypted(ciphers, start, end-start)
+	if err != nil {
+		return nil, err
+	}
+
+	// 2. Find the .cnmt file
+	r := bytes.NewReader(buf)
+	files, headerSize, err := OpenPfs0(r)
+	if err != nil {
+		return nil, fmt.Errorf("meta section: %w", err)
+	}
+	for _, file := range files {
+		if !strings.EqualFold(filepath.Ext(file.Name), ".cnmt") {
+			continue
+		}
+		b := make([]byte, file.Entry.DataSize)
+		if _, err := r.ReadAt(b, headerSize+int64(file.Entry.DataOffset)); err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name, err)
+		}
+		return ParseCnmt(b)
+	}
+	return nil, fmt.Errorf("%w: meta section has no .cnmt file", ErrNoCnmt)
+}
+
+// ReadCnmt reads the content meta of the NSP or NSZ r, from the first meta
+// NCA among its members. A meta NCA stored as NCZ is decompressed in memory.
+// It returns ErrNoCnmt if there is none, or none whose header can be read.
+func ReadCnmt(r io.ReaderAt) (*Cnmt, error) {
+	files, headerSize, err := OpenPfs0(r)
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		if !isNcaName(file.Name) {
+			continue
+		}
+		var member io.ReaderAt = io.NewSectionReader(r, headerSize+int64(file.Entry.DataOffset), int64(file.Entry.DataSize))
+		nca, err := NewNCA(member)
+		if err != nil || nca.Header.ContentType != ContentTypeMeta {
+			continue
+		}
+		if IsNcz(member) {
+			if nca.Header.ContentSize > maxMetaSectionSize {
+				return nil, fmt.Errorf("%s: meta NCA is 0x%x bytes", file.Name, nca.Header.ContentSize)
+			}
+			var restored bytes.Buffer
+			if _, err := DecompressNca(member, &restored); err != nil {
+				return nil, fmt.Errorf("%s: %w", file.Name, err)
+			}
+			member = bytes.NewReader(restored.Bytes())
+			nca.Reader = member
+		}
+		c, err := nca.ReadCnmt()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name, err)
+		}
+		return c, nil
+	}
+	return nil, ErrNoCnmt
+}
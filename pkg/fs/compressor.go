@@ -1,11 +1,17 @@
 package fs
 
 import (
+	"crypto/cipher"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"os"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/falk/nsz-go/pkg/crypto"
 	"github.com/falk/nsz-go/pkg/nsz"
@@ -14,85 +20,477 @@ import (
 
 const (
 	DefaultBlockSizeEx      = 20 // 1MB blocks (2^20)
+	MaxBlockSizeEx          = nsz.MaxBlockSizeExp
 	DefaultCompressionLevel = 18 // Matches Python default
+	DefaultMinCompressSize  = 0x4000
 )
 
+var (
+	// ErrNcaTooSmall is returned when an NCA has no data past its full header.
+	ErrNcaTooSmall = errors.New("nca too small to compress")
+	// ErrNcaTruncated is returned when an NCA is shorter than its header's
+	// content size.
+	ErrNcaTruncated = errors.New("nca is truncated")
+	// ErrNotCompressible is returned when the NCZ would not be smaller than the NCA.
+	ErrNotCompressible = errors.New("nca is not compressible")
+	// ErrNoSections is returned for an NCA whose section table is empty, so
+	// nothing is known about how its body is encrypted. It wraps
+	// ErrNotCompressible, so such NCAs are stored as they are.
+	ErrNoSections = fmt.Errorf("%w: nca has no sections", ErrNotCompressible)
+	// ErrSparseSection is returned for an NCA with a sparse section layer,
+	// whose stored data is not laid out or encrypted like the section's media
+	// range says. It wraps ErrNotCompressible, so such NCAs are stored as
+	// they are rather than decrypted wrongly.
+	ErrSparseSection = fmt.Errorf("%w: nca has a sparse section", ErrNotCompressible)
+	// ErrNoDecryptionKey is returned when an NCA has encrypted sections but
+	// neither a title key nor a decryptable key area.
+	ErrNoDecryptionKey = errors.New("no key to decrypt nca")
+	// ErrUnsupportedBlockType is returned for an NCZ block type with no codec.
+	ErrUnsupportedBlockType = errors.New("unsupported ncz block type")
+	// ErrWrongKey is returned when a decrypted section does not start with the
+	// filesystem header its FS type promises, meaning the key is wrong.
+	ErrWrongKey = errors.New("nca section did not decrypt, wrong key")
+	// ErrBlockHashMismatch is returned for an NCZ block that does not match
+	// its hash in the block hash trailer.
+	ErrBlockHashMismatch = errors.New("ncz block hash mismatch")
+	// ErrNoBlockHashes is returned by VerifyNczBlocks for an NCZ without a
+	// block hash trailer.
+	ErrNoBlockHashes = errors.New("ncz has no block hashes")
+)
+
+// DefaultPrecheckBlocks is the number of blocks test-compressed before
+// committing to compress an NCA.
+const DefaultPrecheckBlocks = 4
+
+// minPrecheckSavings is the fraction the sampled blocks must shrink by.
+const minPrecheckSavings = 0.01
+
+// CompressResult describes the outcome of compressing one NCA.
+type CompressResult struct {
+	InputSize    int64  // Size of the source NCA
+	OutputSize   int64  // Bytes written
+	Stored       bool   // Compression did not help, so the original NCA was stored verbatim
+	Blocks       uint32 // Blocks in the NCZ
+	StoredBlocks uint32 // Blocks kept raw because they did not shrink
+	SlowBlocks   uint32 // Blocks compressed at FallbackLevel after exceeding BlockTimeBudget
+	Warnings     []string
+	NCA          *NCA // The parsed source NCA, for reusing its header
+}
+
+// ContentType returns the content type of the compressed NCA, if its header
+// was read (it is not with CompressOptions.NoDecrypt).
+func (r *CompressResult) ContentType() (byte, bool) {
+	if r.NCA == nil {
+		return 0, false
+	}
+	return r.NCA.Header.ContentType, true
+}
+
+// CompressOptions controls how CompressNca compresses an NCA.
+// The zero value selects the defaults.
+//
+// Peak memory used by the block pipeline is roughly
+// Workers * (1 << BlockSizeExp) * 2: each worker owns one read buffer, and at
+// most Workers finished blocks wait to be written in order. With a
+// BlockTimeBudget, up to Workers abandoned attempts each keep their block and
+// its output as well, doubling that.
+type CompressOptions struct {
+	// Level is the zstd compression level (1-22). Zero means DefaultCompressionLevel.
+	Level int
+	// Workers is the number of parallel compression goroutines.
+	// Zero falls back to GOMAXPROCS, then NumCPU.
+	Workers int
+	// BlockSizeExp is the NCZ block size exponent, at most MaxBlockSizeEx.
+	// Zero means DefaultBlockSizeEx.
+	BlockSizeExp int
+	// CompressContentTypes is the set of NCA content types worth compressing.
+	// Nil means DefaultCompressContentTypes.
+	CompressContentTypes map[byte]bool
+	// MinSize is the smallest NCA size worth compressing. Zero means no
+	// minimum and negative means DefaultMinCompressSize. NCAs no larger than
+	// NcaFullHeaderSize are never compressed either way, since they have no
+	// body.
+	MinSize int64
+	// PrecheckBlocks is how many blocks, spread across the body, are
+	// test-compressed first; if they save less than 1% the NCA is reported as
+	// ErrNotCompressible. Zero means DefaultPrecheckBlocks; negative disables
+	// the check.
+	PrecheckBlocks int
+	// AllowEncrypted compresses NCAs whose body key is unavailable or wrong
+	// instead of failing with ErrNoDecryptionKey or ErrWrongKey. Sections
+	// without a key go into the NCZ as stored, still encrypted, under
+	// CryptoTypeNone, so that nothing decrypts or re-encrypts them. Sections
+	// with a wrong key are "decrypted" into noise, which decompression
+	// encrypts back with the same key. Either way the NCZ restores the exact
+	// NCA, but those sections save next to nothing.
+	AllowEncrypted bool
+	// HeaderKey decrypts the NCA header. Nil means the loaded header_key.
+	HeaderKey []byte
+	// Dict is a raw zstd dictionary the blocks are compressed against. The
+	// NCZ can then only be decompressed with the same dictionary, which
+	// NSZs carry in a trailer (nsz.DictTrailer); other tools cannot read it.
+	Dict []byte
+	// BlockType is the NCZ block type, which selects the codec. Zero means
+	// nsz.BlockTypeZstd (the stored type 0 cannot be requested; NCAs that do
+	// not compress are stored whole instead). Only zstd is implemented.
+	BlockType uint8
+	// CheckpointBlocks, if positive, makes CompressNca call Checkpoint every
+	// CheckpointBlocks blocks with the sizes of the blocks written so far.
+	// After Checkpoint returns, the NCZ can be continued from that point by
+	// passing the sizes back as Resume, as long as the output up to the last
+	// of those blocks is kept. Checkpoint should flush the output first.
+	CheckpointBlocks uint32
+	Checkpoint       func(sizes []uint32) error
+	// NoDecrypt compresses the body as stored, still encrypted, under a
+	// single pass-through section, without reading the NCA header. No keys
+	// are needed to compress or decompress, and the NCZ restores the exact
+	// NCA, but it barely shrinks. It is never chosen implicitly.
+	NoDecrypt bool
+	// Resume holds the block sizes of a checkpoint to continue an
+	// interrupted NCZ from. w must be positioned where that NCZ started, and
+	// the other options must match the interrupted run.
+	Resume []uint32
+	// BlockHashes appends a CRC-32C of every block to the NCZ
+	// (nsz.BlockHashTrailer), so single damaged blocks can be found without
+	// decompressing. A resumed NCZ is read back from w to hash the blocks it
+	// already has, so w must then be an io.ReaderAt.
+	BlockHashes bool
+	// BlockTimeBudget, if positive, bounds the time spent compressing one
+	// block. A block that takes longer is compressed again at FallbackLevel
+	// instead, keeping the worst case latency down at high levels while easy
+	// blocks still get the full level. The abandoned attempt finishes in the
+	// background, so this bounds latency rather than CPU time. At most
+	// Workers attempts run in the background; past that a slow block waits
+	// for its own attempt. CompressNca returns once they have all finished.
+	BlockTimeBudget time.Duration
+}
+
+// FallbackLevel is the level blocks over CompressOptions.BlockTimeBudget are
+// compressed at: the fastest encoder, which takes milliseconds per block.
+const FallbackLevel = 1
+
+// DefaultCompressContentTypes are the content types compressed by default:
+// Program and PublicData hold nearly all of the data in a title.
+var DefaultCompressContentTypes = map[byte]bool{
+	ContentTypeProgram:    true,
+	ContentTypePublicData: true,
+}
+
+// ShouldCompressSize reports whether an NCA of the given size should be compressed.
+func (o CompressOptions) ShouldCompressSize(size int64) bool {
+	minSize := o.MinSize
+	if minSize < 0 {
+		minSize = DefaultMinCompressSize
+	}
+	return size > NcaFullHeaderSize && size >= minSize
+}
+
+// ShouldCompressType reports whether NCAs of the given content type should be compressed.
+func (o CompressOptions) ShouldCompressType(ct byte) bool {
+	if o.CompressContentTypes == nil {
+		return DefaultCompressContentTypes[ct]
+	}
+	return o.CompressContentTypes[ct]
+}
+
+// blockType returns the effective NCZ block type.
+func (o CompressOptions) blockType() uint8 {
+	if o.BlockType == nsz.BlockTypeStored {
+		return nsz.BlockTypeZstd
+	}
+	return o.BlockType
+}
+
+// level returns the effective compression level.
+func (o CompressOptions) level() int {
+	if o.Level <= 0 {
+		return DefaultCompressionLevel
+	}
+	return o.Level
+}
+
+// blockSizeExp returns the effective block size exponent.
+func (o CompressOptions) blockSizeExp() int {
+	if o.BlockSizeExp <= 0 {
+		return DefaultBlockSizeEx
+	}
+	return o.BlockSizeExp
+}
+
+// workers returns the effective worker count.
+// GOMAXPROCS honours container CPU limits, unlike NumCPU.
+func (o CompressOptions) workers() int {
+	if o.Workers > 0 {
+		return o.Workers
+	}
+	if n := runtime.GOMAXPROCS(0); n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
+}
+
 // CompressNca compresses a single NCA stream to NCZ format.
-func CompressNca(r io.ReaderAt, w io.Writer, totalSize int64, titleKey []byte, compressionLevel int) (int64, error) {
-	nca, err := NewNCA(r)
+//
+// If the NCZ would not be smaller than the NCA, CompressNca returns
+// ErrNotCompressible and seeks w back to where it started; the caller should
+// store the original NCA instead and overwrite or truncate what was written.
+//
+// The block size table precedes the blocks, so w is written out of order. If
+// w cannot seek (a pipe, say), the NCZ is built in a temporary file and then
+// copied to w, and nothing is written to w if it does not compress.
+func CompressNca(r io.ReaderAt, w io.Writer, totalSize int64, titleKey []byte, opts CompressOptions) (*CompressResult, error) {
+	if totalSize <= NcaFullHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrNcaTooSmall, totalSize)
+	}
+
+	// Without decryption the header is never read, so no keys are needed
+	if opts.NoDecrypt {
+		return compressSections(r, w, totalSize, rawSections(totalSize), opts)
+	}
+
+	nca, err := NewNCAWithHeaderKey(r, opts.HeaderKey)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	return CompressParsedNca(nca, w, totalSize, titleKey, opts)
+}
+
+// CompressParsedNca is CompressNca for an NCA the caller has already opened,
+// so its header is not decrypted and parsed again. The data is read from
+// nca.Reader, and a non-nil titleKey is stored in nca.Header. Either way the
+// result carries the NCA.
+func CompressParsedNca(nca *NCA, w io.Writer, totalSize int64, titleKey []byte, opts CompressOptions) (*CompressResult, error) {
+	if nca == nil {
+		return nil, errors.New("nil NCA")
+	}
+	if totalSize <= NcaFullHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrNcaTooSmall, totalSize)
+	}
+	if bt := opts.blockType(); bt != nsz.BlockTypeZstd {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedBlockType, bt)
+	}
+	r := nca.Reader
 
 	if titleKey != nil {
 		nca.Header.TitleKey = titleKey
 	}
 
-	ws, ok := w.(io.WriteSeeker)
-	if !ok {
-		return 0, fmt.Errorf("writer must support seeking")
+	// The header's content size is authoritative: the sections end within it,
+	// and bytes past it are container padding. They are kept as a raw tail
+	// outside every section, so the NCZ still restores the whole NCA.
+	var warnings []string
+	sectionsEnd := totalSize
+	if contentSize := int64(nca.Header.ContentSize); contentSize > totalSize {
+		return nil, fmt.Errorf("%w: header says 0x%x bytes, got 0x%x", ErrNcaTruncated, contentSize, totalSize)
+	} else if contentSize > NcaFullHeaderSize && contentSize < totalSize {
+		warnings = append(warnings, fmt.Sprintf("nca is 0x%x bytes but its header says 0x%x; kept the 0x%x trailing bytes unencrypted", totalSize, contentSize, totalSize-contentSize))
+		sectionsEnd = contentSize
+	}
+
+	if opts.NoDecrypt {
+		res, err := compressSections(r, w, totalSize, rawSections(sectionsEnd), opts)
+		if res != nil {
+			res.NCA = nca
+			res.Warnings = warnings
+		}
+		return res, err
+	}
+
+	sections, err := nca.GetEncryptionSections()
+	if err != nil {
+		return nil, err
+	}
+	if len(sections) == 0 {
+		return nil, ErrNoSections
+	}
+	if opts.AllowEncrypted {
+		sections = passKeylessSections(sections)
+	} else {
+		if err := checkSectionKeys(sections); err != nil {
+			return nil, err
+		}
+		if err := nca.checkDecryption(r, sections); err != nil {
+			return nil, err
+		}
+	}
+
+	res, err := compressSections(r, w, totalSize, sections, opts)
+	if res != nil {
+		res.NCA = nca
+		res.Warnings = warnings
+	}
+	return res, err
+}
+
+// compressSections is compressSectionsTo for any writer, building the NCZ in
+// a temporary file first if w cannot seek.
+func compressSections(r io.ReaderAt, w io.Writer, totalSize int64, sections []nsz.NczSectionEntry, opts CompressOptions) (*CompressResult, error) {
+	if ws, ok := w.(io.WriteSeeker); ok {
+		// Files such as os.Stdout implement Seek but fail it on a pipe
+		if _, err := ws.Seek(0, io.SeekCurrent); err == nil {
+			return compressSectionsTo(r, ws, totalSize, sections, opts)
+		}
+	}
+	if opts.Checkpoint != nil || opts.Resume != nil {
+		return nil, errors.New("checkpoints need a seekable writer")
+	}
+
+	tmp, err := os.CreateTemp("", "nsz-*.ncz")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	res, err := compressSectionsTo(r, tmp, totalSize, sections, opts)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(w, tmp, res.OutputSize); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// rawSections returns the NCZ section table of CompressOptions.NoDecrypt: one
+// section over the whole body that is neither decrypted nor re-encrypted.
+func rawSections(totalSize int64) []nsz.NczSectionEntry {
+	return []nsz.NczSectionEntry{{
+		Offset:     NcaFullHeaderSize,
+		Size:       uint64(totalSize - NcaFullHeaderSize),
+		CryptoType: CryptoTypeNone,
+	}}
+}
+
+// compressSectionsTo writes the NCZ of the NCA r, decrypting the body as the
+// sections say.
+func compressSectionsTo(r io.ReaderAt, ws io.WriteSeeker, totalSize int64, sections []nsz.NczSectionEntry, opts CompressOptions) (*CompressResult, error) {
+	blockHeader, err := newBlockHeader(totalSize, opts)
+	if err != nil {
+		return nil, err
+	}
+	blockCount := blockHeader.BlockCount
+	if uint32(len(opts.Resume)) > blockCount {
+		return nil, fmt.Errorf("resume: %d blocks done of %d", len(opts.Resume), blockCount)
+	}
+
+	// Give up before writing anything if a sample of blocks barely compresses.
+	// A resumed NCZ already passed this check.
+	if opts.Resume == nil {
+		worth, err := worthCompressing(r, totalSize, int64(blockHeader.BlockSize()), sections, opts)
+		if err != nil {
+			return nil, err
+		}
+		if !worth {
+			return nil, ErrNotCompressible
+		}
 	}
 
 	startPos, _ := ws.Seek(0, io.SeekCurrent)
 
-	// 1. Copy uncompressable header
+	// 1-3. Header, section table, block header and a placeholder size table.
+	// The header goes in still encrypted, as read: NCZs keep it exactly as
+	// in the NCA, and DecompressNca copies it back without re-encrypting
+	// (NcaHeader.DecryptedHeaderBytes is for inspecting it, not for this).
 	headerBuf := make([]byte, NcaFullHeaderSize)
-	if _, err := r.ReadAt(headerBuf, 0); err != nil {
-		return 0, err
+	if err := readFullAt(r, headerBuf, 0); err != nil {
+		return nil, fmt.Errorf("read header: %w", err)
 	}
-	if _, err := ws.Write(headerBuf); err != nil {
-		return 0, err
+	sizeListOffset, err := writeNczStart(ws, headerBuf, sections, &blockHeader)
+	if err != nil {
+		return nil, err
 	}
 
-	// 2. Write section header
-	sections, err := nca.GetEncryptionSections()
+	// 4. Parallel compression, streamed to the output in block order. A
+	// resumed NCZ continues after the blocks it already has.
+	if opts.Resume != nil {
+		var done int64
+		for _, size := range opts.Resume {
+			done += int64(size)
+		}
+		if _, err := ws.Seek(sizeListOffset+int64(blockCount)*4+done, io.SeekStart); err != nil {
+			return nil, err
+		}
+	}
+	compressedSizes, hashes, counts, err := compressBlocks(r, ws, totalSize, &blockHeader, sections, opts)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	if err := nsz.WriteNczHeader(ws, sections); err != nil {
-		return 0, err
+	if opts.BlockHashes && len(opts.Resume) > 0 {
+		if err := hashWrittenBlocks(ws, sizeListOffset+int64(blockCount)*4, opts.Resume, hashes); err != nil {
+			return nil, err
+		}
+	}
+
+	// 5-6. Size table and block hashes
+	endPos, err := writeNczEnd(ws, sizeListOffset, compressedSizes, hashes)
+	if err != nil {
+		return nil, err
 	}
 
-	// 3. Write block header
-	blockSize := int64(1) << DefaultBlockSizeEx
+	outputSize := endPos - startPos
+	if outputSize >= totalSize {
+		if _, err := ws.Seek(startPos, io.SeekStart); err != nil {
+			return nil, err
+		}
+		return nil, ErrNotCompressible
+	}
+
+	return &CompressResult{InputSize: totalSize, OutputSize: outputSize, Blocks: blockCount, StoredBlocks: counts.stored, SlowBlocks: counts.slow}, nil
+}
+
+// newBlockHeader returns the NCZ block header for an NCA of totalSize bytes
+// compressed with opts.
+func newBlockHeader(totalSize int64, opts CompressOptions) (nsz.NczBlockHeader, error) {
+	blockSizeExp := opts.blockSizeExp()
+	if blockSizeExp > MaxBlockSizeEx {
+		return nsz.NczBlockHeader{}, fmt.Errorf("block size exponent %d is above the maximum of %d", blockSizeExp, MaxBlockSizeEx)
+	}
+	blockSize := int64(1) << blockSizeExp
 	dataSize := totalSize - NcaFullHeaderSize
-	blockCount := uint32((dataSize + blockSize - 1) / blockSize)
 
-	blockHeader := nsz.NczBlockHeader{
+	bh := nsz.NczBlockHeader{
 		Version:          2,
-		Type:             1,
-		BlockSizeExp:     DefaultBlockSizeEx,
-		BlockCount:       blockCount,
+		Type:             opts.blockType(),
+		BlockSizeExp:     uint8(blockSizeExp),
+		BlockCount:       uint32((dataSize + blockSize - 1) / blockSize),
 		DecompressedSize: uint64(dataSize),
 	}
-	copy(blockHeader.Magic[:], nsz.MagicNCZBLOCK)
+	copy(bh.Magic[:], nsz.MagicNCZBLOCK)
+	return bh, nil
+}
 
-	if err := binary.Write(ws, binary.LittleEndian, blockHeader); err != nil {
+// writeNczStart writes everything of an NCZ that precedes the blocks: the NCA
+// header as stored, the section table, the block header and a zeroed size
+// table. It returns the offset of the size table, for writeNczEnd.
+func writeNczStart(ws io.WriteSeeker, header []byte, sections []nsz.NczSectionEntry, bh *nsz.NczBlockHeader) (int64, error) {
+	if _, err := ws.Write(header); err != nil {
 		return 0, err
 	}
-
-	// Reserve space for compressed size table
-	sizeListOffset, _ := ws.Seek(0, io.SeekCurrent)
-	if _, err := ws.Write(make([]byte, blockCount*4)); err != nil {
+	if err := nsz.WriteNczHeader(ws, sections); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(ws, binary.LittleEndian, bh); err != nil {
 		return 0, err
 	}
 
-	// 4. Parallel compression
-	compressedBlocks, err := compressBlocks(r, totalSize, blockSize, blockCount, sections, compressionLevel)
+	sizeListOffset, err := ws.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return 0, err
 	}
-
-	// 5. Write compressed blocks and collect sizes
-	compressedSizes := make([]uint32, blockCount)
-	for i := uint32(0); i < blockCount; i++ {
-		if _, err := ws.Write(compressedBlocks[i]); err != nil {
-			return 0, fmt.Errorf("write block %d: %w", i, err)
-		}
-		compressedSizes[i] = uint32(len(compressedBlocks[i]))
+	if _, err := ws.Write(make([]byte, int64(bh.BlockCount)*4)); err != nil {
+		return 0, err
 	}
+	return sizeListOffset, nil
+}
 
-	// 6. Write size table
+// writeNczEnd fills in the size table at sizeListOffset once the blocks are
+// written and appends the block hash trailer if hashes is not nil. It returns
+// the offset of the end of the NCZ, where ws is left.
+func writeNczEnd(ws io.WriteSeeker, sizeListOffset int64, sizes, hashes []uint32) (int64, error) {
 	endPos, err := ws.Seek(0, io.SeekCurrent)
 	if err != nil {
 		return 0, err
@@ -100,20 +498,237 @@ func CompressNca(r io.ReaderAt, w io.Writer, totalSize int64, titleKey []byte, c
 	if _, err := ws.Seek(sizeListOffset, io.SeekStart); err != nil {
 		return 0, err
 	}
-	if err := binary.Write(ws, binary.LittleEndian, compressedSizes); err != nil {
+	if err := binary.Write(ws, binary.LittleEndian, sizes); err != nil {
 		return 0, err
 	}
 	if _, err := ws.Seek(endPos, io.SeekStart); err != nil {
 		return 0, err
 	}
 
-	return endPos - startPos, nil
+	// Block hashes go after the last block
+	if hashes != nil {
+		trailer := nsz.BlockHashTrailer(hashes)
+		if _, err := ws.Write(trailer); err != nil {
+			return 0, err
+		}
+		endPos += int64(len(trailer))
+	}
+	return endPos, nil
+}
+
+// hashWrittenBlocks fills hashes for the blocks of a resumed NCZ, whose
+// sizes are resumed and whose data starts at offset in w.
+func hashWrittenBlocks(w io.Writer, offset int64, resumed []uint32, hashes []uint32) error {
+	ra, ok := w.(io.ReaderAt)
+	if !ok {
+		return errors.New("block hashes of a resumed ncz need a readable output")
+	}
+	var buf []byte
+	for i, size := range resumed {
+		if uint32(cap(buf)) < size {
+			buf = make([]byte, size)
+		}
+		buf = buf[:size]
+		if err := readFullAt(ra, buf, offset); err != nil {
+			return fmt.Errorf("read back block %d: %w", i, err)
+		}
+		hashes[i] = nsz.BlockHash(buf)
+		offset += int64(size)
+	}
+	return nil
+}
+
+// encodeBlock decrypts chunk, the block at offset, in place and returns it as
+// it goes into the NCZ: compressed, or a copy of the plaintext if that is not
+// smaller. Ties are stored raw, as a block whose size equals its decompressed
+// size is raw (nsz.NczBlockHeader.IsStored). slow and leftovers are as for
+// compressBlockWithin.
+func encodeBlock(chunk []byte, offset int64, ciphers []sectionCipher, opts CompressOptions, leftovers leftoverAttempts) (data []byte, stored, slow bool) {
+	decryptChunk(chunk, offset, ciphers)
+	compressed, slow := compressBlockWithin(chunk, opts, leftovers)
+	if len(compressed) < len(chunk) {
+		return compressed, false, slow
+	}
+	return append([]byte(nil), chunk...), true, slow
+}
+
+// compressBlockWithin is compressBlock bounded by opts.BlockTimeBudget: a
+// block that takes longer is compressed again at FallbackLevel, and slow is
+// true. The abandoned attempt goes on reading chunk until it finishes, so the
+// caller must not reuse chunk's memory after a slow block.
+//
+// The abandoned attempt holds a slot of leftovers while it runs. With every
+// slot taken the block waits for its own attempt instead, so the memory and
+// CPU of abandoned attempts stay bounded.
+func compressBlockWithin(chunk []byte, opts CompressOptions, leftovers leftoverAttempts) (compressed []byte, slow bool) {
+	if opts.BlockTimeBudget <= 0 || opts.level() <= FallbackLevel {
+		return compressBlock(chunk, opts), false
+	}
+
+	done := make(chan []byte, 1)
+	go func() { done <- compressBlock(chunk, opts) }()
+	timer := time.NewTimer(opts.BlockTimeBudget)
+	defer timer.Stop()
+	select {
+	case compressed := <-done:
+		return compressed, false
+	case <-timer.C:
+	}
+
+	select {
+	case leftovers <- struct{}{}:
+		go func() {
+			<-done
+			<-leftovers
+		}()
+	default:
+		return <-done, false
+	}
+
+	fast := opts
+	fast.Level = FallbackLevel
+	return compressBlock(chunk, fast), true
+}
+
+// leftoverAttempts holds a slot for every block attempt that
+// compressBlockWithin abandoned and that is still running.
+type leftoverAttempts chan struct{}
+
+// newLeftoverAttempts returns room for n abandoned attempts.
+func newLeftoverAttempts(n int) leftoverAttempts {
+	return make(leftoverAttempts, n)
 }
 
-// compressBlocks handles parallel reading, decryption, and compression.
-func compressBlocks(r io.ReaderAt, totalSize, blockSize int64, blockCount uint32, sections []nsz.NczSectionEntry, compressionLevel int) ([][]byte, error) {
-	numWorkers := runtime.NumCPU()
-	results := make([][]byte, blockCount)
+// wait returns once every abandoned attempt has finished.
+func (l leftoverAttempts) wait() {
+	for i := 0; i < cap(l); i++ {
+		l <- struct{}{}
+	}
+	for i := 0; i < cap(l); i++ {
+		<-l
+	}
+}
+
+// compressBlock compresses one block with the codec of opts.BlockType.
+// CompressNca checks the type up front, so only supported types reach here.
+func compressBlock(chunk []byte, opts CompressOptions) []byte {
+	switch opts.blockType() {
+	case nsz.BlockTypeZstd:
+		return github_zstd.CompressWithDict(chunk, opts.Dict, opts.level())
+	}
+	panic(fmt.Sprintf("compressBlock: block type %d", opts.blockType()))
+}
+
+// decompressBlock reverses compressBlock for the given block type.
+func decompressBlock(blockType uint8, compressed, dict []byte) ([]byte, error) {
+	switch blockType {
+	case nsz.BlockTypeZstd:
+		return github_zstd.DecompressWithDict(compressed, dict)
+	}
+	return nil, fmt.Errorf("%w: %d", ErrUnsupportedBlockType, blockType)
+}
+
+// checkSectionKeys returns ErrNoDecryptionKey if a section that is decrypted
+// has no key, which NcaHeader.BodyKey leaves all zero. XTS sections are kept
+// encrypted (see GetEncryptionSections) and need none.
+func checkSectionKeys(sections []nsz.NczSectionEntry) error {
+	for _, sec := range sections {
+		switch sec.CryptoType {
+		case CryptoTypeCTR, CryptoTypeBKTR:
+			if sec.CryptoKey == [16]byte{} {
+				return fmt.Errorf("%w: section at 0x%x", ErrNoDecryptionKey, sec.Offset)
+			}
+		}
+	}
+	return nil
+}
+
+// passKeylessSections returns sections with every CTR and BKTR section that
+// has no key turned into a CryptoTypeNone one, for
+// CompressOptions.AllowEncrypted. Decrypting them with the all-zero key would
+// only XOR the stored bytes with a keystream.
+func passKeylessSections(sections []nsz.NczSectionEntry) []nsz.NczSectionEntry {
+	out := make([]nsz.NczSectionEntry, len(sections))
+	for i, sec := range sections {
+		out[i] = sec
+		if (sec.CryptoType == CryptoTypeCTR || sec.CryptoType == CryptoTypeBKTR) && sec.CryptoKey == [16]byte{} {
+			out[i].CryptoType = CryptoTypeNone
+		}
+	}
+	return out
+}
+
+// worthCompressing test-compresses up to opts.PrecheckBlocks blocks spread
+// evenly over the body and reports whether they shrank by minPrecheckSavings.
+func worthCompressing(r io.ReaderAt, totalSize, blockSize int64, sections []nsz.NczSectionEntry, opts CompressOptions) (bool, error) {
+	samples := opts.PrecheckBlocks
+	if samples == 0 {
+		samples = DefaultPrecheckBlocks
+	}
+	if samples < 0 {
+		return true, nil
+	}
+
+	blockCount := (totalSize - NcaFullHeaderSize + blockSize - 1) / blockSize
+	if int64(samples) > blockCount {
+		samples = int(blockCount)
+	}
+
+	ciphers, err := newSectionCiphers(sections)
+	if err != nil {
+		return false, err
+	}
+
+	var in, out int64
+	buf := make([]byte, blockSize)
+	for i := 0; i < samples; i++ {
+		index := int64(i) * blockCount / int64(samples)
+		offset := NcaFullHeaderSize + index*blockSize
+		chunk := buf
+		if offset+blockSize > totalSize {
+			chunk = buf[:totalSize-offset]
+		}
+		if err := readFullAt(r, chunk, offset); err != nil {
+			return false, fmt.Errorf("read block %d: %w", index, err)
+		}
+
+		decryptChunk(chunk, offset, ciphers)
+		in += int64(len(chunk))
+		out += int64(len(compressBlock(chunk, opts)))
+	}
+
+	return float64(out) < float64(in)*(1-minPrecheckSavings), nil
+}
+
+// compressBlocks reads, decrypts and compresses blocks in parallel and writes
+// them to out in block order, returning the size of each written block, their
+// hashes with opts.BlockHashes (zero for resumed blocks), and the number of
+// blocks stored raw or over the time budget. Blocks listed in opts.Resume are
+// taken as already written.
+// A block holds a token from submission until it is written, so at most
+// numWorkers blocks are in flight regardless of blockCount.
+func compressBlocks(r io.ReaderAt, out io.Writer, totalSize int64, bh *nsz.NczBlockHeader, sections []nsz.NczSectionEntry, opts CompressOptions) ([]uint32, []uint32, blockCounts, error) {
+	numWorkers := opts.workers()
+	blockSize := int64(bh.BlockSize())
+	blockCount := bh.BlockCount
+
+	ciphers, err := newSectionCiphers(sections)
+	if err != nil {
+		return nil, nil, blockCounts{}, err
+	}
+	// Attempts over the time budget outlive their block, but not the NCA
+	leftovers := newLeftoverAttempts(numWorkers)
+	defer leftovers.wait()
+	var storedBlocks, slowBlocks atomic.Uint32
+	first := uint32(len(opts.Resume))
+	for i, size := range opts.Resume {
+		if err := bh.CheckBlockSize(i, size); err != nil {
+			return nil, nil, blockCounts{}, fmt.Errorf("resume: %w", err)
+		}
+		if bh.IsStored(i, size) {
+			storedBlocks.Add(1)
+		}
+	}
 
 	// Work represents a block to process
 	type work struct {
@@ -122,90 +737,180 @@ func compressBlocks(r io.ReaderAt, totalSize, blockSize int64, blockCount uint32
 		size   int64
 	}
 
-	workCh := make(chan work, numWorkers*4)
-	resultCh := make(chan struct {
+	type result struct {
 		index uint32
 		data  []byte
-	}, numWorkers*4)
+		err   error
+	}
 
-	// Result collector
-	var collectWg sync.WaitGroup
-	collectWg.Add(1)
+	tokens := make(chan struct{}, numWorkers)
+	workCh := make(chan work)
+	resultCh := make(chan result, numWorkers)
+	done := make(chan struct{})
+
+	// Submit work
 	go func() {
-		defer collectWg.Done()
-		for r := range resultCh {
-			results[r.index] = r.data
+		defer close(workCh)
+		for i := first; i < blockCount; i++ {
+			select {
+			case tokens <- struct{}{}:
+			case <-done:
+				return
+			}
+			offset := NcaFullHeaderSize + int64(i)*blockSize
+			size := blockSize
+			if offset+size > totalSize {
+				size = totalSize - offset
+			}
+			workCh <- work{i, offset, size}
 		}
 	}()
 
 	// Workers: read, decrypt, compress
 	var workerWg sync.WaitGroup
-	var workerErr error
-	var errOnce sync.Once
-
 	for i := 0; i < numWorkers; i++ {
 		workerWg.Add(1)
 		go func() {
 			defer workerWg.Done()
 			buf := make([]byte, blockSize)
+			ciphers := forWorker(ciphers)
 
 			for w := range workCh {
 				// Read
 				chunk := buf[:w.size]
-				n, err := r.ReadAt(chunk, w.offset)
-				if err != nil && n == 0 {
-					errOnce.Do(func() { workerErr = fmt.Errorf("read block %d: %w", w.index, err) })
+				if err := readFullAt(r, chunk, w.offset); err != nil {
+					resultCh <- result{index: w.index, err: fmt.Errorf("read block %d: %w", w.index, err)}
 					continue
 				}
-				chunk = chunk[:n]
-
-				// Decrypt sections that intersect this block
-				decryptChunk(chunk, w.offset, sections)
-
-				// Compress
-				compressed := github_zstd.Compress(chunk, compressionLevel)
 
-				// Use smaller of compressed/uncompressed
-				var data []byte
-				if len(compressed) < len(chunk) {
-					data = compressed
-				} else {
-					data = make([]byte, len(chunk))
-					copy(data, chunk)
+				// Decrypt and compress; a slow block leaves buf to its abandoned attempt
+				data, stored, slow := encodeBlock(chunk, w.offset, ciphers, opts, leftovers)
+				if stored {
+					storedBlocks.Add(1)
+				}
+				if slow {
+					slowBlocks.Add(1)
+					buf = make([]byte, blockSize)
 				}
 
-				resultCh <- struct {
-					index uint32
-					data  []byte
-				}{w.index, data}
+				resultCh <- result{index: w.index, data: data}
 			}
 		}()
 	}
 
-	// Submit work
-	for i := uint32(0); i < blockCount; i++ {
-		offset := NcaFullHeaderSize + int64(i)*blockSize
-		size := blockSize
-		if offset+size > totalSize {
-			size = totalSize - offset
+	go func() {
+		workerWg.Wait()
+		close(resultCh)
+	}()
+
+	// Ordered writer: hold out-of-order blocks until their predecessors are written
+	sizes := make([]uint32, blockCount)
+	copy(sizes, opts.Resume)
+	var hashes []uint32
+	if opts.BlockHashes {
+		hashes = make([]uint32, blockCount)
+	}
+	pending := make(map[uint32][]byte)
+	next := first
+	var firstErr error
+
+	for res := range resultCh {
+		if firstErr != nil {
+			continue
+		}
+		if res.err != nil {
+			firstErr = res.err
+			close(done)
+			continue
+		}
+
+		pending[res.index] = res.data
+		for data, ok := pending[next]; ok; data, ok = pending[next] {
+			delete(pending, next)
+			if uint64(len(data)) > math.MaxUint32 {
+				firstErr = fmt.Errorf("block %d: %d bytes do not fit the size table", next, len(data))
+				close(done)
+				break
+			}
+			if _, err := out.Write(data); err != nil {
+				firstErr = fmt.Errorf("write block %d: %w", next, err)
+				close(done)
+				break
+			}
+			sizes[next] = uint32(len(data))
+			if hashes != nil {
+				hashes[next] = nsz.BlockHash(data)
+			}
+			next++
+			<-tokens
+
+			if opts.Checkpoint != nil && opts.CheckpointBlocks > 0 && next%opts.CheckpointBlocks == 0 && next < blockCount {
+				if err := opts.Checkpoint(append([]uint32(nil), sizes[:next]...)); err != nil {
+					firstErr = fmt.Errorf("checkpoint after block %d: %w", next, err)
+					close(done)
+					break
+				}
+			}
 		}
-		workCh <- work{i, offset, size}
 	}
 
-	close(workCh)
-	workerWg.Wait()
-	close(resultCh)
-	collectWg.Wait()
+	if firstErr != nil {
+		return nil, nil, blockCounts{}, firstErr
+	}
 
-	if workerErr != nil {
-		return nil, workerErr
+	return sizes, hashes, blockCounts{stored: storedBlocks.Load(), slow: slowBlocks.Load()}, nil
+}
+
+// blockCounts counts the blocks of compressBlocks that were not compressed
+// at the requested level.
+type blockCounts struct {
+	stored uint32 // Kept raw
+	slow   uint32 // Over CompressOptions.BlockTimeBudget
+}
+
+// sectionCipher pairs an NCZ section with its AES cipher, built once per NCA
+// rather than once per block, and a CTR keystream reused across chunks.
+// Concurrent workers each need their own copy (see forWorker).
+type sectionCipher struct {
+	nsz.NczSectionEntry
+	block cipher.Block // nil for sections decryptChunk leaves untouched
+	ctr   *crypto.CTR
+}
+
+// newSectionCiphers builds the ciphers for the encrypted sections.
+func newSectionCiphers(sections []nsz.NczSectionEntry) ([]sectionCipher, error) {
+	ciphers := make([]sectionCipher, len(sections))
+	for i, sec := range sections {
+		ciphers[i].NczSectionEntry = sec
+		if sec.CryptoType != CryptoTypeCTR && sec.CryptoType != CryptoTypeBKTR {
+			continue
+		}
+		block, err := crypto.NewBlock(sec.CryptoKey[:])
+		if err != nil {
+			return nil, fmt.Errorf("section at 0x%x: %w", sec.Offset, err)
+		}
+		ciphers[i].block = block
+		ciphers[i].ctr = crypto.NewCTR(block, sec.CryptoCounter[:])
 	}
+	return ciphers, nil
+}
 
-	return results, nil
+// forWorker returns a copy of ciphers with keystreams of its own, for use
+// by one of several goroutines.
+func forWorker(ciphers []sectionCipher) []sectionCipher {
+	own := make([]sectionCipher, len(ciphers))
+	for i, sec := range ciphers {
+		own[i] = sec
+		if sec.block != nil {
+			own[i].ctr = crypto.NewCTR(sec.block, sec.CryptoCounter[:])
+		}
+	}
+	return own
 }
 
-// decryptChunk decrypts portions of a chunk that fall within encrypted sections.
-func decryptChunk(chunk []byte, chunkOffset int64, sections []nsz.NczSectionEntry) {
+// decryptChunk decrypts the portions of a chunk that fall within CTR and BKTR
+// sections. Other sections, XTS ones included, are left as they are.
+func decryptChunk(chunk []byte, chunkOffset int64, sections []sectionCipher) {
 	chunkStart := uint64(chunkOffset)
 	chunkEnd := chunkStart + uint64(len(chunk))
 
@@ -230,11 +935,72 @@ func decryptChunk(chunk []byte, chunkOffset int64, sections []nsz.NczSectionEntr
 		// Get slice to decrypt
 		slice := chunk[start-chunkStart : end-chunkStart]
 
-		if sec.CryptoType == 3 || sec.CryptoType == 4 {
-			stream, err := crypto.NewCTRStream(sec.CryptoKey[:], sec.CryptoCounter[:], int64(start))
-			if err == nil {
-				stream.XORKeyStream(slice, slice)
-			}
+		// The CTR block number counts from the start of the NCA, so the
+		// absolute offset is used rather than start - sec.Offset.
+		if sec.block != nil {
+			sec.ctr.SeekTo(int64(start))
+			sec.ctr.XORKeyStream(slice, slice)
+		}
+	}
+}
+
+// DictSample returns up to n bytes of the decrypted body of an NCA, for
+// building a shared dictionary with github_zstd.BuildRawDict.
+func DictSample(r io.ReaderAt, size int64, titleKey []byte, n int64, opts CompressOptions) ([]byte, error) {
+	nca, err := NewNCAWithHeaderKey(r, opts.HeaderKey)
+	if err != nil {
+		return nil, err
+	}
+	if titleKey != nil {
+		nca.Header.TitleKey = titleKey
+	}
+	sections, err := nca.GetEncryptionSections()
+	if err != nil {
+		return nil, err
+	}
+	if opts.AllowEncrypted {
+		sections = passKeylessSections(sections)
+	} else if err := checkSectionKeys(sections); err != nil {
+		return nil, err
+	}
+	ciphers, err := newSectionCiphers(sections)
+	if err != nil {
+		return nil, err
+	}
+
+	if rest := size - NcaFullHeaderSize; rest < n {
+		n = rest
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	sample := make([]byte, n)
+	if err := readFullAt(r, sample, NcaFullHeaderSize); err != nil {
+		return nil, fmt.Errorf("read sample: %w", err)
+	}
+	decryptChunk(sample, NcaFullHeaderSize, ciphers)
+	return sample, nil
+}
+
+// readFullAt fills buf from r at off. Unlike a single ReadAt, it keeps reading
+// when a reader (such as an HTTP range reader) returns fewer bytes without an
+// error, and reports io.ErrUnexpectedEOF if the data ends before buf is full.
+func readFullAt(r io.ReaderAt, buf []byte, off int64) error {
+	for n := 0; n < len(buf); {
+		m, err := r.ReadAt(buf[n:], off+int64(n))
+		n += m
+		if n == len(buf) {
+			return nil
+		}
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		if m == 0 {
+			return io.ErrNoProgress
 		}
 	}
+	return nil
 }
@@ -0,0 +1,87 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/falk/nsz-go/pkg/nsz"
+)
+
+// testCtrSection is a CTR section at 0x4000 with the key and counter of the
+// crypto package's CTR vectors.
+func testCtrSection() nsz.NczSectionEntry {
+	sec := nsz.NczSectionEntry{Offset: 0x4000, Size: 0x10000, CryptoType: CryptoTypeCTR}
+	key, _ := hex.DecodeString("000102030405060708090a0b0c0d0e0f")
+	counter, _ := hex.DecodeString("0123456789abcdef0000000000000000")
+	copy(sec.CryptoKey[:], key)
+	copy(sec.CryptoCounter[:], counter)
+	return sec
+}
+
+func TestDecryptChunkCountsFromNcaStart(t *testing.T) {
+	ciphers, err := newSectionCiphers([]nsz.NczSectionEntry{testCtrSection()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 0xC000 is 0x8000 into the section; the counter must still be 0xC00
+	// (openssl enc -aes-128-ctr with iv 0123456789abcdef0000000000000c00)
+	want, _ := hex.DecodeString("d4a1e0449558442dd8887e95291c7a6f25921e954d3c9fbaeb98eec2f21e0088380246d23ebcd47691ce2380094ee9fe")
+	chunk := make([]byte, len(want))
+	decryptChunk(chunk, 0xC000, ciphers)
+	if !bytes.Equal(chunk, want) {
+		t.Errorf("keystream at 0xC000:\n got %x\nwant %x", chunk, want)
+	}
+}
+
+// BenchmarkDecryptChunk decrypts 1 MB blocks of a CTR section, as each
+// compression worker does.
+func BenchmarkDecryptChunk(b *testing.B) {
+	sec := testCtrSection()
+	sec.Size = 64 << 20
+	ciphers, err := newSectionCiphers([]nsz.NczSectionEntry{sec})
+	if err != nil {
+		b.Fatal(err)
+	}
+	chunk := make([]byte, 1<<DefaultBlockSizeEx)
+	b.SetBytes(int64(len(chunk)))
+	offset := int64(sec.Offset)
+	for b.Loop() {
+		decryptChunk(chunk, offset, ciphers)
+		if offset += int64(len(chunk)); offset+int64(len(chunk)) > int64(sec.Offset+sec.Size) {
+			offset = int64(sec.Offset)
+		}
+	}
+}
+
+func TestCompressBlockWithinWaitsWithoutSlot(t *testing.T) {
+	chunk := bytes.Repeat([]byte("block "), 0x1000)
+	opts := CompressOptions{Level: 19, BlockTimeBudget: time.Nanosecond}
+
+	// Every slot is held by an earlier attempt, so none may be abandoned
+	leftovers := newLeftoverAttempts(2)
+	leftovers <- struct{}{}
+	leftovers <- struct{}{}
+	for i := 0; i < 20; i++ {
+		compressed, slow := compressBlockWithin(chunk, opts, leftovers)
+		if slow {
+			t.Fatal("abandoned an attempt with no slot free")
+		}
+		if !bytes.Equal(compressed, compressBlock(chunk, opts)) {
+			t.Fatal("block was not compressed at the requested level")
+		}
+	}
+
+	// With slots free, attempts over the budget release theirs when done
+	<-leftovers
+	<-leftovers
+	for i := 0; i < 20; i++ {
+		compressBlockWithin(chunk, opts, leftovers)
+	}
+	leftovers.wait()
+	if len(leftovers) != 0 {
+		t.Errorf("%d slots still held after wait", len(leftovers))
+	}
+}
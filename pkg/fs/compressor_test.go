@@ -0,0 +1,274 @@
+package fs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"runtime"
+	"slices"
+	"testing"
+
+	"github.com/falk/nsz-go/internal/testutil"
+	"github.com/falk/nsz-go/pkg/fs"
+	"github.com/falk/nsz-go/pkg/nsz"
+)
+
+// testOptions compresses small synthetic NCAs: 64 KB blocks, so they have
+// several, and no precheck, so half-random bodies are not given up on.
+func testOptions() fs.CompressOptions {
+	return fs.CompressOptions{
+		Level:          3,
+		BlockSizeExp:   16,
+		PrecheckBlocks: -1,
+		HeaderKey:      testutil.HeaderKey,
+	}
+}
+
+// testSections is a PFS0 section and a RomFS section, both CTR.
+func testSections() []testutil.SectionSpec {
+	return []testutil.SectionSpec{
+		{Size: 0x30000, FsType: fs.FsTypePfs0, Counter: 1},
+		{Size: 0x50000, FsType: fs.FsTypeRomFs, Counter: 2},
+	}
+}
+
+func newTestNca(t testing.TB, sections []testutil.SectionSpec) []byte {
+	t.Helper()
+	nca, err := testutil.NewSyntheticNCA(sections)
+	if err != nil {
+		t.Fatalf("NewSyntheticNCA: %v", err)
+	}
+	return nca
+}
+
+func compressTestNca(t testing.TB, nca, titleKey []byte, opts fs.CompressOptions) ([]byte, *fs.CompressResult) {
+	t.Helper()
+	var ncz bytes.Buffer
+	res, err := fs.CompressNca(bytes.NewReader(nca), &ncz, int64(len(nca)), titleKey, opts)
+	if err != nil {
+		t.Fatalf("CompressNca: %v", err)
+	}
+	if res.OutputSize != int64(ncz.Len()) {
+		t.Fatalf("OutputSize = %d, wrote %d bytes", res.OutputSize, ncz.Len())
+	}
+	return ncz.Bytes(), res
+}
+
+// readBlockTable returns the block header and the size table of a block-mode NCZ.
+func readBlockTable(t testing.TB, ncz []byte) (*nsz.NczBlockHeader, []uint32) {
+	t.Helper()
+	r := bytes.NewReader(ncz[fs.NcaFullHeaderSize:])
+	if _, err := nsz.ReadNczHeader(r); err != nil {
+		t.Fatalf("ReadNczHeader: %v", err)
+	}
+	bh, err := nsz.ReadNczBlockHeader(r)
+	if err != nil {
+		t.Fatalf("ReadNczBlockHeader: %v", err)
+	}
+	sizes := make([]uint32, bh.BlockCount)
+	if err := binary.Read(r, binary.LittleEndian, sizes); err != nil {
+		t.Fatalf("read size table: %v", err)
+	}
+	return bh, sizes
+}
+
+func decompressTestNcz(t testing.TB, ncz []byte) []byte {
+	t.Helper()
+	var nca bytes.Buffer
+	n, err := fs.DecompressNca(bytes.NewReader(ncz), &nca)
+	if err != nil {
+		t.Fatalf("DecompressNca: %v", err)
+	}
+	if n != int64(nca.Len()) {
+		t.Fatalf("DecompressNca returned %d, wrote %d bytes", n, nca.Len())
+	}
+	return nca.Bytes()
+}
+
+func TestShouldCompressSize(t *testing.T) {
+	tests := []struct {
+		minSize, size int64
+		want          bool
+	}{
+		{-1, fs.DefaultMinCompressSize - 1, false},
+		{-1, fs.DefaultMinCompressSize + 1, true},
+		{0, fs.NcaFullHeaderSize + 1, true},
+		{0, fs.NcaFullHeaderSize, false}, // No body
+		{0x100000, 0xfffff, false},
+		{0x100000, 0x100000, true},
+	}
+	for _, tt := range tests {
+		if got := (fs.CompressOptions{MinSize: tt.minSize}).ShouldCompressSize(tt.size); got != tt.want {
+			t.Errorf("MinSize %d: ShouldCompressSize(0x%x) = %v, want %v", tt.minSize, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestCompressDecompressRoundTrip(t *testing.T) {
+	sections := testSections()
+	nca := newTestNca(t, sections)
+	if sections[0].CryptoType != 0 {
+		t.Errorf("NewSyntheticNCA set CryptoType %d in the caller's spec", sections[0].CryptoType)
+	}
+
+	ncz, res := compressTestNca(t, nca, testutil.TitleKey, testOptions())
+	if res.Stored || res.OutputSize >= int64(len(nca)) {
+		t.Fatalf("compressed %d bytes to %d (stored %v)", len(nca), res.OutputSize, res.Stored)
+	}
+	if got := decompressTestNcz(t, ncz); !bytes.Equal(got, nca) {
+		t.Fatal("decompressed NCA differs from the original")
+	}
+}
+
+func TestTrailingBytesAreKept(t *testing.T) {
+	// Container padding past the header's content size
+	nca := append(newTestNca(t, testSections()), bytes.Repeat([]byte("padding"), 0x123)...)
+	ncz, res := compressTestNca(t, nca, testutil.TitleKey, testOptions())
+	if len(res.Warnings) != 1 {
+		t.Errorf("warnings = %q", res.Warnings)
+	}
+	if got := decompressTestNcz(t, ncz); !bytes.Equal(got, nca) {
+		t.Errorf("decompressed %d bytes, want the original %d", len(got), len(nca))
+	}
+}
+
+func TestNczKeepsEncryptedHeader(t *testing.T) {
+	nca := newTestNca(t, testSections())
+	parsed, err := fs.NewNCAWithHeaderKey(bytes.NewReader(nca), testutil.HeaderKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The header region is the NCA header as stored, so decompressors copy
+	// it back without the header key
+	ncz, _ := compressTestNca(t, nca, testutil.TitleKey, testOptions())
+	header := ncz[:fs.NcaFullHeaderSize]
+	if !bytes.Equal(header, nca[:fs.NcaFullHeaderSize]) {
+		t.Error("NCZ header differs from the encrypted NCA header")
+	}
+	if bytes.Equal(header[:fs.NcaHeaderStructSize], parsed.Header.DecryptedHeaderBytes()) {
+		t.Error("NCZ header is the decrypted NCA header")
+	}
+	if got := decompressTestNcz(t, ncz); !bytes.Equal(got, nca) {
+		t.Fatal("decompressed NCA differs from the original")
+	}
+}
+
+func TestIncompressibleLastBlockIsStored(t *testing.T) {
+	// Zeros, then a random section that ends 0x8200 bytes into a 64 KB block
+	random := make([]byte, 0x18200)
+	rand.New(rand.NewSource(2)).Read(random)
+	sections := []testutil.SectionSpec{
+		{Size: 0x20000, FsType: fs.FsTypePfs0, Counter: 1, Data: []byte("PFS0")},
+		{Size: int64(len(random)), FsType: fs.FsTypeRomFs, Counter: 2, Data: random},
+	}
+	nca := newTestNca(t, sections)
+
+	ncz, _ := compressTestNca(t, nca, testutil.TitleKey, testOptions())
+	bh, sizes := readBlockTable(t, ncz)
+	last := len(sizes) - 1
+	if got := bh.BlockDecompressedSize(last); got != 0x8200 {
+		t.Fatalf("last block is 0x%x bytes, want 0x8200", got)
+	}
+	if !bh.IsStored(last, sizes[last]) {
+		t.Errorf("random last block of 0x%x bytes is not stored", sizes[last])
+	}
+	if bh.IsStored(0, sizes[0]) {
+		t.Errorf("zero block 0 is stored")
+	}
+	if got := decompressTestNcz(t, ncz); !bytes.Equal(got, nca) {
+		t.Fatal("decompressed NCA differs from the original")
+	}
+}
+
+func TestCompressWithoutKey(t *testing.T) {
+	// The CTR section stays encrypted; the plain one is what shrinks
+	sections := []testutil.SectionSpec{
+		{Size: 0x20000, FsType: fs.FsTypePfs0, Counter: 1},
+		{Size: 0x40000, FsType: fs.FsTypeRomFs, CryptoType: fs.CryptoTypeNone, Data: []byte{1}},
+	}
+	nca := newTestNca(t, sections)
+
+	opts := testOptions()
+	if _, err := fs.CompressNca(bytes.NewReader(nca), io.Discard, int64(len(nca)), nil, opts); !errors.Is(err, fs.ErrNoDecryptionKey) {
+		t.Fatalf("without a key: got %v, want ErrNoDecryptionKey", err)
+	}
+
+	opts.AllowEncrypted = true
+	ncz, _ := compressTestNca(t, nca, nil, opts)
+	entries, err := nsz.ReadNczHeader(bytes.NewReader(ncz[fs.NcaFullHeaderSize:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, e := range entries {
+		if e.CryptoType != fs.CryptoTypeNone {
+			t.Errorf("section at 0x%x has crypto type %d, want none", e.Offset, e.CryptoType)
+		}
+	}
+	// Its first block is the CTR section as stored
+	bh, sizes := readBlockTable(t, ncz)
+	if !bh.IsStored(0, sizes[0]) {
+		t.Fatal("encrypted block 0 was compressed")
+	}
+	start := nsz.DataOffset(len(entries), bh)
+	if !bytes.Equal(ncz[start:start+int64(sizes[0])], nca[fs.NcaFullHeaderSize:][:sizes[0]]) {
+		t.Error("block 0 is not the encrypted section as stored")
+	}
+
+	if got := decompressTestNcz(t, ncz); !bytes.Equal(got, nca) {
+		t.Fatal("decompressed NCA differs from the original")
+	}
+}
+
+// BenchmarkCompressNca compresses an 8 MB synthetic NCA whose sections are
+// half random and half zeros, at several levels and worker counts.
+func TestDetectNczWithoutHeaderKey(t *testing.T) {
+	nca := newTestNca(t, testSections())
+	ncz, _ := compressTestNca(t, nca, testutil.TitleKey, testOptions())
+	useWrongHeaderKey(t)
+	if typ, err := fs.DetectContainer(bytes.NewReader(ncz)); typ != fs.ContainerNCZ || err != nil {
+		t.Errorf("DetectContainer = %v, %v, want NCZ", typ, err)
+	}
+	if _, err := fs.DetectContainer(bytes.NewReader(nca)); !errors.Is(err, fs.ErrUnknownContainer) {
+		t.Errorf("an NCA was detected with the wrong header key: %v", err)
+	}
+}
+
+func BenchmarkCompressNca(b *testing.B) {
+	nca := newTestNca(b, []testutil.SectionSpec{
+		{Size: 0x100000, FsType: fs.FsTypePfs0, Counter: 1},
+		{Size: 0x6fc000, FsType: fs.FsTypeRomFs, Counter: 2},
+	})
+	out, err := os.CreateTemp(b.TempDir(), "*.ncz")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer out.Close()
+
+	workerCounts := []int{1, 4, runtime.GOMAXPROCS(0)}
+	slices.Sort(workerCounts)
+	workerCounts = slices.Compact(workerCounts)
+	for _, level := range []int{1, 12, 18, 22} {
+		for _, workers := range workerCounts {
+			b.Run(fmt.Sprintf("level=%d/workers=%d", level, workers), func(b *testing.B) {
+				opts := testOptions()
+				opts.Level = level
+				opts.Workers = workers
+				opts.BlockSizeExp = fs.DefaultBlockSizeEx
+				b.SetBytes(int64(len(nca)))
+				for b.Loop() {
+					if _, err := out.Seek(0, io.SeekStart); err != nil {
+						b.Fatal(err)
+					}
+					if _, err := fs.CompressNca(bytes.NewReader(nca), out, int64(len(nca)), testutil.TitleKey, opts); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,252 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/falk/nsz-go/pkg/nsz"
+	github_zstd "github.com/falk/nsz-go/pkg/zstd"
+)
+
+// DecompressNca restores the original encrypted NCA from an NCZ stream.
+//
+// The NCZ keeps the first NcaFullHeaderSize bytes exactly as they were in the
+// NCA, still XTS-encrypted, so the header (including the wrapped key area of
+// standard crypto NCAs) is copied back verbatim and needs no re-wrapping.
+// The body is decompressed and each section re-encrypted with the key and
+// counter recorded in the NCZ section table.
+func DecompressNca(r io.ReaderAt, w io.Writer) (int64, error) {
+	return DecompressNcaWithDict(r, w, nil)
+}
+
+// DecompressNcaWithDict is DecompressNca for an NCZ compressed against the
+// raw zstd dictionary dict (see CompressOptions.Dict).
+func DecompressNcaWithDict(r io.ReaderAt, w io.Writer, dict []byte) (int64, error) {
+	// 1. Header, copied verbatim
+	header := make([]byte, NcaFullHeaderSize)
+	if n, err := r.ReadAt(header, 0); n < len(header) {
+		return 0, fmt.Errorf("read header: %w", err)
+	}
+	written, err := writeCounted(w, header, 0)
+	if err != nil {
+		return written, err
+	}
+
+	// 2. Section table
+	sr := io.NewSectionReader(r, NcaFullHeaderSize, 1<<62)
+	sections, err := nsz.ReadNczHeader(sr)
+	if err != nil {
+		return written, err
+	}
+	ciphers, err := newSectionCiphers(sections)
+	if err != nil {
+		return written, err
+	}
+
+	// 3. Body: block mode if a block header follows, otherwise one solid zstd stream
+	pos, _ := sr.Seek(0, io.SeekCurrent)
+	magic := make([]byte, len(nsz.MagicNCZBLOCK))
+	if n, err := sr.ReadAt(magic, pos); n < len(magic) {
+		return written, fmt.Errorf("read block header: %w", err)
+	}
+	if string(magic) == nsz.MagicNCZBLOCK {
+		return decompressBlocks(sr, w, ciphers, dict, written)
+	}
+	return decompressSolid(sr, w, ciphers, dict, written)
+}
+
+// decompressBlocks decompresses a block-mode NCZ body.
+func decompressBlocks(r *io.SectionReader, w io.Writer, ciphers []sectionCipher, dict []byte, written int64) (int64, error) {
+	bh, sizes, hashes, err := readBlockTable(r)
+	if err != nil {
+		return written, err
+	}
+	return decompressBlockData(r, w, bh, sizes, hashes, ciphers, dict, written)
+}
+
+// readBlockTable reads the block header and size table at the position of r,
+// leaving r at the first block, and the block hashes if the NCZ has them.
+func readBlockTable(r *io.SectionReader) (*nsz.NczBlockHeader, []uint32, []uint32, error) {
+	bh, err := nsz.ReadNczBlockHeader(r)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if bh.Type != nsz.BlockTypeStored && bh.Type != nsz.BlockTypeZstd {
+		return nil, nil, nil, fmt.Errorf("%w: %d", ErrUnsupportedBlockType, bh.Type)
+	}
+
+	sizes := make([]uint32, bh.BlockCount)
+	if err := binary.Read(r, binary.LittleEndian, sizes); err != nil {
+		return nil, nil, nil, fmt.Errorf("read block size table: %w", err)
+	}
+	dataEnd, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	for i, size := range sizes {
+		if err := bh.CheckBlockSize(i, size); err != nil {
+			return nil, nil, nil, err
+		}
+		dataEnd += int64(size)
+	}
+
+	hashes, err := nsz.ReadBlockHashTrailer(r, dataEnd, bh.BlockCount)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return bh, sizes, hashes, nil
+}
+
+// decompressBlockData decompresses and re-encrypts the blocks in parallel and
+// writes them to w in block order. The NCZ is read sequentially by a single
+// goroutine; as when compressing, a block holds a token from being read until
+// it is written, so at most one block per worker is in memory. Blocks are
+// checked against hashes, if not nil, as they are read.
+func decompressBlockData(r io.Reader, w io.Writer, bh *nsz.NczBlockHeader, sizes []uint32, hashes []uint32, ciphers []sectionCipher, dict []byte, written int64) (int64, error) {
+	numWorkers := CompressOptions{}.workers()
+
+	type work struct {
+		index  int
+		offset int64
+		data   []byte
+	}
+
+	type result struct {
+		index int
+		data  []byte
+		err   error
+	}
+
+	tokens := make(chan struct{}, numWorkers)
+	workCh := make(chan work)
+	resultCh := make(chan result, numWorkers)
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+
+	// Reader
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer close(workCh)
+		offset := int64(NcaFullHeaderSize)
+		for i, size := range sizes {
+			select {
+			case tokens <- struct{}{}:
+			case <-done:
+				return
+			}
+			compressed := make([]byte, size)
+			if _, err := io.ReadFull(r, compressed); err != nil {
+				resultCh <- result{index: i, err: fmt.Errorf("read block %d: %w", i, err)}
+				return
+			}
+			if hashes != nil && nsz.BlockHash(compressed) != hashes[i] {
+				resultCh <- result{index: i, err: fmt.Errorf("%w: block %d", ErrBlockHashMismatch, i)}
+				return
+			}
+			workCh <- work{i, offset, compressed}
+			offset += int64(bh.BlockDecompressedSize(i))
+		}
+	}()
+
+	// Workers: decompress, re-encrypt
+	for i := 0; i < numWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ciphers := forWorker(ciphers)
+			for b := range workCh {
+				chunk := b.data
+				if bh.Type != nsz.BlockTypeStored && !bh.IsStored(b.index, uint32(len(b.data))) {
+					var err error
+					chunk, err = decompressBlock(bh.Type, b.data, dict)
+					if err != nil {
+						resultCh <- result{index: b.index, err: fmt.Errorf("decompress block %d: %w", b.index, err)}
+						continue
+					}
+				}
+				if expected := bh.BlockDecompressedSize(b.index); uint64(len(chunk)) != expected {
+					resultCh <- result{index: b.index, err: fmt.Errorf("block %d: got %d bytes, expected %d", b.index, len(chunk), expected)}
+					continue
+				}
+
+				// CTR is symmetric, so decrypting the plaintext re-encrypts it
+				decryptChunk(chunk, b.offset, ciphers)
+				resultCh <- result{index: b.index, data: chunk}
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(resultCh)
+	}()
+
+	// Ordered writer
+	pending := make(map[int][]byte)
+	next := 0
+	var firstErr error
+
+	for res := range resultCh {
+		if firstErr != nil {
+			continue
+		}
+		if res.err != nil {
+			firstErr = res.err
+			close(done)
+			continue
+		}
+
+		pending[res.index] = res.data
+		for data, ok := pending[next]; ok; data, ok = pending[next] {
+			delete(pending, next)
+			var err error
+			if written, err = writeCounted(w, data, written); err != nil {
+				firstErr = err
+				close(done)
+				break
+			}
+			next++
+			<-tokens
+		}
+	}
+
+	return written, firstErr
+}
+
+// decompressSolid decompresses a solid NCZ body: one zstd stream to the end of the file.
+func decompressSolid(r io.Reader, w io.Writer, ciphers []sectionCipher, dict []byte, written int64) (int64, error) {
+	zr, err := github_zstd.NewReaderWithDict(r, dict)
+	if err != nil {
+		return written, err
+	}
+	defer zr.Close()
+
+	buf := make([]byte, 1<<DefaultBlockSizeEx)
+	offset := int64(NcaFullHeaderSize)
+	for {
+		n, readErr := io.ReadFull(zr, buf)
+		if n > 0 {
+			chunk := buf[:n]
+			decryptChunk(chunk, offset, ciphers)
+			if written, err = writeCounted(w, chunk, written); err != nil {
+				return written, err
+			}
+			offset += int64(n)
+		}
+		if readErr == io.EOF || readErr == io.ErrUnexpectedEOF {
+			return written, nil
+		}
+		if readErr != nil {
+			return written, fmt.Errorf("decompress at 0x%x: %w", offset, readErr)
+		}
+	}
+}
+
+// writeCounted writes b to w and adds the bytes written to total.
+func writeCounted(w io.Writer, b []byte, total int64) (int64, error) {
+	n, err := w.Write(b)
+	return total + int64(n), err
+}
@@ -0,0 +1,49 @@
+package fs_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/falk/nsz-go/internal/testutil"
+	"github.com/falk/nsz-go/pkg/fs"
+)
+
+func TestDecompressStandardCrypto(t *testing.T) {
+	if err := testutil.SetKeys(); err != nil {
+		t.Fatal(err)
+	}
+	sections := []testutil.SectionSpec{
+		{Size: 0x20000, FsType: fs.FsTypePfs0, Counter: 1, Data: append([]byte("PFS0"), bytes.Repeat([]byte{0x11}, 0x1fffc)...)},
+		{Size: 0x24000, FsType: fs.FsTypeRomFs, Counter: 2},
+	}
+	nca, err := testutil.NewStandardCryptoNCA(sections)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, exp := range []int{14, 16, 20} {
+		t.Run(fmt.Sprintf("block 2^%d", exp), func(t *testing.T) {
+			opts := testOptions()
+			opts.BlockSizeExp = exp
+			ncz, _ := compressTestNca(t, nca, nil, opts)
+			if !bytes.Equal(ncz[:fs.NcaFullHeaderSize], nca[:fs.NcaFullHeaderSize]) {
+				t.Error("NCZ header is not the NCA header as stored")
+			}
+
+			// The restored NCA is the original, key area included, so its
+			// body still decrypts with the key area key
+			restored := decompressTestNcz(t, ncz)
+			if !bytes.Equal(restored, nca) {
+				t.Fatal("decompressed NCA differs from the original")
+			}
+			var plain bytes.Buffer
+			if _, err := fs.DecryptNca(bytes.NewReader(restored), &plain, nil); err != nil {
+				t.Fatalf("DecryptNca of the restored NCA: %v", err)
+			}
+			if got := plain.Bytes()[fs.NcaFullHeaderSize:][:len(sections[0].Data)]; !bytes.Equal(got, sections[0].Data) {
+				t.Error("restored section 0 did not decrypt to its plaintext")
+			}
+		})
+	}
+}
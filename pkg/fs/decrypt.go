@@ -0,0 +1,76 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+)
+
+// DecryptNca writes the fully decrypted NCA to w: the decrypted header
+// followed by the body with every encrypted section decrypted. titleKey is
+// used for rights ID NCAs and may be nil for standard crypto.
+// The body is read up to the header's ContentSize.
+func DecryptNca(r io.ReaderAt, w io.Writer, titleKey []byte) (int64, error) {
+	nca, err := NewNCA(r)
+	if err != nil {
+		return 0, err
+	}
+	if titleKey != nil {
+		nca.Header.TitleKey = titleKey
+	}
+
+	totalSize := int64(nca.Header.ContentSize)
+	if totalSize < NcaFullHeaderSize {
+		return 0, fmt.Errorf("%w: content size %d", ErrNcaTooSmall, totalSize)
+	}
+
+	sections, err := nca.GetEncryptionSections()
+	if err != nil {
+		return 0, err
+	}
+	if err := checkSectionKeys(sections); err != nil {
+		return 0, err
+	}
+	ciphers, err := newSectionCiphers(sections)
+	if err != nil {
+		return 0, err
+	}
+
+	// 1. Header: the decrypted 0xC00 header, then the rest of the full header as stored
+	header := nca.Header.DecryptedHeaderBytes()
+	rest := make([]byte, NcaFullHeaderSize-NcaHeaderStructSize)
+	if n, err := r.ReadAt(rest, NcaHeaderStructSize); n < len(rest) {
+		return 0, err
+	}
+
+	var written int64
+	for _, b := range [][]byte{header, rest} {
+		n, err := w.Write(b)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	// 2. Body, decrypted block by block
+	blockSize := int64(1) << DefaultBlockSizeEx
+	buf := make([]byte, blockSize)
+	for offset := int64(NcaFullHeaderSize); offset < totalSize; offset += blockSize {
+		chunk := buf
+		if remaining := totalSize - offset; remaining < blockSize {
+			chunk = buf[:remaining]
+		}
+		if n, err := r.ReadAt(chunk, offset); n < len(chunk) {
+			return written, fmt.Errorf("read at 0x%x: %w", offset, err)
+		}
+
+		decryptChunk(chunk, offset, ciphers)
+
+		n, err := w.Write(chunk)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
@@ -0,0 +1,66 @@
+package fs_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/falk/nsz-go/internal/testutil"
+	"github.com/falk/nsz-go/pkg/crypto"
+	"github.com/falk/nsz-go/pkg/fs"
+	"github.com/falk/nsz-go/pkg/keys"
+)
+
+func TestDecryptNca(t *testing.T) {
+	if err := keys.Set("header_key", testutil.HeaderKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two CTR sections and a plain one, with known plaintext
+	sections := []testutil.SectionSpec{
+		{Size: 0x20000, FsType: fs.FsTypePfs0, Counter: 1, Data: append([]byte("PFS0"), bytes.Repeat([]byte{0xa5}, 0x1fffc)...)},
+		{Size: 0x10000, FsType: fs.FsTypeRomFs, Counter: 2, Data: bytes.Repeat([]byte("romfs data\n\x00\x00\x00\x00\x00"), 0x1000)},
+		{Size: 0x8000, FsType: fs.FsTypeRomFs, CryptoType: fs.CryptoTypeNone, Data: bytes.Repeat([]byte{0x3c}, 0x8000)},
+	}
+	nca := newTestNca(t, sections)
+
+	var out bytes.Buffer
+	n, err := fs.DecryptNca(bytes.NewReader(nca), &out, testutil.TitleKey)
+	if err != nil {
+		t.Fatalf("DecryptNca: %v", err)
+	}
+	if n != int64(len(nca)) || out.Len() != len(nca) {
+		t.Fatalf("DecryptNca returned %d and wrote %d bytes, want %d", n, out.Len(), len(nca))
+	}
+	got := out.Bytes()
+
+	// The header, decrypted sector by sector with the header key
+	xts, err := crypto.NewXTS(testutil.HeaderKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header := make([]byte, fs.NcaHeaderStructSize)
+	for sector := 0; sector < fs.NcaHeaderStructSize/fs.MediaSize; sector++ {
+		b := nca[sector*fs.MediaSize : (sector+1)*fs.MediaSize]
+		if err := xts.Decrypt(header[sector*fs.MediaSize:], b, uint64(sector)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if string(got[0x200:0x204]) != fs.MagicNCA3 {
+		t.Errorf("magic = %q", got[0x200:0x204])
+	}
+	if !bytes.Equal(got[:fs.NcaHeaderStructSize], header) {
+		t.Error("decrypted header differs")
+	}
+	if !bytes.Equal(got[fs.NcaHeaderStructSize:fs.NcaFullHeaderSize], nca[fs.NcaHeaderStructSize:fs.NcaFullHeaderSize]) {
+		t.Error("the rest of the full header was not copied as stored")
+	}
+
+	// The sections, back to back after the header
+	offset := int64(fs.NcaFullHeaderSize)
+	for i, s := range sections {
+		if !bytes.Equal(got[offset:offset+s.Size], s.Data) {
+			t.Errorf("section %d did not decrypt to its plaintext", i)
+		}
+		offset += s.Size
+	}
+}
@@ -0,0 +1,278 @@
+package fs
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+const MagicHFS0 = "HFS0"
+
+// HFS0Header represents the header of an HFS0 partition (gamecard filesystem).
+type HFS0Header struct {
+	Magic           [4]byte
+	NumFiles        uint32
+	StringTableSize uint32
+	Reserved        uint32
+}
+
+// HFS0FileEntry represents a file entry in the HFS0 header. Hash is the
+// SHA-256 of the first HashedSize bytes of the file.
+type HFS0FileEntry struct {
+	DataOffset uint64
+	DataSize   uint64
+	NameOffset uint32
+	HashedSize uint32
+	Reserved   uint64
+	Hash       [sha256.Size]byte
+}
+
+type Hfs0File struct {
+	Name  string
+	Entry HFS0FileEntry
+}
+
+// OpenHfs0 reads the HFS0 header at offset and returns the file entries and
+// the header size; file data offsets are relative to the end of the header.
+func OpenHfs0(r io.ReaderAt, offset int64) ([]Hfs0File, int64, error) {
+	f := io.NewSectionReader(r, offset, 1<<62)
+
+	var header HFS0Header
+	if err := binary.Read(f, binary.LittleEndian, &header); err != nil {
+		return nil, 0, err
+	}
+
+	if string(header.Magic[:]) != MagicHFS0 {
+		return nil, 0, fmt.Errorf("invalid magic: expected HFS0, got %s", header.Magic)
+	}
+
+	entries := make([]HFS0FileEntry, header.NumFiles)
+	if err := binary.Read(f, binary.LittleEndian, &entries); err != nil {
+		return nil, 0, err
+	}
+
+	stringTable := make([]byte, header.StringTableSize)
+	if _, err := io.ReadFull(f, stringTable); err != nil {
+		return nil, 0, err
+	}
+
+	files := make([]Hfs0File, header.NumFiles)
+	for i, entry := range entries {
+		name, err := getName(stringTable, entry.NameOffset)
+		if err != nil {
+			return nil, 0, err
+		}
+		files[i] = Hfs0File{Name: name, Entry: entry}
+	}
+
+	// Data starts after Header + Entries + StringTable
+	headerSize := int64(16 + len(entries)*0x40 + len(stringTable))
+	return files, headerSize, nil
+}
+
+// Hfs0Writer writes an HFS0 partition at a fixed offset of f. Files are
+// written in order, each starting on a MediaSize boundary; the header and
+// hashes are written by Close, which reads the start of every file back.
+type Hfs0Writer struct {
+	f           io.ReadWriteSeeker
+	base        int64
+	names       []string
+	stringTable []byte
+	entries     []HFS0FileEntry
+	headerSize  int64
+	dataOffset  int64 // Current write position relative to data start
+}
+
+// NewHfs0Writer returns a writer for an HFS0 starting at offset base of f.
+// The string table is padded so the header fills whole MediaSize sectors.
+func NewHfs0Writer(f io.ReadWriteSeeker, base int64, fileNames []string) (*Hfs0Writer, error) {
+	stringTable := make([]byte, 0)
+	entries := make([]HFS0FileEntry, len(fileNames))
+	for i, name := range fileNames {
+		entries[i].NameOffset = uint32(len(stringTable))
+		stringTable = append(stringTable, []byte(name)...)
+		stringTable = append(stringTable, 0)
+	}
+
+	headerSize := int64(16 + len(entries)*0x40 + len(stringTable))
+	if pad := alignUp(headerSize, MediaSize) - headerSize; pad > 0 {
+		stringTable = append(stringTable, make([]byte, pad)...)
+		headerSize += pad
+	}
+
+	if _, err := f.Seek(base+headerSize, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	return &Hfs0Writer{
+		f:           f,
+		base:        base,
+		names:       append([]string(nil), fileNames...),
+		stringTable: stringTable,
+		entries:     entries,
+		headerSize:  headerSize,
+	}, nil
+}
+
+// BeginFile starts the i-th file at the next MediaSize boundary and returns
+// its absolute offset in f. Everything written to f until EndFile belongs to it.
+func (w *Hfs0Writer) BeginFile(index int) (int64, error) {
+	if pad := alignUp(w.dataOffset, MediaSize) - w.dataOffset; pad > 0 {
+		if _, err := w.f.Write(make([]byte, pad)); err != nil {
+			return 0, err
+		}
+		w.dataOffset += pad
+	}
+	w.entries[index].DataOffset = uint64(w.dataOffset)
+	return w.base + w.headerSize + w.dataOffset, nil
+}
+
+// EndFile ends the i-th file at the current position of f. Its hash covers
+// the first hashedSize bytes (or the whole file, if shorter).
+func (w *Hfs0Writer) EndFile(index int, hashedSize uint32) error {
+	pos, err := w.f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	size := pos - w.base - w.headerSize - int64(w.entries[index].DataOffset)
+	if size < 0 {
+		return fmt.Errorf("file %d ends before it starts", index)
+	}
+	if int64(hashedSize) > size {
+		hashedSize = uint32(size)
+	}
+
+	w.entries[index].DataSize = uint64(size)
+	w.entries[index].HashedSize = hashedSize
+	w.dataOffset += size
+	return nil
+}
+
+// AddFile writes data for the i-th file.
+func (w *Hfs0Writer) AddFile(index int, r io.Reader, size int64, hashedSize uint32) error {
+	if _, err := w.BeginFile(index); err != nil {
+		return err
+	}
+	if _, err := io.CopyN(w.f, r, size); err != nil {
+		return err
+	}
+	return w.EndFile(index, hashedSize)
+}
+
+// AddCompressedFile compresses and writes the i-th file, hashing its first
+// sector. If the NCA does not compress, the original bytes are stored instead
+// and the member is renamed from .ncz back to .nca.
+func (w *Hfs0Writer) AddCompressedFile(index int, r io.ReaderAt, size int64, titleKey []byte, opts CompressOptions) (*CompressResult, error) {
+	if _, err := w.BeginFile(index); err != nil {
+		return nil, err
+	}
+
+	var nca *NCA
+	var res *CompressResult
+	var err error
+	if opts.NoDecrypt {
+		res, err = CompressNca(r, w.f, size, titleKey, opts)
+	} else {
+		nca, err = NewNCAWithHeaderKey(r, opts.HeaderKey)
+		if err != nil {
+			return nil, err
+		}
+		res, err = CompressParsedNca(nca, w.f, size, titleKey, opts)
+	}
+	if errors.Is(err, ErrNotCompressible) {
+		if ext := filepath.Ext(w.names[index]); strings.ToLower(ext) == ".ncz" {
+			w.setName(index, strings.TrimSuffix(w.names[index], ext)+".nca")
+		}
+		if _, err := io.Copy(w.f, io.NewSectionReader(r, 0, size)); err != nil {
+			return nil, err
+		}
+		res = &CompressResult{InputSize: size, OutputSize: size, Stored: true, NCA: nca}
+	} else if err != nil {
+		return nil, err
+	}
+
+	return res, w.EndFile(index, MediaSize)
+}
+
+// AddDecompressedFile decompresses the NCZ r and writes the restored NCA as
+// the i-th file.
+func (w *Hfs0Writer) AddDecompressedFile(index int, r io.ReaderAt, hashedSize uint32) error {
+	if _, err := w.BeginFile(index); err != nil {
+		return err
+	}
+	if _, err := DecompressNca(r, w.f); err != nil {
+		return err
+	}
+	return w.EndFile(index, hashedSize)
+}
+
+// setName renames the i-th file to a name of the same length.
+func (w *Hfs0Writer) setName(index int, name string) {
+	copy(w.stringTable[w.entries[index].NameOffset:], name)
+	w.names[index] = name
+}
+
+// Name returns the current name of the i-th file.
+func (w *Hfs0Writer) Name(index int) string {
+	return w.names[index]
+}
+
+// HeaderSize returns the size of the HFS0 header, string table padding included.
+func (w *Hfs0Writer) HeaderSize() int64 {
+	return w.headerSize
+}
+
+// Size returns the size of the HFS0 written so far, header included.
+func (w *Hfs0Writer) Size() int64 {
+	return w.headerSize + w.dataOffset
+}
+
+// Close hashes the files, writes the header and leaves f positioned at the
+// end of the partition. It does not close f.
+func (w *Hfs0Writer) Close() error {
+	// 1. Hash the start of every file
+	for i := range w.entries {
+		e := &w.entries[i]
+		buf := make([]byte, e.HashedSize)
+		if _, err := w.f.Seek(w.base+w.headerSize+int64(e.DataOffset), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(w.f, buf); err != nil {
+			return fmt.Errorf("hash %s: %w", w.names[i], err)
+		}
+		e.Hash = sha256.Sum256(buf)
+	}
+
+	// 2. Header
+	if _, err := w.f.Seek(w.base, io.SeekStart); err != nil {
+		return err
+	}
+
+	header := HFS0Header{
+		NumFiles:        uint32(len(w.entries)),
+		StringTableSize: uint32(len(w.stringTable)),
+	}
+	copy(header.Magic[:], MagicHFS0)
+
+	if err := binary.Write(w.f, binary.LittleEndian, header); err != nil {
+		return err
+	}
+	if err := binary.Write(w.f, binary.LittleEndian, w.entries); err != nil {
+		return err
+	}
+	if _, err := w.f.Write(w.stringTable); err != nil {
+		return err
+	}
+
+	_, err := w.f.Seek(w.base+w.Size(), io.SeekStart)
+	return err
+}
+
+// alignUp rounds n up to a multiple of align.
+func alignUp(n, align int64) int64 {
+	return (n + align - 1) / align * align
+}
@@ -0,0 +1,95 @@
+package fs
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	romFsHeaderSize   = 0x50
+	romFsFileEntryLen = 0x20 // File entry without its name
+
+	// nacpTitlesSize is the size of the 16 language entries that open a NACP:
+	// a 0x200-byte name then a 0x100-byte publisher each.
+	nacpTitlesSize    = 16 * 0x300
+	nacpTitleNameSize = 0x200
+
+	// maxRomFsMetaSize bounds the file table ReadTitleName reads into memory.
+	maxRomFsMetaSize = 1 << 24
+)
+
+// ErrNoTitleName is returned by ReadTitleName when the control NCA has no
+// control.nacp, or it names the title in no language.
+var ErrNoTitleName = errors.New("no title name found")
+
+// ReadTitleName returns the name of the title from the control.nacp in the
+// RomFS of a control NCA, in the first language that has one (American
+// English comes first).
+func (n *NCA) ReadTitleName() (string, error) {
+	if n.Header.ContentType != ContentTypeControl {
+		return "", fmt.Errorf("%w: %s NCA", ErrNoTitleName, ContentTypeName(n.Header.ContentType))
+	}
+	start, end, err := n.sectionFs(0, FsTypeRomFs)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrNoTitleName, err)
+	}
+	ciphers, err := n.bodyCiphers()
+	if err != nil {
+		return "", err
+	}
+
+	// 1. RomFS header, then the file table
+	header, err := n.readDecrypted(ciphers, start, romFsHeaderSize)
+	if err != nil {
+		return "", err
+	}
+	if binary.LittleEndian.Uint64(header) != romFsHeaderSize {
+		return "", fmt.Errorf("%w: section 0 is not a RomFS", ErrNoTitleName)
+	}
+	fileTableOffset := int64(binary.LittleEndian.Uint64(header[0x38:]))
+	fileTableSize := int64(binary.LittleEndian.Uint64(header[0x40:]))
+	fileDataOffset := int64(binary.LittleEndian.Uint64(header[0x48:]))
+	if fileTableSize > maxRomFsMetaSize || start+fileTableOffset+fileTableSize > end {
+		return "", fmt.Errorf("romfs file table at 0x%x is 0x%x bytes", fileTableOffset, fileTableSize)
+	}
+	files, err := n.readDecrypted(ciphers, start+fileTableOffset, fileTableSize)
+	if err != nil {
+		return "", err
+	}
+
+	// 2. control.nacp, a file of the root directory. Files are looked up
+	// by walking the table rather than its hash buckets.
+	for off := int64(0); off+romFsFileEntryLen <= fileTableSize; {
+		entry := files[off:]
+		nameLen := int64(binary.LittleEndian.Uint32(entry[0x1C:]))
+		if off+romFsFileEntryLen+nameLen > fileTableSize {
+			break
+		}
+		name := string(entry[romFsFileEntryLen : romFsFileEntryLen+nameLen])
+		if binary.LittleEndian.Uint32(entry) == 0 && name == "control.nacp" {
+			dataOffset := start + fileDataOffset + int64(binary.LittleEndian.Uint64(entry[0x8:]))
+			if binary.LittleEndian.Uint64(entry[0x10:]) < nacpTitlesSize || dataOffset+nacpTitlesSize > end {
+				return "", fmt.Errorf("%w: control.nacp is truncated", ErrNoTitleName)
+			}
+			return n.readNacpName(ciphers, dataOffset)
+		}
+		// Entries are 4-byte aligned
+		off += (romFsFileEntryLen + nameLen + 3) &^ 3
+	}
+	return "", fmt.Errorf("%w: no control.nacp", ErrNoTitleName)
+}
+
+// readNacpName returns the first title name of the NACP at offset.
+func (n *NCA) readNacpName(ciphers []sectionCipher, offset int64) (string, error) {
+	titles, err := n.readDecrypted(ciphers, offset, nacpTitlesSize)
+	if err != nil {
+		return "", err
+	}
+	for i := 0; i < nacpTitlesSize; i += 0x300 {
+		if name := trimNul(titles[i : i+nacpTitleNameSize]); len(name) > 0 {
+			return string(name), nil
+		}
+	}
+	return "", ErrNoTitleName
+}
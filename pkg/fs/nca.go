@@ -1,25 +1,75 @@
 package fs
 
 import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"sort"
 
 	"github.com/falk/nsz-go/pkg/nsz"
 )
 
+var (
+	// ErrSectionOverlap is returned when two crypto sections cover the same
+	// bytes.
+	ErrSectionOverlap = errors.New("ncz sections overlap")
+	// ErrSectionOutOfRange is returned when a crypto section runs past the
+	// content size in the NCA header.
+	ErrSectionOutOfRange = errors.New("ncz section runs past the end of the nca")
+	// ErrSectionGap is returned when part of an NCA section is not covered by
+	// any crypto section.
+	ErrSectionGap = errors.New("ncz sections leave a gap")
+	// ErrBktrParse is returned when the subsection table of a BKTR section
+	// cannot be read. Without it the per-subsection counters are unknown, and
+	// the base counter alone would silently corrupt the patched regions.
+	ErrBktrParse = errors.New("cannot parse bktr subsection table")
+)
+
 type NCA struct {
 	Header *NcaHeader
 	Reader io.ReaderAt
 }
 
 func NewNCA(r io.ReaderAt) (*NCA, error) {
-	h, err := ParseNcaHeader(r)
+	return NewNCAWithHeaderKey(r, nil)
+}
+
+// NewNCAWithHeaderKey opens an NCA whose header is encrypted with headerKey
+// rather than the loaded header_key.
+func NewNCAWithHeaderKey(r io.ReaderAt, headerKey []byte) (*NCA, error) {
+	h, err := ParseNcaHeaderWithKey(r, headerKey)
 	if err != nil {
 		return nil, err
 	}
 	return &NCA{Header: h, Reader: r}, nil
 }
 
+// ContentID returns the NCA's content ID: the first 16 bytes of the SHA-256
+// of the whole NCA as stored (encrypted). Canonical NCA filenames are the
+// hex content ID.
+func (n *NCA) ContentID(r io.ReaderAt, size int64) ([16]byte, error) {
+	var id [16]byte
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(r, 0, size)); err != nil {
+		return id, err
+	}
+	copy(id[:], h.Sum(nil))
+	return id, nil
+}
+
+// IsPatch reports whether the NCA is a patch (update) NCA, one with a BKTR
+// section that patches the matching NCA of the base game.
+func (n *NCA) IsPatch() bool {
+	for i := range n.Header.FsHeaders {
+		if n.Header.FsHeaders[i].CryptoType == CryptoTypeBKTR {
+			return true
+		}
+	}
+	return false
+}
+
 // GetEncryptionSections extracts the sections for NSZ compression.
 // For BKTR sections, this parses subsection entries for proper decryption.
 func (n *NCA) GetEncryptionSections() ([]nsz.NczSectionEntry, error) {
@@ -34,17 +84,24 @@ func (n *NCA) GetEncryptionSections() ([]nsz.NczSectionEntry, error) {
 		sectionEnd := uint64(entry.MediaEndOffset) * MediaSize
 		sectionSize := sectionEnd - sectionOffset
 		fsHeader := n.Header.FsHeaders[i]
+		if fsHeader.IsSparse() {
+			return nil, fmt.Errorf("%w: section %d", ErrSparseSection, i)
+		}
 
 		// Build base counter from FS header
 		baseIV := buildBaseIV(fsHeader.CryptoCounter[:])
 
-		// Handle BKTR sections with subsection info
-		if fsHeader.CryptoType == CryptoTypeBKTR && fsHeader.BktrSubsection != nil && fsHeader.BktrSubsection.Size > 0 {
-			bktrSections := n.parseBktrSections(sectionOffset, sectionEnd, fsHeader.BktrSubsection, baseIV)
-			if len(bktrSections) > 0 {
-				sections = append(sections, bktrSections...)
-				continue
+		// Handle BKTR sections with subsection info. Without a body key (only
+		// with CompressOptions.AllowEncrypted) the table cannot be read and
+		// the section is passed through under the base counter.
+		if fsHeader.CryptoType == CryptoTypeBKTR && fsHeader.BktrSubsection != nil && fsHeader.BktrSubsection.Size > 0 &&
+			n.Header.BodyKey(CryptoTypeBKTR) != nil {
+			bktrSections, err := n.parseBktrSections(sectionOffset, sectionEnd, fsHeader.BktrSubsection, baseIV)
+			if err != nil {
+				return nil, fmt.Errorf("section %d: %w", i, err)
 			}
+			sections = append(sections, bktrSections...)
+			continue
 		}
 
 		// Default: single section
@@ -53,8 +110,11 @@ func (n *NCA) GetEncryptionSections() ([]nsz.NczSectionEntry, error) {
 			Size:       sectionSize,
 			CryptoType: uint64(fsHeader.CryptoType),
 		}
-		if n.Header.TitleKey != nil {
-			copy(sec.CryptoKey[:], n.Header.TitleKey)
+		// An NCZ section holds a 16 byte key, too short for XTS, and
+		// decompressors only re-encrypt CTR, so XTS sections (rare outside
+		// the header) are compressed still encrypted and carry no key
+		if fsHeader.CryptoType != CryptoTypeXTS {
+			copy(sec.CryptoKey[:], n.Header.BodyKey(fsHeader.CryptoType))
 		}
 		copy(sec.CryptoCounter[:], baseIV)
 		sections = append(sections, sec)
@@ -65,14 +125,64 @@ func (n *NCA) GetEncryptionSections() ([]nsz.NczSectionEntry, error) {
 		return sections[i].Offset < sections[j].Offset
 	})
 
+	if err := n.validateSections(sections); err != nil {
+		return nil, err
+	}
 	return sections, nil
 }
 
+// validateSections checks that the sorted crypto sections do not overlap,
+// stay within the NCA, and together cover every NCA section. Bytes between
+// NCA sections are not encrypted and need no crypto section.
+func (n *NCA) validateSections(sections []nsz.NczSectionEntry) error {
+	for i, s := range sections {
+		end := s.Offset + s.Size
+		if end < s.Offset || end > n.Header.ContentSize {
+			return fmt.Errorf("%w: 0x%x-0x%x, content size 0x%x", ErrSectionOutOfRange, s.Offset, end, n.Header.ContentSize)
+		}
+		if i > 0 {
+			prev := sections[i-1]
+			if s.Offset < prev.Offset+prev.Size {
+				return fmt.Errorf("%w: 0x%x-0x%x and 0x%x-0x%x", ErrSectionOverlap, prev.Offset, prev.Offset+prev.Size, s.Offset, end)
+			}
+		}
+	}
+
+	for i, entry := range n.Header.SectionTables {
+		if entry.MediaStartOffset == 0 && entry.MediaEndOffset == 0 {
+			continue
+		}
+		start := uint64(entry.MediaStartOffset) * MediaSize
+		end := uint64(entry.MediaEndOffset) * MediaSize
+
+		// Walk the crypto sections that touch [start, end)
+		pos := start
+		for _, s := range sections {
+			if s.Offset+s.Size <= pos || s.Offset >= end {
+				continue
+			}
+			if s.Offset > pos {
+				break
+			}
+			pos = s.Offset + s.Size
+		}
+		if pos < end {
+			return fmt.Errorf("%w: section %d is not covered from 0x%x", ErrSectionGap, i, pos)
+		}
+	}
+	return nil
+}
+
 // parseBktrSections parses BKTR subsection entries into encryption sections.
-func (n *NCA) parseBktrSections(sectionOffset, sectionEnd uint64, bktrHeader *BktrHeader, baseIV []byte) []nsz.NczSectionEntry {
-	buckets, err := ParseBktrSubsectionBuckets(n.Reader, int64(sectionOffset), bktrHeader, n.Header.TitleKey, baseIV)
-	if err != nil || len(buckets) == 0 {
-		return nil
+// It returns ErrBktrParse if the table is unreadable or empty.
+func (n *NCA) parseBktrSections(sectionOffset, sectionEnd uint64, bktrHeader *BktrHeader, baseIV []byte) ([]nsz.NczSectionEntry, error) {
+	bodyKey := n.Header.BodyKey(CryptoTypeBKTR)
+	buckets, err := ParseBktrSubsectionBuckets(n.Reader, int64(sectionOffset), bktrHeader, bodyKey, baseIV)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBktrParse, err)
+	}
+	if len(buckets) == 0 {
+		return nil, ErrBktrParse
 	}
 
 	var sections []nsz.NczSectionEntry
@@ -90,9 +200,7 @@ func (n *NCA) parseBktrSections(sectionOffset, sectionEnd uint64, bktrHeader *Bk
 				CryptoType: CryptoTypeCTR, // BKTR uses CTR for decryption
 			}
 
-			if n.Header.TitleKey != nil {
-				copy(sec.CryptoKey[:], n.Header.TitleKey)
-			}
+			copy(sec.CryptoKey[:], bodyKey)
 
 			counter := SetBktrCounter(baseIV, entry.Ctr)
 			copy(sec.CryptoCounter[:], counter)
@@ -111,23 +219,104 @@ func (n *NCA) parseBktrSections(sectionOffset, sectionEnd uint64, bktrHeader *Bk
 			Size:       sectionEnd - lastEntryEnd,
 			CryptoType: CryptoTypeCTR,
 		}
-		if n.Header.TitleKey != nil {
-			copy(tail.CryptoKey[:], n.Header.TitleKey)
-		}
+		copy(tail.CryptoKey[:], bodyKey)
 		copy(tail.CryptoCounter[:], baseIV)
 		sections = append(sections, tail)
 	}
 
-	return sections
+	if len(sections) == 0 {
+		return nil, ErrBktrParse
+	}
+	return sections, nil
 }
 
 // buildBaseIV constructs the 16-byte base IV from the 8-byte FS header counter.
+// The header stores the upper counter little-endian; the IV wants it
+// big-endian in bytes 0-7. Bytes 8-15 stay zero because NewCTRStream
+// overwrites them with the block number.
 func buildBaseIV(counter []byte) []byte {
 	iv := make([]byte, 16)
-	// Copy counter to high bytes and reverse for proper format
-	copy(iv[8:], counter)
-	for i, j := 0, 15; i < j; i, j = i+1, j-1 {
-		iv[i], iv[j] = iv[j], iv[i]
+	for i := 0; i < 8 && i < len(counter); i++ {
+		iv[7-i] = counter[i]
 	}
 	return iv
 }
+
+// checkDecryption decrypts the start of the filesystem in the first CTR
+// section with a known layout and checks for its header: the PFS0 magic, or
+// the 0x50 header size that opens a RomFS. It returns ErrWrongKey if it is
+// missing, and nil if no section can be checked.
+func (n *NCA) checkDecryption(r io.ReaderAt, sections []nsz.NczSectionEntry) error {
+	ciphers, err := newSectionCiphers(sections)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range n.Header.SectionTables {
+		fsHeader := n.Header.FsHeaders[i]
+		if entry.MediaEndOffset == 0 || fsHeader.CryptoType != CryptoTypeCTR {
+			continue
+		}
+		dataOffset, ok := fsHeader.DataOffset()
+		if !ok {
+			continue
+		}
+
+		offset := int64(entry.MediaStartOffset)*MediaSize + int64(dataOffset)
+		buf := make([]byte, 0x10)
+		if err := readFullAt(r, buf, offset); err != nil {
+			return fmt.Errorf("read section %d at 0x%x: %w", i, offset, err)
+		}
+		decryptChunk(buf, offset, ciphers)
+
+		switch {
+		case fsHeader.FsType == FsTypePfs0 && string(buf[:4]) == "PFS0":
+			return nil
+		case fsHeader.FsType == FsTypeRomFs && binary.LittleEndian.Uint64(buf) == 0x50:
+			return nil
+		}
+		return fmt.Errorf("%w: section %d", ErrWrongKey, i)
+	}
+	return nil
+}
+
+// sectionFs returns where the filesystem of section i starts in the NCA,
+// past its hash tables, and where the section ends. It fails unless the
+// section holds a filesystem of type fsType.
+func (n *NCA) sectionFs(i int, fsType uint8) (start, end int64, err error) {
+	entry := n.Header.SectionTables[i]
+	fsHeader := n.Header.FsHeaders[i]
+	dataOffset, ok := fsHeader.DataOffset()
+	if entry.MediaEndOffset == 0 || fsHeader.FsType != fsType || !ok {
+		return 0, 0, fmt.Errorf("section %d has no filesystem of type %d", i, fsType)
+	}
+	start = int64(entry.MediaStartOffset)*MediaSize + int64(dataOffset)
+	end = int64(entry.MediaEndOffset) * MediaSize
+	if start >= end {
+		return 0, 0, fmt.Errorf("section %d: filesystem at 0x%x is past the end at 0x%x", i, start, end)
+	}
+	return start, end, nil
+}
+
+// bodyCiphers returns the ciphers that decrypt the body, for reading parts of
+// it with readDecrypted.
+func (n *NCA) bodyCiphers() ([]sectionCipher, error) {
+	sections, err := n.GetEncryptionSections()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkSectionKeys(sections); err != nil {
+		return nil, err
+	}
+	return newSectionCiphers(sections)
+}
+
+// readDecrypted reads size bytes of the NCA at offset and decrypts them.
+func (n *NCA) readDecrypted(ciphers []sectionCipher, offset, size int64) ([]byte, error) {
+	buf := make([]byte, size)
+	if err := readFullAt(n.Reader, buf, offset); err != nil {
+		return nil, fmt.Errorf("read 0x%x bytes at 0x%x: %w", size, offset, err)
+	}
+	decryptChunk(buf, offset, ciphers)
+	return buf, nil
+}
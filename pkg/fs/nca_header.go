@@ -3,8 +3,11 @@ package fs
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
+	"sync"
 
 	"github.com/falk/nsz-go/pkg/crypto"
 	"github.com/falk/nsz-go/pkg/keys"
@@ -21,31 +24,102 @@ const (
 	CryptoTypeXTS  = 2
 	CryptoTypeCTR  = 3
 	CryptoTypeBKTR = 4
+
+	// FS types from FS header
+	FsTypeRomFs = 0
+	FsTypePfs0  = 1
+
+	// Hash types from FS header
+	HashTypeHierarchicalSha256    = 2 // PFS0 sections
+	HashTypeHierarchicalIntegrity = 3 // RomFS sections (IVFC)
+
+	// Distribution types from NCA header
+	DistributionTypeDownload = 0
+	DistributionTypeGameCard = 1
+
+	// Content types from NCA header
+	ContentTypeProgram    = 0
+	ContentTypeMeta       = 1
+	ContentTypeControl    = 2
+	ContentTypeManual     = 3
+	ContentTypeData       = 4
+	ContentTypePublicData = 5
 )
 
+// ErrInvalidHeaderKey is returned when header_key is not 32 bytes long.
+var ErrInvalidHeaderKey = errors.New("invalid header_key")
+
+// ContentTypeNames maps NCA content types to their lower-case names.
+var ContentTypeNames = map[byte]string{
+	ContentTypeProgram:    "program",
+	ContentTypeMeta:       "meta",
+	ContentTypeControl:    "control",
+	ContentTypeManual:     "manual",
+	ContentTypeData:       "data",
+	ContentTypePublicData: "publicdata",
+}
+
+// ContentTypeName returns the name of a content type, or "unknown".
+func ContentTypeName(ct byte) string {
+	if name, ok := ContentTypeNames[ct]; ok {
+		return name
+	}
+	return "unknown"
+}
+
+// ParseContentType returns the content type with the given name (case-insensitive).
+func ParseContentType(name string) (byte, error) {
+	name = strings.ToLower(strings.TrimSpace(name))
+	for ct, n := range ContentTypeNames {
+		if n == name {
+			return ct, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown content type %q", name)
+}
+
 type NcaHeader struct {
-	FixedKeySig    [0x100]byte     // 0x000
-	NpkSignature   [0x100]byte     // 0x100
-	Magic          [4]byte         // 0x200 "NCA3"
-	DistType       byte            // 0x204
-	ContentType    byte            // 0x205
-	KeyGeneration  byte            // 0x206
-	KeyAreaIndex   byte            // 0x207
-	ContentSize    uint64          // 0x208
-	ProgID         uint64          // 0x210
-	ContentIdx     uint32          // 0x218
-	SdkAddonVer    uint32          // 0x21C
-	KeyGeneration2 byte            // 0x220
-	Signature2     [0xF]byte       // 0x221
-	RightsID       [0x10]byte      // 0x230
-	SectionTables  [4]SectionEntry // 0x240
-	KeyArea        [0x40]byte      // 0x300 (Fixed offset for Key Area?)
+	FixedKeySig      [0x100]byte     // 0x000
+	NpkSignature     [0x100]byte     // 0x100
+	Magic            [4]byte         // 0x200 "NCA3"
+	DistributionType byte            // 0x204, DistributionTypeDownload or DistributionTypeGameCard
+	ContentType      byte            // 0x205
+	KeyGeneration    byte            // 0x206
+	KeyAreaIndex     byte            // 0x207
+	ContentSize      uint64          // 0x208
+	ProgID           uint64          // 0x210
+	ContentIdx       uint32          // 0x218
+	SdkAddonVersion  uint32          // 0x21C, see SdkVersion
+	KeyGeneration2   byte            // 0x220
+	Signature2       [0xF]byte       // 0x221
+	RightsID         [0x10]byte      // 0x230
+	SectionTables    [4]SectionEntry // 0x240
+	KeyArea          [0x40]byte      // 0x300 (Fixed offset for Key Area?)
 	// Note: KeyArea is at 0x300 relative to start of file (decrypted)
 	// struct padding might be needed if we Read directly into struct.
 	// But we use binary.Read on parts.
 
-	TitleKey  []byte // Decrypted Title Key
-	FsHeaders [4]FsHeader
+	TitleKey         []byte // Decrypted title key from the ticket (rights ID crypto)
+	DecryptedKeyArea []byte // Decrypted key area, nil if the key area key is unavailable
+	FsHeaders        [4]FsHeader
+	// Warnings describes problems that did not stop parsing but may stop
+	// decryption, such as a key area key that is not available.
+	Warnings []string
+
+	decrypted []byte // The decrypted NcaHeaderStructSize bytes it was parsed from
+}
+
+// DecryptedHeaderBytes returns a copy of the decrypted header the NcaHeader
+// was parsed from: the first NcaHeaderStructSize bytes of the NCA, with the
+// key area still wrapped. The rest of the NcaFullHeaderSize region is not
+// encrypted with the header key and is read from the NCA as is. It returns
+// nil for an NcaHeader that was not parsed. NCZs store the header encrypted,
+// not these bytes.
+func (h *NcaHeader) DecryptedHeaderBytes() []byte {
+	if h.decrypted == nil {
+		return nil
+	}
+	return append([]byte(nil), h.decrypted...)
 }
 
 type SectionEntry struct {
@@ -57,43 +131,181 @@ type SectionEntry struct {
 
 type FsHeader struct {
 	Version       uint16
-	FsType        uint8
-	HashType      uint8
-	CryptoType    uint8
-	Reserved      [0x13B]byte // Padding to 0x140
-	CryptoCounter [8]byte     // 0x140
-	Reserved2     [0xB8]byte  // Padding to 0x200
+	FsType        uint8      // 0x2
+	HashType      uint8      // 0x3
+	CryptoType    uint8      // 0x4
+	Reserved      [0x3]byte  // Padding to 0x8
+	HashInfo      [0xF8]byte // 0x8, layout depends on HashType
+	Reserved1     [0x38]byte // Padding to 0x140
+	CryptoCounter [8]byte    // 0x140
+	Reserved2     [0xB8]byte // Padding to 0x200
 
 	// BKTR info (from offsets 0x100-0x140 in FS header)
 	BktrRelocation *BktrHeader // 0x100-0x120
 	BktrSubsection *BktrHeader // 0x120-0x140
+
+	// Layers of newer NCAs (0x148-0x1A0), zero when absent
+	Sparse      SparseInfo // 0x148
+	Compression BktrHeader // 0x178, the bucket tree of the compression layer
 }
 
-// ParseNcaHeader reads and decrypts the NCA header.
-func ParseNcaHeader(r io.ReaderAt) (*NcaHeader, error) {
+// SparseInfo describes the sparse layer of a section: a bucket tree that maps
+// the section onto physical data, with the rest virtual zeros that are not
+// stored. The physical data is encrypted with a counter of its own generation.
+type SparseInfo struct {
+	Table          BktrHeader // Bucket tree, relative to PhysicalOffset
+	PhysicalOffset uint64
+	Generation     uint16
+}
+
+// IsSparse reports whether the section has a sparse layer.
+func (h *FsHeader) IsSparse() bool {
+	return h.Sparse.Generation != 0
+}
+
+// IsCompressed reports whether the section has a compression layer. Its data
+// is still encrypted as a whole, so it compresses like any other section.
+func (h *FsHeader) IsCompressed() bool {
+	return h.Compression.Offset != 0 && h.Compression.Size != 0
+}
+
+// decryptNcaHeader reads the NCA header and XTS-decrypts it with headerKey,
+// or with the loaded header_key if headerKey is nil.
+func decryptNcaHeader(r io.ReaderAt, headerKey []byte) ([]byte, error) {
 	encryptedHeader := make([]byte, NcaHeaderStructSize)
-	if _, err := r.ReadAt(encryptedHeader, 0); err != nil {
+	if err := readFullAt(r, encryptedHeader, 0); err != nil {
 		return nil, err
 	}
 
-	headerKey := keys.Get("header_key")
+	if headerKey == nil {
+		headerKey = keys.Get("header_key")
+	}
 	if headerKey == nil {
 		return nil, fmt.Errorf("header_key not found")
 	}
+	if len(headerKey) != 32 {
+		return nil, fmt.Errorf("%w: expected 32 bytes, got %d", ErrInvalidHeaderKey, len(headerKey))
+	}
 
-	// Decrypt in sectors of 0x200 bytes
+	cacheKey := string(headerKey) + string(encryptedHeader)
+	if decrypted, ok := headerCache.get(cacheKey); ok {
+		return decrypted, nil
+	}
+
+	xts, err := crypto.CachedXTS(headerKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// Decrypt in sectors of 0x200 bytes; the header is always a whole number of sectors
 	decrypted := make([]byte, len(encryptedHeader))
-	sectorSize := 0x200
+	sectorSize := MediaSize
+	if len(encryptedHeader)%sectorSize != 0 {
+		return nil, fmt.Errorf("header length 0x%x is not sector aligned", len(encryptedHeader))
+	}
 	for i := 0; i < len(encryptedHeader)/sectorSize; i++ {
 		start := i * sectorSize
 		end := start + sectorSize
-		chunk := encryptedHeader[start:end]
 
-		out, err := crypto.XTSDecrypt(chunk, headerKey, uint64(i))
-		if err != nil {
+		if err := xts.Decrypt(decrypted[start:end], encryptedHeader[start:end], uint64(i)); err != nil {
 			return nil, fmt.Errorf("failed to decrypt sector %d: %v", i, err)
 		}
-		copy(decrypted[start:end], out)
+	}
+
+	headerCache.put(cacheKey, decrypted)
+	return decrypted, nil
+}
+
+// headerCacheSize is how many decrypted NCA headers are kept.
+const headerCacheSize = 64
+
+// headerCache holds recently decrypted NCA headers, keyed by the header key
+// and the encrypted header, so that opening the same NCA again (to pick the
+// NCAs worth compressing, then to compress them) skips the XTS pass.
+var headerCache = &ncaHeaderCache{entries: make(map[string][]byte)}
+
+type ncaHeaderCache struct {
+	mu      sync.Mutex
+	entries map[string][]byte
+	order   []string // Insertion order, for eviction
+}
+
+// get returns a copy of the cached header for key.
+func (c *ncaHeaderCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	h, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	return append([]byte(nil), h...), true
+}
+
+// put caches a copy of header, evicting the oldest entry when full.
+func (c *ncaHeaderCache) put(key string, header []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[key]; ok {
+		return
+	}
+	if len(c.order) >= headerCacheSize {
+		delete(c.entries, c.order[0])
+		c.order = c.order[1:]
+	}
+	c.entries[key] = append([]byte(nil), header...)
+	c.order = append(c.order, key)
+}
+
+// PeekContentType returns the content type of an NCA, decrypting only the
+// header sector that holds it (with the loaded header_key). Use it to decide
+// whether an NCA is worth compressing without parsing the whole header.
+func PeekContentType(r io.ReaderAt) (byte, error) {
+	return PeekContentTypeWithKey(r, nil)
+}
+
+// PeekContentTypeWithKey is like PeekContentType but decrypts the header
+// sector with the given 32-byte header key; nil means the loaded header_key.
+func PeekContentTypeWithKey(r io.ReaderAt, headerKey []byte) (byte, error) {
+	if headerKey == nil {
+		headerKey = keys.Get("header_key")
+	}
+	if headerKey == nil {
+		return 0, fmt.Errorf("header_key not found")
+	}
+	if len(headerKey) != 32 {
+		return 0, fmt.Errorf("%w: expected 32 bytes, got %d", ErrInvalidHeaderKey, len(headerKey))
+	}
+	xts, err := crypto.CachedXTS(headerKey)
+	if err != nil {
+		return 0, err
+	}
+
+	// The main header (magic, content type) is the second sector
+	sector := make([]byte, MediaSize)
+	if _, err := r.ReadAt(sector, MediaSize); err != nil {
+		return 0, err
+	}
+	if err := xts.Decrypt(sector, sector, 1); err != nil {
+		return 0, err
+	}
+	if string(sector[:4]) != MagicNCA3 {
+		return 0, fmt.Errorf("invalid magic: expected NCA3, got %s", sector[:4])
+	}
+	return sector[5], nil
+}
+
+// ParseNcaHeader reads and decrypts the NCA header with the loaded header_key.
+func ParseNcaHeader(r io.ReaderAt) (*NcaHeader, error) {
+	return ParseNcaHeaderWithKey(r, nil)
+}
+
+// ParseNcaHeaderWithKey is like ParseNcaHeader but decrypts the header with
+// the given 32-byte header key instead of the global key set. The key area is
+// still decrypted with the loaded key area keys.
+func ParseNcaHeaderWithKey(r io.ReaderAt, headerKey []byte) (*NcaHeader, error) {
+	decrypted, err := decryptNcaHeader(r, headerKey)
+	if err != nil {
+		return nil, err
 	}
 
 	// Parse Main Header at 0x200
@@ -122,12 +334,18 @@ func ParseNcaHeader(r io.ReaderAt) (*NcaHeader, error) {
 	}
 
 	var header NcaHeader
+	header.decrypted = decrypted
 	header.Magic = mainBlock.Magic
 	header.ContentType = mainBlock.ContentType
+	header.KeyAreaIndex = mainBlock.KeyAreaIdx
 	header.KeyGeneration = mainBlock.KeyGen
 	header.KeyGeneration2 = mainBlock.KeyGen2
 	header.ContentSize = mainBlock.ContentSize
 	header.RightsID = mainBlock.RightsID
+	header.DistributionType = mainBlock.DistType
+	header.SdkAddonVersion = mainBlock.SdkAddonVer
+	header.ProgID = mainBlock.ProgID
+	header.ContentIdx = mainBlock.ContentIdx
 
 	// Read Section Tables (0x240)
 	secReader := bytes.NewReader(decrypted[0x240:])
@@ -138,35 +356,13 @@ func ParseNcaHeader(r io.ReaderAt) (*NcaHeader, error) {
 	// Read Key Area (0x300)
 	copy(header.KeyArea[:], decrypted[0x300:0x340])
 
-	// Get Title Key
-	keyGen := int(header.KeyGeneration)
-	if header.KeyGeneration2 > header.KeyGeneration {
-		keyGen = int(header.KeyGeneration2)
-	}
-	keyGen = keyGen - 1
-	if keyGen < 0 {
-		keyGen = 0
-	}
-
-	// Decrypt Key Area
-	// Usually Title Key is at index 2 (offset 0x20 in KeyArea)
-	encryptedTitleKey := header.KeyArea[0x20:0x30]
-
-	// Only decrypt if we have keys (check rightsID?)
-	// If RightsID is zero, use Key Area. If RightsID is set, usually title key is from ticket.
-	// For Standard crypto (e.g. Program), RightsID might be 0 or set.
-	// If set, we need ticket.
-	// Simplification: Assume Key Area contains the key (Standard Crypto).
-
-	// Check if Key Area is used (Crypto Type != 0)
-	// Wait, FS Header determines Crypto Type.
-	// But getting the key block happens here.
-
-	titleKey, err := keys.UnwrapAesWrappedTitleKey(encryptedTitleKey, keyGen)
+	// Decrypt the key area. Standard crypto NCAs (no rights ID) take their
+	// body key from it; rights ID NCAs get a title key from a ticket instead.
+	keyArea, err := keys.DecryptKeyArea(header.KeyArea[:], header.MasterKeyRevision(), int(header.KeyAreaIndex))
 	if err == nil {
-		header.TitleKey = titleKey
-	} else {
-		// fmt.Printf("Warning: Failed to unwrap title key: %v\n", err)
+		header.DecryptedKeyArea = keyArea
+	} else if !header.HasRightsID() {
+		header.Warnings = append(header.Warnings, fmt.Sprintf("key area: %v", err))
 	}
 
 	// Parse FS Headers (0x400, 0x600, 0x800, 0xA00)
@@ -176,8 +372,10 @@ func ParseNcaHeader(r io.ReaderAt) (*NcaHeader, error) {
 
 		var h FsHeader
 		h.Version = binary.LittleEndian.Uint16(data[0x0:0x2])
-		h.FsType = data[0x3]
+		h.FsType = data[0x2]
+		h.HashType = data[0x3]
 		h.CryptoType = data[0x4]
+		copy(h.HashInfo[:], data[0x8:0x100])
 		copy(h.CryptoCounter[:], data[0x140:0x148])
 
 		// Parse BKTR headers if this is a BKTR section
@@ -185,9 +383,114 @@ func ParseNcaHeader(r io.ReaderAt) (*NcaHeader, error) {
 			h.BktrRelocation = ParseBktrHeader(data[0x100:0x120])
 			h.BktrSubsection = ParseBktrHeader(data[0x120:0x140])
 		}
+		h.Sparse = SparseInfo{
+			Table:          *ParseBktrHeader(data[0x148:0x168]),
+			PhysicalOffset: binary.LittleEndian.Uint64(data[0x168:0x170]),
+			Generation:     binary.LittleEndian.Uint16(data[0x170:0x172]),
+		}
+		h.Compression = *ParseBktrHeader(data[0x178:0x198])
 
 		header.FsHeaders[i] = h
 	}
 
 	return &header, nil
 }
+
+// MasterKeyRevision returns the index of the master key the NCA is encrypted
+// with. Key generations 0 and 1 both use master key 0.
+func (h *NcaHeader) MasterKeyRevision() int {
+	keyGen := h.KeyGeneration
+	if h.KeyGeneration2 > h.KeyGeneration {
+		keyGen = h.KeyGeneration2
+	}
+	return masterKeyIndex(keyGen)
+}
+
+// RightsIDKeyGeneration returns the key generation encoded in the last byte
+// of the rights ID, which is the one the ticket's title key is encrypted
+// with. It is 0 for NCAs without a rights ID.
+func (h *NcaHeader) RightsIDKeyGeneration() int {
+	return int(h.RightsID[15])
+}
+
+// TitleKeyMasterKeyIndex returns the index of the master key that decrypts
+// the title key of a rights ID NCA: the rights ID generation, which can
+// differ from the header's. Without a rights ID it is MasterKeyRevision.
+func (h *NcaHeader) TitleKeyMasterKeyIndex() int {
+	if !h.HasRightsID() {
+		return h.MasterKeyRevision()
+	}
+	return masterKeyIndex(byte(h.RightsIDKeyGeneration()))
+}
+
+// masterKeyIndex returns the master key index of a key generation byte.
+func masterKeyIndex(keyGen byte) int {
+	if keyGen == 0 {
+		return 0
+	}
+	return int(keyGen) - 1
+}
+
+// HasRightsID reports whether the NCA uses title key crypto (a ticket)
+// rather than its key area.
+func (h *NcaHeader) HasRightsID() bool {
+	return h.RightsID != [0x10]byte{}
+}
+
+// BodyKey returns the key used to decrypt sections of the given crypto type:
+// the ticket title key for rights ID NCAs, otherwise the matching key area
+// slot (slots 0-1 for XTS, slot 2 for CTR). It returns nil if unavailable.
+// An all-zero key counts as unavailable: it is what a failed unwrap leaves
+// behind, and decrypting with it silently yields garbage.
+func (h *NcaHeader) BodyKey(cryptoType uint8) []byte {
+	var key []byte
+	switch {
+	case h.HasRightsID():
+		key = h.TitleKey
+	case h.DecryptedKeyArea == nil:
+		return nil
+	case cryptoType == CryptoTypeXTS:
+		key = h.DecryptedKeyArea[0x00:0x20]
+	case cryptoType == CryptoTypeCTR, cryptoType == CryptoTypeBKTR:
+		key = h.DecryptedKeyArea[0x20:0x30]
+	}
+	if isZeroKey(key) {
+		return nil
+	}
+	return key
+}
+
+// isZeroKey reports whether key is empty or all zero bytes.
+func isZeroKey(key []byte) bool {
+	for _, b := range key {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// SdkVersion returns the SDK addon version as "major.minor.micro".
+func (h *NcaHeader) SdkVersion() string {
+	v := h.SdkAddonVersion
+	return fmt.Sprintf("%d.%d.%d", v>>24, v>>16&0xFF, v>>8&0xFF)
+}
+
+// DataOffset returns the offset, relative to the section, of the filesystem
+// data that follows the hash tables: the PFS0 header for HierarchicalSha256
+// sections, or the RomFS header (the last IVFC level) for HierarchicalIntegrity.
+// ok is false for other hash types.
+func (h *FsHeader) DataOffset() (offset uint64, ok bool) {
+	switch h.HashType {
+	case HashTypeHierarchicalSha256:
+		// Master hash (0x20), block size, layer count, hash table region, then the PFS0 region
+		return binary.LittleEndian.Uint64(h.HashInfo[0x38:]), true
+	case HashTypeHierarchicalIntegrity:
+		// "IVFC", version, master hash size, level count, then six 0x18-byte levels
+		if string(h.HashInfo[:4]) != "IVFC" {
+			return 0, false
+		}
+		return binary.LittleEndian.Uint64(h.HashInfo[0x10+5*0x18:]), true
+	}
+	return 0, false
+}
@@ -0,0 +1,70 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+
+	"github.com/falk/nsz-go/pkg/nsz"
+)
+
+func TestBuildBaseIV(t *testing.T) {
+	tests := []struct {
+		name    string
+		counter string // As in the FS header
+		want    string
+	}{
+		{"zero", "0000000000000000", "00000000000000000000000000000000"},
+		{"generation", "0100000000000000", "00000000000000010000000000000000"},
+		{"secure value", "0000000001000000", "00000001000000000000000000000000"},
+		{"all bytes", "0123456789abcdef", "efcdab89674523010000000000000000"},
+		{"short", "0102", "00000000000002010000000000000000"},
+		{"long", "0123456789abcdefffff", "efcdab89674523010000000000000000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			counter, _ := hex.DecodeString(tt.counter)
+			want, _ := hex.DecodeString(tt.want)
+			if got := buildBaseIV(counter); !bytes.Equal(got, want) {
+				t.Errorf("buildBaseIV(%s) = %x, want %x", tt.counter, got, want)
+			}
+		})
+	}
+}
+
+func TestValidateSections(t *testing.T) {
+	// Two NCA sections, 0x4000-0x24000 and 0x24000-0x34000, with a gap
+	// before a third at 0x40000-0x50000
+	header := &NcaHeader{ContentSize: 0x50000}
+	header.SectionTables[0] = SectionEntry{MediaStartOffset: 0x20, MediaEndOffset: 0x120}
+	header.SectionTables[1] = SectionEntry{MediaStartOffset: 0x120, MediaEndOffset: 0x1A0}
+	header.SectionTables[2] = SectionEntry{MediaStartOffset: 0x200, MediaEndOffset: 0x280}
+	n := &NCA{Header: header}
+
+	section := func(offset, size uint64) nsz.NczSectionEntry {
+		return nsz.NczSectionEntry{Offset: offset, Size: size, CryptoType: CryptoTypeCTR}
+	}
+	tests := []struct {
+		name     string
+		sections []nsz.NczSectionEntry
+		want     error
+	}{
+		{"one per section", []nsz.NczSectionEntry{section(0x4000, 0x20000), section(0x24000, 0x10000), section(0x40000, 0x10000)}, nil},
+		{"split section", []nsz.NczSectionEntry{section(0x4000, 0x8000), section(0xC000, 0x18000), section(0x24000, 0x10000), section(0x40000, 0x10000)}, nil},
+		{"one across two", []nsz.NczSectionEntry{section(0x4000, 0x30000), section(0x40000, 0x10000)}, nil},
+		{"overlap", []nsz.NczSectionEntry{section(0x4000, 0x20010), section(0x24000, 0x10000), section(0x40000, 0x10000)}, ErrSectionOverlap},
+		{"gap", []nsz.NczSectionEntry{section(0x4000, 0x1FFF0), section(0x24000, 0x10000), section(0x40000, 0x10000)}, ErrSectionGap},
+		{"missing section", []nsz.NczSectionEntry{section(0x4000, 0x20000), section(0x24000, 0x10000)}, ErrSectionGap},
+		{"past the content size", []nsz.NczSectionEntry{section(0x4000, 0x20000), section(0x24000, 0x10000), section(0x40000, 0x10010)}, ErrSectionOutOfRange},
+		{"size wraps around", []nsz.NczSectionEntry{section(0x4000, 0x20000), section(0x24000, 0x10000), section(0x40000, ^uint64(0))}, ErrSectionOutOfRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := n.validateSections(tt.sections)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
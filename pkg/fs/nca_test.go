@@ -0,0 +1,202 @@
+package fs_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"slices"
+	"testing"
+
+	"github.com/falk/nsz-go/internal/testutil"
+	"github.com/falk/nsz-go/pkg/crypto"
+	"github.com/falk/nsz-go/pkg/fs"
+	"github.com/falk/nsz-go/pkg/keys"
+)
+
+// shortReader returns at most 7 bytes per ReadAt, without an error, as some
+// network readers do.
+type shortReader struct{ r io.ReaderAt }
+
+func (s shortReader) ReadAt(p []byte, off int64) (int, error) {
+	return s.r.ReadAt(p[:min(len(p), 7)], off)
+}
+
+func TestWrongKey(t *testing.T) {
+	nca := newTestNca(t, testSections())
+	opts := testOptions()
+
+	_, err := fs.CompressNca(bytes.NewReader(nca), io.Discard, int64(len(nca)), []byte("not-the-title-k!"), opts)
+	if !errors.Is(err, fs.ErrWrongKey) {
+		t.Errorf("wrong key: got %v, want ErrWrongKey", err)
+	}
+
+	// Short reads are not a wrong key
+	if _, err := fs.CompressNca(shortReader{bytes.NewReader(nca)}, io.Discard, int64(len(nca)), testutil.TitleKey, opts); err != nil {
+		t.Errorf("short reads: %v", err)
+	}
+
+	// Nor is an NCA cut short, which fails with the cause of the short read
+	parsed, err := fs.NewNCAWithHeaderKey(bytes.NewReader(nca), testutil.HeaderKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed.Reader = bytes.NewReader(nca[:fs.NcaFullHeaderSize+8])
+	_, err = fs.CompressParsedNca(parsed, io.Discard, int64(len(nca)), testutil.TitleKey, opts)
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("truncated: got %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func TestMixedCryptoSections(t *testing.T) {
+	// A CTR PFS0, a BKTR RomFS of three subsections, a plain section and an
+	// XTS one
+	bktrData := bytes.Repeat([]byte("bktr subsection\n"), 0x2be00/16)
+	sections := []testutil.SectionSpec{
+		{Size: 0x20000, FsType: fs.FsTypePfs0, Counter: 1},
+		{Size: 0x30000, FsType: fs.FsTypeRomFs, CryptoType: fs.CryptoTypeBKTR, Counter: 2, Data: bktrData, Subsections: 3},
+		{Size: 0x8000, FsType: fs.FsTypeRomFs, CryptoType: fs.CryptoTypeNone, Data: bytes.Repeat([]byte{0x3c}, 0x8000)},
+		{Size: 0x8000, FsType: fs.FsTypeRomFs, CryptoType: fs.CryptoTypeXTS, Data: bytes.Repeat([]byte{0xc3}, 0x8000)},
+	}
+	nca := newTestNca(t, sections)
+	parsed, err := fs.NewNCAWithHeaderKey(bytes.NewReader(nca), testutil.HeaderKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed.Header.TitleKey = testutil.TitleKey
+
+	got, err := parsed.GetEncryptionSections()
+	if err != nil {
+		t.Fatalf("GetEncryptionSections: %v", err)
+	}
+	counter := func(base uint64, ctr uint32) []byte {
+		iv := make([]byte, 16)
+		binary.BigEndian.PutUint64(iv, base)
+		if ctr != 0 {
+			binary.BigEndian.PutUint32(iv[4:], ctr)
+		}
+		return iv
+	}
+	want := []struct {
+		offset, size uint64
+		cryptoType   uint64
+		counter      []byte
+	}{
+		{0x4000, 0x20000, fs.CryptoTypeCTR, counter(1, 0)},
+		// The subsections, then the table under the section counter
+		{0x24000, 0xea00, fs.CryptoTypeCTR, counter(2, 1)},
+		{0x32a00, 0xea00, fs.CryptoTypeCTR, counter(2, 2)},
+		{0x41400, 0xea00, fs.CryptoTypeCTR, counter(2, 3)},
+		{0x4fe00, 0x4200, fs.CryptoTypeCTR, counter(2, 0)},
+		{0x54000, 0x8000, fs.CryptoTypeNone, counter(0, 0)},
+		{0x5c000, 0x8000, fs.CryptoTypeXTS, counter(0, 0)},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("got %d sections, want %d: %+v", len(got), len(want), got)
+	}
+	for i, w := range want {
+		g := got[i]
+		if g.Offset != w.offset || g.Size != w.size || g.CryptoType != w.cryptoType || !bytes.Equal(g.CryptoCounter[:], w.counter) {
+			t.Errorf("section %d = 0x%x+0x%x type %d counter %x, want 0x%x+0x%x type %d counter %x",
+				i, g.Offset, g.Size, g.CryptoType, g.CryptoCounter, w.offset, w.size, w.cryptoType, w.counter)
+		}
+		if w.cryptoType == fs.CryptoTypeCTR && !bytes.Equal(g.CryptoKey[:], testutil.TitleKey) {
+			t.Errorf("section %d has key %x, want the title key", i, g.CryptoKey)
+		}
+	}
+	if xts := got[len(got)-1]; xts.CryptoKey != [16]byte{} {
+		t.Errorf("XTS section has key %x, want none", xts.CryptoKey)
+	}
+
+	// Every subsection decrypts to the data under its own counter
+	if err := keys.Set("header_key", testutil.HeaderKey); err != nil {
+		t.Fatal(err)
+	}
+	var decrypted bytes.Buffer
+	if _, err := fs.DecryptNca(bytes.NewReader(nca), &decrypted, testutil.TitleKey); err != nil {
+		t.Fatalf("DecryptNca: %v", err)
+	}
+	if !bytes.Equal(decrypted.Bytes()[0x24000:0x4fe00], bktrData) {
+		t.Error("BKTR subsections decrypt wrong")
+	}
+
+	ncz, _ := compressTestNca(t, nca, testutil.TitleKey, testOptions())
+	if got := decompressTestNcz(t, ncz); !bytes.Equal(got, nca) {
+		t.Fatal("decompressed NCA differs from the original")
+	}
+}
+
+// libraryHeaders returns the encrypted headers of n distinct synthetic NCAs,
+// more than the header cache holds, as a library scan would read them.
+func TestRequiredKeysOfRightsIDNca(t *testing.T) {
+	if err := testutil.SetKeys(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The ticket's title key is encrypted with the master key of the rights
+	// ID generation, here 0x0b, not with that of the header (0)
+	rightsID := testutil.RightsID
+	t.Cleanup(func() { testutil.RightsID = rightsID })
+	testutil.RightsID[15] = 0x0b
+	nca := newTestNca(t, testSections())
+
+	names, err := fs.RequiredKeys(bytes.NewReader(nca))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(names, "master_key_0a") || slices.Contains(names, "master_key_00") {
+		t.Errorf("RequiredKeys = %q, want master_key_0a", names)
+	}
+}
+
+func libraryHeaders(b *testing.B, n int) [][]byte {
+	b.Helper()
+	headers := make([][]byte, n)
+	for i := range headers {
+		nca := newTestNca(b, []testutil.SectionSpec{{Size: fs.MediaSize, FsType: fs.FsTypeRomFs, Counter: uint64(i)}})
+		headers[i] = nca[:fs.NcaHeaderStructSize]
+	}
+	return headers
+}
+
+// BenchmarkListNcas parses the headers of 5,000 NCAs ("parse"). The other
+// two time only the XTS pass over the headers, with two AES key schedules
+// per 0x200-byte sector as before the ciphers were reused ("per sector"),
+// and with the cached cipher pair ("reused").
+func BenchmarkListNcas(b *testing.B) {
+	const count = 5000
+	headers := libraryHeaders(b, count)
+
+	b.Run("parse", func(b *testing.B) {
+		for b.Loop() {
+			for _, h := range headers {
+				if _, err := fs.NewNCAWithHeaderKey(bytes.NewReader(h), testutil.HeaderKey); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	decryptHeaders := func(b *testing.B, xts func() (*crypto.XTS, error)) {
+		decrypted := make([]byte, fs.MediaSize)
+		for b.Loop() {
+			for _, h := range headers {
+				for sector := 0; sector < fs.NcaHeaderStructSize/fs.MediaSize; sector++ {
+					x, err := xts()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if err := x.Decrypt(decrypted, h[sector*fs.MediaSize:(sector+1)*fs.MediaSize], uint64(sector)); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		}
+	}
+	b.Run("per sector", func(b *testing.B) {
+		decryptHeaders(b, func() (*crypto.XTS, error) { return crypto.NewXTS(testutil.HeaderKey) })
+	})
+	b.Run("reused", func(b *testing.B) {
+		decryptHeaders(b, func() (*crypto.XTS, error) { return crypto.CachedXTS(testutil.HeaderKey) })
+	})
+}
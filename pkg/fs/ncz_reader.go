@@ -0,0 +1,179 @@
+package fs
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/falk/nsz-go/pkg/nsz"
+)
+
+// nczCacheBlocks is the number of blocks an NCZ reader keeps, most recently
+// used first; 8 MB with the default block size.
+const nczCacheBlocks = 8
+
+// ErrSolidNcz is returned by OpenNcz for an NCZ without a block table, whose
+// single zstd stream can only be read from the start.
+var ErrSolidNcz = errors.New("solid ncz cannot be read at random")
+
+// nczReader reads the NCA an NCZ restores to, decompressing and re-encrypting
+// only the blocks a read touches.
+type nczReader struct {
+	r            io.ReaderAt
+	header       []byte // The NCA header, stored as is
+	bh           *nsz.NczBlockHeader
+	sizes        []uint32
+	blockOffsets []int64 // Offset of each block in the NCZ
+	hashes       []uint32
+	dict         []byte
+	size         int64
+
+	mu      sync.Mutex // Guards the ciphers and the cache
+	ciphers []sectionCipher
+	cache   *list.List            // Of *cachedBlock, most recently used first
+	blocks  map[int]*list.Element // By block index
+}
+
+type cachedBlock struct {
+	index int
+	data  []byte
+}
+
+// OpenNcz returns a ReaderAt over the NCA that the block-mode NCZ r restores
+// to, and the size of that NCA. Reads decompress and re-encrypt only the
+// blocks they touch, keeping the last few in memory, so an NCZ can be passed
+// to anything that takes an NCA (NewNCA, DecryptNca, ...) without expanding
+// it. No title key is needed, as the NCZ section table has the keys.
+//
+// It returns ErrSolidNcz for a solid NCZ. The ReaderAt is safe for
+// concurrent use, but reads are served one at a time.
+func OpenNcz(r io.ReaderAt) (io.ReaderAt, int64, error) {
+	return OpenNczWithDict(r, nil)
+}
+
+// OpenNczWithDict is OpenNcz for an NCZ compressed against the raw zstd
+// dictionary dict (see CompressOptions.Dict).
+func OpenNczWithDict(r io.ReaderAt, dict []byte) (io.ReaderAt, int64, error) {
+	header := make([]byte, NcaFullHeaderSize)
+	if n, err := r.ReadAt(header, 0); n < len(header) {
+		return nil, 0, fmt.Errorf("read header: %w", err)
+	}
+
+	sr := io.NewSectionReader(r, NcaFullHeaderSize, 1<<62)
+	sections, err := nsz.ReadNczHeader(sr)
+	if err != nil {
+		return nil, 0, err
+	}
+	ciphers, err := newSectionCiphers(sections)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	pos, _ := sr.Seek(0, io.SeekCurrent)
+	magic := make([]byte, len(nsz.MagicNCZBLOCK))
+	if n, err := sr.ReadAt(magic, pos); n < len(magic) {
+		return nil, 0, fmt.Errorf("read block header: %w", err)
+	}
+	if string(magic) != nsz.MagicNCZBLOCK {
+		return nil, 0, ErrSolidNcz
+	}
+	bh, sizes, hashes, err := readBlockTable(sr)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Blocks follow the size table back to back
+	offset := nsz.DataOffset(len(sections), bh)
+	blockOffsets := make([]int64, len(sizes))
+	for i, size := range sizes {
+		blockOffsets[i] = offset
+		offset += int64(size)
+	}
+
+	nr := &nczReader{
+		r:            r,
+		header:       header,
+		bh:           bh,
+		sizes:        sizes,
+		blockOffsets: blockOffsets,
+		hashes:       hashes,
+		dict:         dict,
+		size:         NcaFullHeaderSize + int64(bh.DecompressedSize),
+		ciphers:      ciphers,
+		cache:        list.New(),
+		blocks:       make(map[int]*list.Element),
+	}
+	return nr, nr.size, nil
+}
+
+// ReadAt reads the restored NCA at off.
+func (nr *nczReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, errors.New("negative offset")
+	}
+	if off >= nr.size {
+		return 0, io.EOF
+	}
+
+	nr.mu.Lock()
+	defer nr.mu.Unlock()
+
+	n := 0
+	for n < len(p) && off < nr.size {
+		var src []byte
+		if off < NcaFullHeaderSize {
+			src = nr.header[off:]
+		} else {
+			index := int((off - NcaFullHeaderSize) / int64(nr.bh.BlockSize()))
+			data, err := nr.block(index)
+			if err != nil {
+				return n, err
+			}
+			src = data[(off-NcaFullHeaderSize)%int64(nr.bh.BlockSize()):]
+		}
+		copied := copy(p[n:], src)
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// block returns block index as in the NCA, from the cache or from the NCZ.
+func (nr *nczReader) block(index int) ([]byte, error) {
+	if e, ok := nr.blocks[index]; ok {
+		nr.cache.MoveToFront(e)
+		return e.Value.(*cachedBlock).data, nil
+	}
+
+	compressed := make([]byte, nr.sizes[index])
+	if n, err := nr.r.ReadAt(compressed, nr.blockOffsets[index]); n < len(compressed) {
+		return nil, fmt.Errorf("read block %d: %w", index, err)
+	}
+	if nr.hashes != nil && nsz.BlockHash(compressed) != nr.hashes[index] {
+		return nil, fmt.Errorf("%w: block %d", ErrBlockHashMismatch, index)
+	}
+	data := compressed
+	if nr.bh.Type != nsz.BlockTypeStored && !nr.bh.IsStored(index, nr.sizes[index]) {
+		var err error
+		if data, err = decompressBlock(nr.bh.Type, compressed, nr.dict); err != nil {
+			return nil, fmt.Errorf("decompress block %d: %w", index, err)
+		}
+	}
+	if expected := nr.bh.BlockDecompressedSize(index); uint64(len(data)) != expected {
+		return nil, fmt.Errorf("block %d: got %d bytes, expected %d", index, len(data), expected)
+	}
+	// CTR is symmetric, so decrypting the plaintext re-encrypts it
+	decryptChunk(data, NcaFullHeaderSize+int64(index)*int64(nr.bh.BlockSize()), nr.ciphers)
+
+	nr.blocks[index] = nr.cache.PushFront(&cachedBlock{index, data})
+	if nr.cache.Len() > nczCacheBlocks {
+		oldest := nr.cache.Remove(nr.cache.Back()).(*cachedBlock)
+		delete(nr.blocks, oldest.index)
+	}
+	return data, nil
+}
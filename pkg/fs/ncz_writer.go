@@ -0,0 +1,220 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/falk/nsz-go/pkg/nsz"
+)
+
+// NczWriter compresses an NCA that is written to it in order, a piece at a
+// time, for callers that do not have the whole NCA at hand, such as while it
+// is downloaded. Write takes the NCA from its first byte; the header is
+// copied through and the body is cut into blocks, each decrypted and
+// compressed as soon as it is complete. Close writes the size table.
+//
+// Unlike CompressNca it compresses one block at a time on the calling
+// goroutine, cannot check the key or sample the body before writing, and
+// writes the NCZ even if it ends up no smaller than the NCA. Checkpoint and
+// Resume are not supported.
+type NczWriter struct {
+	ws      io.WriteSeeker
+	opts    CompressOptions
+	bh      nsz.NczBlockHeader
+	ciphers []sectionCipher
+
+	sections       []nsz.NczSectionEntry
+	totalSize      int64  // NCA bytes that go into the NCZ
+	pos            int64  // NCA bytes written so far
+	buf            []byte // The header, then the current block
+	startPos       int64
+	sizeListOffset int64
+
+	sizes     []uint32
+	hashes    []uint32
+	leftovers leftoverAttempts // One abandoned block attempt at a time
+	result    CompressResult
+	err       error // First error, returned by every later call
+	closed    bool
+	dropped   int64 // Bytes past totalSize
+}
+
+// NewNczWriter returns an NczWriter that writes the NCZ of nca to ws from
+// its current position. nca is only used for its header (and for the BKTR
+// tables of update NCAs, which nca.Reader must be able to read); the NCA
+// itself is what is passed to Write. titleKey is as for CompressNca.
+func NewNczWriter(ws io.WriteSeeker, nca *NCA, titleKey []byte, opts CompressOptions) (*NczWriter, error) {
+	if nca == nil {
+		return nil, errors.New("nil NCA")
+	}
+	if bt := opts.blockType(); bt != nsz.BlockTypeZstd {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedBlockType, bt)
+	}
+	if opts.Checkpoint != nil || opts.Resume != nil {
+		return nil, errors.New("ncz writer cannot checkpoint or resume")
+	}
+	if titleKey != nil {
+		nca.Header.TitleKey = titleKey
+	}
+
+	totalSize := int64(nca.Header.ContentSize)
+	if totalSize <= NcaFullHeaderSize {
+		return nil, fmt.Errorf("%w: header says %d bytes", ErrNcaTooSmall, totalSize)
+	}
+
+	sections := rawSections(totalSize)
+	if !opts.NoDecrypt {
+		var err error
+		if sections, err = nca.GetEncryptionSections(); err != nil {
+			return nil, err
+		}
+		if len(sections) == 0 {
+			return nil, ErrNoSections
+		}
+		if opts.AllowEncrypted {
+			sections = passKeylessSections(sections)
+		} else if err := checkSectionKeys(sections); err != nil {
+			return nil, err
+		}
+	}
+	ciphers, err := newSectionCiphers(sections)
+	if err != nil {
+		return nil, err
+	}
+
+	bh, err := newBlockHeader(totalSize, opts)
+	if err != nil {
+		return nil, err
+	}
+	startPos, err := ws.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &NczWriter{
+		ws:        ws,
+		opts:      opts,
+		bh:        bh,
+		ciphers:   ciphers,
+		sections:  sections,
+		totalSize: totalSize,
+		buf:       make([]byte, 0, max(NcaFullHeaderSize, int64(bh.BlockSize()))),
+		startPos:  startPos,
+		sizes:     make([]uint32, 0, bh.BlockCount),
+		leftovers: newLeftoverAttempts(1),
+		result:    CompressResult{InputSize: totalSize, Blocks: bh.BlockCount, NCA: nca},
+	}
+	if opts.BlockHashes {
+		w.hashes = make([]uint32, 0, bh.BlockCount)
+	}
+	return w, nil
+}
+
+// Write takes the next bytes of the NCA. Bytes past the header's content
+// size are padding and are dropped.
+func (w *NczWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, errors.New("write to closed ncz writer")
+	}
+
+	n := len(p)
+	if rest := w.totalSize - w.pos; int64(len(p)) > rest {
+		w.dropped += int64(len(p)) - rest
+		p = p[:rest]
+	}
+	for len(p) > 0 {
+		// The header until it is complete, then one block at a time
+		want := int64(NcaFullHeaderSize)
+		if w.pos >= NcaFullHeaderSize {
+			index := (w.pos - NcaFullHeaderSize) / int64(w.bh.BlockSize())
+			want = int64(w.bh.BlockDecompressedSize(int(index)))
+		}
+		take := min(int64(len(p)), want-int64(len(w.buf)))
+		w.buf = append(w.buf, p[:take]...)
+		w.pos += take
+		p = p[take:]
+
+		if int64(len(w.buf)) == want {
+			if w.err = w.flush(); w.err != nil {
+				return n - len(p), w.err
+			}
+		}
+	}
+	return n, nil
+}
+
+// flush writes the complete header or block in buf.
+func (w *NczWriter) flush() error {
+	if w.pos == NcaFullHeaderSize {
+		offset, err := writeNczStart(w.ws, w.buf, w.sections, &w.bh)
+		if err != nil {
+			return err
+		}
+		w.sizeListOffset = offset
+		w.buf = w.buf[:0]
+		return nil
+	}
+
+	index := len(w.sizes)
+	offset := w.pos - int64(len(w.buf))
+	data, stored, slow := encodeBlock(w.buf, offset, w.ciphers, w.opts, w.leftovers)
+	if stored {
+		w.result.StoredBlocks++
+	}
+	if slow {
+		// The abandoned attempt still reads buf
+		w.result.SlowBlocks++
+		w.buf = make([]byte, 0, cap(w.buf))
+	} else {
+		w.buf = w.buf[:0]
+	}
+
+	if _, err := w.ws.Write(data); err != nil {
+		return fmt.Errorf("write block %d: %w", index, err)
+	}
+	w.sizes = append(w.sizes, uint32(len(data)))
+	if w.hashes != nil {
+		w.hashes = append(w.hashes, nsz.BlockHash(data))
+	}
+	return nil
+}
+
+// Close writes the size table, and the block hashes with
+// CompressOptions.BlockHashes, once the whole NCA has been written. It
+// returns ErrNcaTruncated if the NCA ended early. It does not close the
+// underlying writer.
+func (w *NczWriter) Close() error {
+	if w.closed || w.err != nil {
+		return w.err
+	}
+	w.closed = true
+	w.leftovers.wait()
+	if w.pos < w.totalSize {
+		w.err = fmt.Errorf("%w: header says 0x%x bytes, got 0x%x", ErrNcaTruncated, w.totalSize, w.pos)
+		return w.err
+	}
+
+	endPos, err := writeNczEnd(w.ws, w.sizeListOffset, w.sizes, w.hashes)
+	if err != nil {
+		w.err = err
+		return err
+	}
+	w.result.OutputSize = endPos - w.startPos
+	if w.dropped > 0 {
+		w.result.Warnings = append(w.result.Warnings, fmt.Sprintf("nca is 0x%x bytes but its header says 0x%x; dropped 0x%x trailing bytes", w.totalSize+w.dropped, w.totalSize, w.dropped))
+	}
+	return nil
+}
+
+// Result returns what was written, once Close has succeeded.
+func (w *NczWriter) Result() *CompressResult {
+	if !w.closed || w.err != nil {
+		return nil
+	}
+	res := w.result
+	return &res
+}
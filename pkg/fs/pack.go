@@ -0,0 +1,155 @@
+package fs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/falk/nsz-go/pkg/keys"
+)
+
+// PackOptions controls PackDir.
+type PackOptions struct {
+	Compress        bool // Compress NCAs to NCZ on the way in
+	CompressOptions CompressOptions
+}
+
+// PackDir builds a PFS0 at outPath from the regular files in dir, in name
+// order. With opts.Compress, NCAs that pass the CompressOptions checks are
+// compressed to .ncz, using title keys from any tickets in dir.
+func PackDir(dir, outPath string, opts PackOptions) error {
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for _, e := range dirEntries {
+		if e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+
+	// 1. Decide which NCAs to compress, and with which title key
+	outputNames := make([]string, len(names))
+	titleKeys := make([][]byte, len(names))
+	copy(outputNames, names)
+	if opts.Compress {
+		tickets, err := readDirTickets(dir, names)
+		if err != nil {
+			return err
+		}
+		for i, name := range names {
+			if ext := filepath.Ext(name); strings.ToLower(ext) == ".nca" {
+				compress, key, err := packNcaPlan(filepath.Join(dir, name), tickets, opts.CompressOptions)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				if compress {
+					outputNames[i] = strings.TrimSuffix(name, ext) + ".ncz"
+					titleKeys[i] = key
+				}
+			}
+		}
+	}
+
+	// 2. Write the members
+	writer, err := NewPfs0Writer(outPath, outputNames)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	for i, name := range names {
+		if err := packFile(writer, i, filepath.Join(dir, name), outputNames[i] != name, titleKeys[i], opts.CompressOptions); err != nil {
+			return fmt.Errorf("%s: %w", name, err)
+		}
+	}
+	return writer.Close()
+}
+
+// packFile adds the file at path as the i-th member, compressing it if asked.
+func packFile(w *Pfs0Writer, index int, path string, compress bool, titleKey []byte, opts CompressOptions) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if compress {
+		_, err = w.AddCompressedFile(index, f, info.Size(), titleKey, opts)
+		return err
+	}
+	return w.AddFile(index, f, info.Size())
+}
+
+// packNcaPlan reports whether the NCA at path should be compressed and
+// returns its title key, if it has a rights ID and a matching ticket.
+func packNcaPlan(path string, tickets map[[16]byte]*Ticket, opts CompressOptions) (bool, []byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, nil, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return false, nil, err
+	}
+	nca, err := NewNCAWithHeaderKey(f, opts.HeaderKey)
+	if err != nil {
+		// Not an NCA we can read; store it as is
+		return false, nil, nil
+	}
+	if !opts.ShouldCompressType(nca.Header.ContentType) || !opts.ShouldCompressSize(info.Size()) {
+		return false, nil, nil
+	}
+
+	if !nca.Header.HasRightsID() {
+		return true, nil, nil
+	}
+	tik, ok := tickets[nca.Header.RightsID]
+	if !ok {
+		// Without a title key the body cannot be decrypted; store it as is
+		return false, nil, nil
+	}
+	key, err := keys.DecryptTitleKey(tik.EncryptedTitleKey(), nca.Header.TitleKeyMasterKeyIndex())
+	if err != nil {
+		return false, nil, err
+	}
+	return true, key, nil
+}
+
+// readDirTickets parses the common tickets among names, keyed by rights ID.
+func readDirTickets(dir string, names []string) (map[[16]byte]*Ticket, error) {
+	tickets := make(map[[16]byte]*Ticket)
+	for _, name := range names {
+		if strings.ToLower(filepath.Ext(name)) != ".tik" {
+			continue
+		}
+		tik, err := readTicketFile(filepath.Join(dir, name))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if tik.TitleKeyType == TitleKeyTypeCommon {
+			tickets[tik.RightsID] = tik
+		}
+	}
+	return tickets, nil
+}
+
+// readTicketFile parses the ticket at path.
+func readTicketFile(path string) (*Ticket, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseTicket(f)
+}
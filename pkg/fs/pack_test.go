@@ -0,0 +1,53 @@
+package fs_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/falk/nsz-go/internal/testutil"
+	"github.com/falk/nsz-go/pkg/fs"
+	"github.com/falk/nsz-go/pkg/keys"
+)
+
+// useWrongHeaderKey loads a header_key that decrypts no test NCA, so that
+// only CompressOptions.HeaderKey can, until the test ends.
+func useWrongHeaderKey(t *testing.T) {
+	t.Helper()
+	if err := testutil.SetKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Set("header_key", []byte("not the header key, not the one!")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { keys.Set("header_key", testutil.HeaderKey) })
+}
+
+func TestPackDirUsesHeaderKey(t *testing.T) {
+	useWrongHeaderKey(t)
+	nca, err := testutil.NewStandardCryptoNCA(testSections())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "0123456789abcdef0123456789abcdef.nca"), nca, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	out := filepath.Join(t.TempDir(), "packed.nsz")
+	if err := fs.PackDir(dir, out, fs.PackOptions{Compress: true, CompressOptions: testOptions()}); err != nil {
+		t.Fatalf("PackDir: %v", err)
+	}
+	f, err := os.Open(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	files, _, err := fs.OpenPfs0(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "0123456789abcdef0123456789abcdef.ncz" {
+		t.Errorf("packed %+v, want the NCA compressed", files)
+	}
+}
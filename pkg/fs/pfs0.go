@@ -5,8 +5,12 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
+const MagicPFS0 = "PFS0"
+
 // PFS0Header represents the header of a PFS0 partition.
 type PFS0Header struct {
 	Magic           [4]byte
@@ -28,8 +32,11 @@ type Pfs0File struct {
 	Entry PFS0FileEntry
 }
 
-// OpenPfs0 reads a PFS0 file and returns the file entries.
-func OpenPfs0(f *os.File) ([]Pfs0File, int64, error) {
+// OpenPfs0 reads a PFS0 header and returns the file entries and the header
+// size; file data offsets are relative to the end of the header.
+func OpenPfs0(r io.ReaderAt) ([]Pfs0File, int64, error) {
+	f := io.NewSectionReader(r, 0, 1<<62)
+
 	var header PFS0Header
 	if err := binary.Read(f, binary.LittleEndian, &header); err != nil {
 		return nil, 0, err
@@ -66,6 +73,50 @@ func OpenPfs0(f *os.File) ([]Pfs0File, int64, error) {
 	return files, headerSize, nil
 }
 
+// IsNestedPfs0 reports whether the given member of the PFS0 r, whose header
+// is headerSize bytes, is itself a PFS0.
+func IsNestedPfs0(r io.ReaderAt, file Pfs0File, headerSize int64) bool {
+	if file.Entry.DataSize < 16 {
+		return false
+	}
+	magic := make([]byte, len(MagicPFS0))
+	_, err := r.ReadAt(magic, headerSize+int64(file.Entry.DataOffset))
+	return err == nil && string(magic) == MagicPFS0
+}
+
+// OpenNested opens the PFS0 stored as the given member of the PFS0 r, whose
+// header is headerSize bytes. It returns a reader over the member together
+// with what OpenPfs0 returns for it; the entries are relative to that reader.
+func OpenNested(r io.ReaderAt, file Pfs0File, headerSize int64) (*io.SectionReader, []Pfs0File, int64, error) {
+	sr := io.NewSectionReader(r, headerSize+int64(file.Entry.DataOffset), int64(file.Entry.DataSize))
+	files, nestedHeaderSize, err := OpenPfs0(sr)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("%s: %w", file.Name, err)
+	}
+	return sr, files, nestedHeaderSize, nil
+}
+
+// NczMembers returns the names of the members of the PFS0 r that are already
+// NCZ: those with an .ncz extension in any case, and those whose contents are
+// an NCZ whatever their name. A PFS0 with any is an NSZ, not an NSP.
+func NczMembers(r io.ReaderAt, files []Pfs0File, headerSize int64) []string {
+	var names []string
+	for _, file := range files {
+		ext := filepath.Ext(file.Name)
+		if strings.EqualFold(ext, ".ncz") {
+			names = append(names, file.Name)
+			continue
+		}
+		if strings.EqualFold(ext, ".nca") && file.Entry.DataSize > NcaFullHeaderSize {
+			sr := io.NewSectionReader(r, headerSize+int64(file.Entry.DataOffset), int64(file.Entry.DataSize))
+			if IsNcz(sr) {
+				names = append(names, file.Name)
+			}
+		}
+	}
+	return names
+}
+
 // ReadPfs0 reads a PFS0 file and prints its content.
 func ReadPfs0(path string) error {
 	f, err := os.Open(path)
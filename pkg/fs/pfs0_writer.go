@@ -2,24 +2,50 @@ package fs
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 	"os"
+	"path/filepath"
+	"strings"
 )
 
 type Pfs0Writer struct {
-	f           *os.File
+	f           io.WriteSeeker
+	closer      io.Closer // Set when the writer owns f
+	sync        bool
+	closed      bool
+	names       []string
 	stringTable []byte
 	entries     []PFS0FileEntry
 	headerSize  int64
-	dataOffset  int64 // Current write position relative to data start
+	dataOffset  int64  // Current write position relative to data start
+	trailer     []byte // Written after the last file
 }
 
+// NewPfs0Writer creates the file at path and returns a writer for it.
 func NewPfs0Writer(path string, fileNames []string) (*Pfs0Writer, error) {
 	f, err := os.Create(path)
 	if err != nil {
 		return nil, err
 	}
 
+	w, err := NewPfs0WriterTo(f, fileNames)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.closer = f
+	return w, nil
+}
+
+// NewPfs0WriterTo returns a writer that writes the PFS0 at offset 0 of f.
+// Close finalizes the header but does not close f.
+//
+// If f has a Truncate(int64) error method (as *os.File does), Close uses it to
+// drop bytes left past the end by a discarded compression attempt; otherwise
+// the caller should only use the first Size bytes.
+func NewPfs0WriterTo(f io.WriteSeeker, fileNames []string) (*Pfs0Writer, error) {
 	// Calculate String Table
 	stringTable := make([]byte, 0)
 	nameOffsets := make([]uint32, len(fileNames))
@@ -43,12 +69,12 @@ func NewPfs0Writer(path string, fileNames []string) (*Pfs0Writer, error) {
 	// Write Placeholder
 	// We seek past the header
 	if _, err := f.Seek(headerSize, 0); err != nil {
-		f.Close()
 		return nil, err
 	}
 
 	return &Pfs0Writer{
 		f:           f,
+		names:       append([]string(nil), fileNames...),
 		stringTable: stringTable,
 		entries:     entries,
 		headerSize:  headerSize,
@@ -56,37 +82,254 @@ func NewPfs0Writer(path string, fileNames []string) (*Pfs0Writer, error) {
 	}, nil
 }
 
-// AddFile writes data for the i-th file.
+// Pfs0WriterState records the members a Pfs0Writer has finished, so that an
+// interrupted PFS0 can be continued with ResumePfs0Writer.
+type Pfs0WriterState struct {
+	Names           []string        // Current names of all members
+	StringTableSize int             // Space reserved for the names
+	Entries         []PFS0FileEntry // The finished members, in order
+}
+
+// ResumePfs0Writer reopens the partly written PFS0 at path and positions it
+// after the members recorded in st. Anything written past them is overwritten.
+func ResumePfs0Writer(path string, st Pfs0WriterState) (*Pfs0Writer, error) {
+	if len(st.Entries) > len(st.Names) {
+		return nil, fmt.Errorf("resume: %d members done of %d", len(st.Entries), len(st.Names))
+	}
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := NewPfs0WriterTo(f, st.Names)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	w.closer = f
+
+	// Restore the reserved string table size, which renames may have shrunk
+	if pad := st.StringTableSize - len(w.stringTable); pad > 0 {
+		w.stringTable = append(w.stringTable, make([]byte, pad)...)
+		w.headerSize += int64(pad)
+	}
+	for i, e := range st.Entries {
+		w.entries[i].DataOffset = e.DataOffset
+		w.entries[i].DataSize = e.DataSize
+		w.dataOffset = int64(e.DataOffset + e.DataSize)
+	}
+
+	end, err := f.Seek(0, io.SeekEnd)
+	if err == nil && end < w.Size() {
+		err = fmt.Errorf("resume: %s is 0x%x bytes, expected at least 0x%x", path, end, w.Size())
+	}
+	if err == nil {
+		_, err = f.Seek(w.Size(), io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// State returns the progress of the writer after its first done members.
+func (w *Pfs0Writer) State(done int) Pfs0WriterState {
+	return Pfs0WriterState{
+		Names:           append([]string(nil), w.names...),
+		StringTableSize: len(w.stringTable),
+		Entries:         append([]PFS0FileEntry(nil), w.entries[:done]...),
+	}
+}
+
+// Sync flushes what has been written so far to stable storage, if the output
+// supports it.
+func (w *Pfs0Writer) Sync() error {
+	return w.syncOutput()
+}
+
+// AddFile copies exactly size bytes from r as the i-th file.
 // It assumes files are added in order.
 func (w *Pfs0Writer) AddFile(index int, r io.Reader, size int64) error {
 	w.entries[index].DataOffset = uint64(w.dataOffset)
 	w.entries[index].DataSize = uint64(size)
 
-	n, err := io.Copy(w.f, r)
+	n, err := io.CopyN(w.f, r, size)
+	w.dataOffset += n
 	if err != nil {
-		return err
+		return fmt.Errorf("copy %s: %d of %d bytes: %w", w.names[index], n, size, err)
 	}
-	w.dataOffset += n
 	return nil
 }
 
 // AddCompressedFile compresses and writes the i-th file.
-func (w *Pfs0Writer) AddCompressedFile(index int, r io.ReaderAt, size int64, titleKey []byte, compressionLevel int) error {
+// If the NCA does not compress, the original bytes are stored instead and the
+// member is renamed from .ncz back to .nca.
+func (w *Pfs0Writer) AddCompressedFile(index int, r io.ReaderAt, size int64, titleKey []byte, opts CompressOptions) (*CompressResult, error) {
+	if size <= NcaFullHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes", ErrNcaTooSmall, size)
+	}
+	if opts.NoDecrypt {
+		// The header is not read, so the NCA need not be parseable
+		w.entries[index].DataOffset = uint64(w.dataOffset)
+		res, err := CompressNca(r, w.f, size, titleKey, opts)
+		return w.finishCompressed(index, r, size, res, err)
+	}
+	nca, err := NewNCAWithHeaderKey(r, opts.HeaderKey)
+	if err != nil {
+		return nil, err
+	}
+	return w.AddCompressedNca(index, nca, size, titleKey, opts)
+}
+
+// AddCompressedNca is AddCompressedFile for an NCA the caller has already
+// opened (see CompressParsedNca).
+func (w *Pfs0Writer) AddCompressedNca(index int, nca *NCA, size int64, titleKey []byte, opts CompressOptions) (*CompressResult, error) {
+	w.entries[index].DataOffset = uint64(w.dataOffset)
+
+	// CompressParsedNca writes to w.f
+	res, err := CompressParsedNca(nca, w.f, size, titleKey, opts)
+	res, err = w.finishCompressed(index, nca.Reader, size, res, err)
+	if res != nil {
+		res.NCA = nca
+	}
+	return res, err
+}
+
+// finishCompressed records the i-th file once compressed to res, or stores
+// the original r instead if it did not compress.
+func (w *Pfs0Writer) finishCompressed(index int, r io.ReaderAt, size int64, res *CompressResult, err error) (*CompressResult, error) {
+	if errors.Is(err, ErrNotCompressible) {
+		return w.storeOriginal(index, r, size)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w.entries[index].DataSize = uint64(res.OutputSize) // Compressed Size
+	w.dataOffset += res.OutputSize
+	return res, nil
+}
+
+// storeOriginal writes the original encrypted NCA as the i-th file, named .nca.
+func (w *Pfs0Writer) storeOriginal(index int, r io.ReaderAt, size int64) (*CompressResult, error) {
+	if ext := filepath.Ext(w.names[index]); strings.ToLower(ext) == ".ncz" {
+		if err := w.SetName(index, strings.TrimSuffix(w.names[index], ext)+".nca"); err != nil {
+			return nil, err
+		}
+	}
+	if err := w.AddFile(index, io.NewSectionReader(r, 0, size), size); err != nil {
+		return nil, err
+	}
+	return &CompressResult{InputSize: size, OutputSize: size, Stored: true}, nil
+}
+
+// SetName renames the i-th file. The new string table must fit in the space
+// reserved when the writer was created.
+func (w *Pfs0Writer) SetName(index int, name string) error {
+	names := append([]string(nil), w.names...)
+	names[index] = name
+
+	var table []byte
+	offsets := make([]uint32, len(names))
+	for i, n := range names {
+		offsets[i] = uint32(len(table))
+		table = append(table, []byte(n)...)
+		table = append(table, 0)
+	}
+	if len(table) > len(w.stringTable) {
+		return fmt.Errorf("renaming %q to %q does not fit in the string table", w.names[index], name)
+	}
+
+	// Pad to the reserved size so the header size does not change
+	table = append(table, make([]byte, len(w.stringTable)-len(table))...)
+	w.names = names
+	w.stringTable = table
+	for i := range w.entries {
+		w.entries[i].NameOffset = offsets[i]
+	}
+	return nil
+}
+
+// Name returns the current name of the i-th file.
+func (w *Pfs0Writer) Name(index int) string {
+	return w.names[index]
+}
+
+// AddDecompressedFile decompresses the NCZ r and writes the restored NCA as the i-th file.
+func (w *Pfs0Writer) AddDecompressedFile(index int, r io.ReaderAt) error {
+	return w.AddDecompressedFileWithDict(index, r, nil)
+}
+
+// AddDecompressedFileWithDict is AddDecompressedFile for an NCZ compressed
+// against the raw zstd dictionary dict.
+func (w *Pfs0Writer) AddDecompressedFileWithDict(index int, r io.ReaderAt, dict []byte) error {
 	w.entries[index].DataOffset = uint64(w.dataOffset)
 
-	// CompressNca writes to w.f
-	n, err := CompressNca(r, w.f, size, titleKey, compressionLevel)
+	n, err := DecompressNcaWithDict(r, w.f, dict)
 	if err != nil {
 		return err
 	}
 
-	w.entries[index].DataSize = uint64(n) // Compressed Size
+	w.entries[index].DataSize = uint64(n)
 	w.dataOffset += n
 	return nil
 }
 
-// WriteHeader finalizes the PFS0 file.
+// Size returns the size of the PFS0 written so far, header included.
+func (w *Pfs0Writer) Size() int64 {
+	return w.headerSize + w.dataOffset
+}
+
+// SetTrailer sets data to write after the last file when closing, such as
+// an nsz.DictTrailer. Size does not include it.
+func (w *Pfs0Writer) SetTrailer(trailer []byte) {
+	w.trailer = trailer
+}
+
+// SetSync makes Close flush the output to stable storage (via a Sync() error
+// method, as on *os.File) after writing the header.
+func (w *Pfs0Writer) SetSync(sync bool) {
+	w.sync = sync
+}
+
+// Close writes the header and, if the writer opened the file, closes it.
+// The file is closed even if finalizing fails; the first error is returned.
+// Calling Close again, or after Abort, does nothing.
 func (w *Pfs0Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	err := w.finalize()
+	if err == nil && w.sync {
+		err = w.syncOutput()
+	}
+	if w.closer != nil {
+		if cerr := w.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// Abort closes the file if the writer opened it, without writing the header
+// or truncating, so that the data written so far can be resumed with
+// ResumePfs0Writer. Close and Abort do nothing after either has been called.
+func (w *Pfs0Writer) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	if w.closer != nil {
+		return w.closer.Close()
+	}
+	return nil
+}
+
+// finalize writes the header and truncates the output.
+func (w *Pfs0Writer) finalize() error {
 	// Seek to 0
 	if _, err := w.f.Seek(0, 0); err != nil {
 		return err
@@ -110,5 +353,29 @@ func (w *Pfs0Writer) Close() error {
 		return err
 	}
 
-	return w.f.Close()
+	if len(w.trailer) > 0 {
+		if _, err := w.f.Seek(w.Size(), io.SeekStart); err != nil {
+			return err
+		}
+		if _, err := w.f.Write(w.trailer); err != nil {
+			return err
+		}
+	}
+
+	// Drop anything left past the end by a discarded compression attempt
+	if t, ok := w.f.(interface{ Truncate(int64) error }); ok {
+		if err := t.Truncate(w.Size() + int64(len(w.trailer))); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// syncOutput flushes the output if it supports Sync.
+func (w *Pfs0Writer) syncOutput() error {
+	if s, ok := w.f.(interface{ Sync() error }); ok {
+		return s.Sync()
+	}
+	return nil
 }
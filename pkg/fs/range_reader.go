@@ -0,0 +1,113 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// RangeReaderAt is an io.ReaderAt over an HTTP resource, issuing one Range
+// request per ReadAt call. It is safe for concurrent use.
+//
+// CompressNca reads the NCA header and any BKTR tables with a few small
+// reads, then reads the body in whole blocks (1 << BlockSizeExp bytes) in
+// roughly ascending order, with up to Workers requests in flight. Larger
+// blocks and more workers hide more latency.
+type RangeReaderAt struct {
+	url    string
+	size   int64
+	client *http.Client
+}
+
+// rangeRequestTimeout bounds each request of a RangeReaderAt, the body
+// included: ample for a block of the largest default size on a slow link,
+// while a stalled server fails the read rather than hanging it.
+const rangeRequestTimeout = 5 * time.Minute
+
+// NewRangeReaderAt probes url with a GET for its first byte and returns a
+// reader for it. The server must answer with 206 Partial Content and the
+// size in Content-Range; Accept-Ranges is not needed. GET rather than HEAD
+// works with presigned object storage URLs, which are signed for one method.
+func NewRangeReaderAt(url string) (*RangeReaderAt, error) {
+	client := &http.Client{Timeout: rangeRequestTimeout}
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1))
+	resp.Body.Close()
+
+	var size int64
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		var first, last int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &first, &last, &size); err != nil || size < 0 {
+			return nil, fmt.Errorf("GET %s: Content-Range %q has no size", url, resp.Header.Get("Content-Range"))
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// An empty resource has no first byte: "bytes */0"
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes */%d", &size); err != nil || size != 0 {
+			return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+		}
+	case http.StatusOK:
+		return nil, fmt.Errorf("GET %s: server does not serve byte ranges", url)
+	default:
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+
+	return &RangeReaderAt{url: url, size: size, client: client}, nil
+}
+
+// Size returns the size of the resource.
+func (r *RangeReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt reads len(p) bytes starting at off.
+func (r *RangeReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+
+	want := int64(len(p))
+	if off+want > r.size {
+		want = r.size - off
+	}
+	if want == 0 {
+		return 0, nil
+	}
+
+	req, err := http.NewRequest(http.MethodGet, r.url, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", off, off+want-1))
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, fmt.Errorf("GET %s range %d+%d: %s", r.url, off, want, resp.Status)
+	}
+
+	n, err := io.ReadFull(resp.Body, p[:want])
+	if err != nil {
+		return n, err
+	}
+	if want < int64(len(p)) {
+		return n, io.EOF
+	}
+	return n, nil
+}
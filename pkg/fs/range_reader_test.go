@@ -0,0 +1,85 @@
+package fs_test
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/falk/nsz-go/pkg/fs"
+)
+
+// presignedHandler serves data the way a presigned object storage GET URL
+// does: HEAD is refused, and ranges are served without Accept-Ranges.
+func presignedHandler(data []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "signature does not match", http.StatusForbidden)
+			return
+		}
+		var first, last int64
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last); err != nil {
+			w.Write(data)
+			return
+		}
+		if first >= int64(len(data)) {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", len(data)))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		last = min(last, int64(len(data))-1)
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", first, last, len(data)))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(data[first : last+1])
+	}
+}
+
+func TestRangeReaderAt(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789abcdef"), 0x100)
+	srv := httptest.NewServer(presignedHandler(data))
+	defer srv.Close()
+
+	rr, err := fs.NewRangeReaderAt(srv.URL)
+	if err != nil {
+		t.Fatalf("NewRangeReaderAt: %v", err)
+	}
+	if rr.Size() != int64(len(data)) {
+		t.Fatalf("Size = %d, want %d", rr.Size(), len(data))
+	}
+	got := make([]byte, 0x20)
+	if n, err := rr.ReadAt(got, 0x105); n != len(got) || err != nil {
+		t.Fatalf("ReadAt = %d, %v", n, err)
+	}
+	if !bytes.Equal(got, data[0x105:0x125]) {
+		t.Errorf("ReadAt read %q", got)
+	}
+	if n, err := rr.ReadAt(got, int64(len(data))-0x10); n != 0x10 || err != io.EOF {
+		t.Errorf("ReadAt at the end = %d, %v, want 16, EOF", n, err)
+	}
+
+	// An empty object has no first byte to probe
+	empty := httptest.NewServer(presignedHandler(nil))
+	defer empty.Close()
+	if rr, err := fs.NewRangeReaderAt(empty.URL); err != nil || rr.Size() != 0 {
+		t.Errorf("empty object: %v", err)
+	}
+}
+
+func TestRangeReaderAtWithoutRanges(t *testing.T) {
+	// A server that ignores Range and sends the whole file
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("the whole file"))
+	}))
+	defer srv.Close()
+	if _, err := fs.NewRangeReaderAt(srv.URL); err == nil {
+		t.Error("NewRangeReaderAt accepted a server without byte ranges")
+	}
+
+	missing := httptest.NewServer(http.NotFoundHandler())
+	defer missing.Close()
+	if _, err := fs.NewRangeReaderAt(missing.URL); err == nil {
+		t.Error("NewRangeReaderAt accepted a 404")
+	}
+}
@@ -0,0 +1,106 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+
+	"github.com/falk/nsz-go/pkg/keys"
+)
+
+// ErrKeysUndetermined is returned by RequiredKeys when the NCA header cannot
+// be decrypted, so only header_key is known to be needed.
+var ErrKeysUndetermined = errors.New("cannot read the nca header to tell which keys it needs")
+
+// keyAreaKeyNames are the key area key types, by NCA key area index.
+var keyAreaKeyNames = [...]string{"application", "ocean", "system"}
+
+// RequiredKeys returns the prod.keys entries needed to compress the NCA or
+// NCZ r, or every NCA and NCZ of the PFS0 r, in the order first needed.
+//
+// header_key is always needed. An encrypted body also needs the master key of
+// its generation (for a rights ID, that of the rights ID, which the ticket's
+// title key is encrypted with) and the sources keys.DeriveKeys derives from it:
+// titlekek_source if the body key comes from a ticket (rights ID), or the
+// key_area_key_<type>_source of its key area otherwise. Tickets themselves
+// are not keys and are not listed.
+//
+// Without a usable header_key the rest cannot be known; the list then holds
+// just header_key and the error wraps ErrKeysUndetermined.
+func RequiredKeys(r io.ReaderAt) ([]string, error) {
+	magic := make([]byte, len(MagicPFS0))
+	if _, err := r.ReadAt(magic, 0); err == nil && string(magic) == MagicPFS0 {
+		return pfs0RequiredKeys(r)
+	}
+	return ncaRequiredKeys(r)
+}
+
+// pfs0RequiredKeys merges the required keys of the NCA and NCZ members of the PFS0 r.
+func pfs0RequiredKeys(r io.ReaderAt) ([]string, error) {
+	files, headerSize, err := OpenPfs0(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	seen := make(map[string]bool)
+	for _, file := range files {
+		if ext := strings.ToLower(filepath.Ext(file.Name)); ext != ".nca" && ext != ".ncz" {
+			continue
+		}
+		sr := io.NewSectionReader(r, headerSize+int64(file.Entry.DataOffset), int64(file.Entry.DataSize))
+		ncaNames, err := ncaRequiredKeys(sr)
+		for _, name := range ncaNames {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		if err != nil {
+			return names, fmt.Errorf("%s: %w", file.Name, err)
+		}
+	}
+	return names, nil
+}
+
+// ncaRequiredKeys returns the required keys of the NCA or NCZ r.
+func ncaRequiredKeys(r io.ReaderAt) ([]string, error) {
+	names := []string{"header_key"}
+	h, err := ParseNcaHeader(r)
+	if err != nil {
+		if keys.Get("header_key") == nil || errors.Is(err, ErrInvalidHeaderKey) {
+			return names, fmt.Errorf("%w: %v", ErrKeysUndetermined, err)
+		}
+		return names, err
+	}
+
+	encrypted := false
+	for i, s := range h.SectionTables {
+		if s.MediaEndOffset == 0 {
+			continue
+		}
+		// XTS sections are compressed still encrypted, so need no key
+		switch h.FsHeaders[i].CryptoType {
+		case CryptoTypeCTR, CryptoTypeBKTR:
+			encrypted = true
+		}
+	}
+	if !encrypted {
+		return names, nil
+	}
+
+	names = append(names,
+		fmt.Sprintf("master_key_%02x", h.TitleKeyMasterKeyIndex()),
+		"aes_kek_generation_source",
+		"aes_key_generation_source",
+	)
+	if h.HasRightsID() {
+		return append(names, "titlekek_source"), nil
+	}
+	if int(h.KeyAreaIndex) >= len(keyAreaKeyNames) {
+		return names, fmt.Errorf("invalid key area index %d", h.KeyAreaIndex)
+	}
+	return append(names, fmt.Sprintf("key_area_key_%s_source", keyAreaKeyNames[h.KeyAreaIndex])), nil
+}
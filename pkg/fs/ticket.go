@@ -0,0 +1,122 @@
+package fs
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Ticket signature types
+const (
+	SigTypeRSA4096SHA1   = 0x10000
+	SigTypeRSA2048SHA1   = 0x10001
+	SigTypeECDSASHA1     = 0x10002
+	SigTypeRSA4096SHA256 = 0x10003
+	SigTypeRSA2048SHA256 = 0x10004
+	SigTypeECDSASHA256   = 0x10005
+	SigTypeHMACSHA1      = 0x10006
+)
+
+// Title key types
+const (
+	TitleKeyTypeCommon       = 0
+	TitleKeyTypePersonalized = 1
+)
+
+// ticketDataSize is the size of the ticket body following the signature block.
+const ticketDataSize = 0x180
+
+// Ticket holds the fields of an ES ticket (.tik) needed to recover a title key.
+type Ticket struct {
+	SignatureType     uint32
+	Issuer            string
+	TitleKeyBlock     [0x100]byte // Common tickets store the encrypted title key in the first 0x10 bytes
+	FormatVersion     byte
+	TitleKeyType      byte
+	TicketVersion     uint16
+	LicenseType       byte
+	MasterKeyRevision byte // 0x285 for RSA-2048 signed tickets
+	PropertyMask      uint16
+	TicketID          uint64
+	DeviceID          uint64
+	RightsID          [0x10]byte
+	AccountID         uint32
+}
+
+// signatureBlockSize returns the size of the signature plus its padding for a signature type.
+func signatureBlockSize(sigType uint32) (int, error) {
+	switch sigType {
+	case SigTypeRSA4096SHA1, SigTypeRSA4096SHA256:
+		return 0x200 + 0x3C, nil
+	case SigTypeRSA2048SHA1, SigTypeRSA2048SHA256:
+		return 0x100 + 0x3C, nil
+	case SigTypeECDSASHA1, SigTypeECDSASHA256:
+		return 0x3C + 0x40, nil
+	case SigTypeHMACSHA1:
+		return 0x14 + 0x28, nil
+	}
+	return 0, fmt.Errorf("unknown ticket signature type 0x%x", sigType)
+}
+
+// ParseTicket reads a ticket, locating the body from the signature type.
+func ParseTicket(r io.Reader) (*Ticket, error) {
+	var sigType uint32
+	if err := binary.Read(r, binary.LittleEndian, &sigType); err != nil {
+		return nil, err
+	}
+
+	sigSize, err := signatureBlockSize(sigType)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.CopyN(io.Discard, r, int64(sigSize)); err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, ticketDataSize)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, fmt.Errorf("read ticket data: %w", err)
+	}
+
+	t := &Ticket{
+		SignatureType:     sigType,
+		FormatVersion:     data[0x140],
+		TitleKeyType:      data[0x141],
+		TicketVersion:     binary.LittleEndian.Uint16(data[0x142:0x144]),
+		LicenseType:       data[0x144],
+		MasterKeyRevision: data[0x145],
+		PropertyMask:      binary.LittleEndian.Uint16(data[0x146:0x148]),
+		TicketID:          binary.LittleEndian.Uint64(data[0x150:0x158]),
+		DeviceID:          binary.LittleEndian.Uint64(data[0x158:0x160]),
+		AccountID:         binary.LittleEndian.Uint32(data[0x170:0x174]),
+	}
+	t.Issuer = string(trimNul(data[0x00:0x40]))
+	copy(t.TitleKeyBlock[:], data[0x40:0x140])
+	copy(t.RightsID[:], data[0x160:0x170])
+
+	return t, nil
+}
+
+// EncryptedTitleKey returns the encrypted title key of a common ticket.
+func (t *Ticket) EncryptedTitleKey() []byte {
+	key := make([]byte, 0x10)
+	copy(key, t.TitleKeyBlock[:0x10])
+	return key
+}
+
+// MasterKeyIndex returns the index of the master key the title key is
+// encrypted with, from the ticket's key generation byte. It should match
+// NcaHeader.TitleKeyMasterKeyIndex, which is preferred when they differ.
+func (t *Ticket) MasterKeyIndex() int {
+	return masterKeyIndex(t.MasterKeyRevision)
+}
+
+// trimNul returns b up to its first NUL byte.
+func trimNul(b []byte) []byte {
+	for i, c := range b {
+		if c == 0 {
+			return b[:i]
+		}
+	}
+	return b
+}
@@ -0,0 +1,48 @@
+package fs
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/falk/nsz-go/pkg/nsz"
+)
+
+// VerifyNczBlocks checks every block of the NCZ r against its block hash
+// trailer (CompressOptions.BlockHashes) without decompressing anything, and
+// returns the indexes of the blocks that do not match. It returns
+// ErrNoBlockHashes if the NCZ has no trailer, as solid NCZs never do.
+func VerifyNczBlocks(r io.ReaderAt) ([]int, error) {
+	sr := io.NewSectionReader(r, NcaFullHeaderSize, 1<<62)
+	if _, err := nsz.ReadNczHeader(sr); err != nil {
+		return nil, err
+	}
+	pos, _ := sr.Seek(0, io.SeekCurrent)
+	magic := make([]byte, len(nsz.MagicNCZBLOCK))
+	if n, err := sr.ReadAt(magic, pos); n < len(magic) {
+		return nil, fmt.Errorf("read block header: %w", err)
+	}
+	if string(magic) != nsz.MagicNCZBLOCK {
+		return nil, ErrNoBlockHashes
+	}
+
+	bh, sizes, hashes, err := readBlockTable(sr)
+	if err != nil {
+		return nil, err
+	}
+	if hashes == nil {
+		return nil, ErrNoBlockHashes
+	}
+
+	var bad []int
+	buf := make([]byte, bh.BlockSize())
+	for i, size := range sizes {
+		block := buf[:size]
+		if _, err := io.ReadFull(sr, block); err != nil {
+			return bad, fmt.Errorf("read block %d: %w", i, err)
+		}
+		if nsz.BlockHash(block) != hashes[i] {
+			bad = append(bad, i)
+		}
+	}
+	return bad, nil
+}
@@ -0,0 +1,116 @@
+package fs
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// WalkNcaFunc is called by WalkNcas for each NCA. nca.Reader is only valid
+// during the call.
+type WalkNcaFunc func(path string, nca *NCA) error
+
+// WalkNcas calls fn for every NCA under root: loose .nca and .ncz files, and
+// the NCA and NCZ members of NSP/NSZ, XCI/XCZ and HFS0 files. Containers are
+// recognized by their contents; other files are ignored. A member's path is
+// the container's path joined with its name (partition/name for an XCI).
+// For a block-mode NCZ, nca.Reader reads the NCA it restores to (see
+// OpenNcz); for a solid one only the header is meaningful and nca.Reader is
+// the NCZ itself.
+//
+// Files and members that cannot be read or parsed are skipped, and their
+// errors are returned together (see errors.Join) once the walk is done. An
+// error from fn stops the walk and is returned as is.
+func WalkNcas(root string, fn WalkNcaFunc) error {
+	var skipped []error
+	err := filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			skipped = append(skipped, err)
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fileSkipped, err := walkFile(path, fn)
+		skipped = append(skipped, fileSkipped...)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Join(skipped...)
+}
+
+// walkFile calls fn for the NCAs of the file at path. It returns the errors
+// of what it skipped, and the error of fn, if any.
+func walkFile(path string, fn WalkNcaFunc) ([]error, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return []error{err}, nil
+	}
+	defer f.Close()
+
+	typ, err := DetectContainer(f)
+	switch {
+	case err != nil:
+		// An NCA the header key does not decrypt is worth reporting
+		if isNcaName(path) {
+			return []error{fmt.Errorf("%s: %w", path, err)}, nil
+		}
+		return nil, nil
+	case typ == ContainerNCA || typ == ContainerNCZ:
+		nca, err := NewNCA(ncaReader(f))
+		if err != nil {
+			return []error{fmt.Errorf("%s: %w", path, err)}, nil
+		}
+		return nil, fn(path, nca)
+	}
+
+	a, err := NewArchive(f)
+	if err != nil {
+		return []error{fmt.Errorf("%s: %w", path, err)}, nil
+	}
+	defer a.Close()
+
+	var skipped []error
+	for _, name := range a.List() {
+		if !isNcaName(name) {
+			continue
+		}
+		memberPath := filepath.Join(path, name)
+		rs, err := a.Open(name)
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("%s: %w", memberPath, err))
+			continue
+		}
+		nca, err := NewNCA(ncaReader(rs.(io.ReaderAt)))
+		if err != nil {
+			skipped = append(skipped, fmt.Errorf("%s: %w", memberPath, err))
+			continue
+		}
+		if err := fn(memberPath, nca); err != nil {
+			return skipped, err
+		}
+	}
+	return skipped, nil
+}
+
+// ncaReader returns r, or a reader over the NCA it restores to if r is a
+// block-mode NCZ.
+func ncaReader(r io.ReaderAt) io.ReaderAt {
+	if IsNcz(r) {
+		if nr, _, err := OpenNcz(r); err == nil {
+			return nr
+		}
+	}
+	return r
+}
+
+// isNcaName reports whether name has an .nca or .ncz extension.
+func isNcaName(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".nca" || ext == ".ncz"
+}
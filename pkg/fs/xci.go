@@ -0,0 +1,327 @@
+package fs
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	MagicXciHead = "HEAD"
+
+	xciHeaderOffset = 0x100 // The gamecard header follows a 0x100-byte RSA signature
+)
+
+// ErrXciHashMismatch is returned by DecompressXci when the restored root
+// HFS0 does not match the hash in the gamecard header.
+var ErrXciHashMismatch = errors.New("root HFS0 hash does not match the gamecard header")
+
+// ErrXczNoLayout is returned by DecompressXci, along with its results, for an
+// XCZ that does not record the layout of the original card image (see
+// MagicXCZLAYOUT), such as one written by another tool. The HFS0 tree is
+// then rebuilt in a layout of its own: every file is restored, but the image
+// is not the original one and fails its root HFS0 hash.
+var ErrXczNoLayout = errors.New("xcz does not record the original card layout")
+
+// XciHeader holds the gamecard header fields needed to find the partitions.
+type XciHeader struct {
+	Magic                  [4]byte // 0x100 "HEAD"
+	SecureAreaStartAddress uint32  // 0x104, in media units
+	BackupAreaStartAddress uint32  // 0x108
+	TitleKeyDecIndex       byte    // 0x10C
+	RomSize                byte    // 0x10D
+	Version                byte    // 0x10E
+	Flags                  byte    // 0x10F
+	PackageID              uint64  // 0x110
+	ValidDataEndAddress    uint32  // 0x118, in media units
+	Reserved               uint32  // 0x11C
+	IV                     [0x10]byte
+	RootHfs0Offset         uint64 // 0x130
+	RootHfs0HeaderSize     uint64 // 0x138
+	RootHfs0HeaderHash     [0x20]byte
+	InitialDataHash        [0x20]byte
+}
+
+// ParseXciHeader reads the gamecard header of an XCI.
+func ParseXciHeader(r io.ReaderAt) (*XciHeader, error) {
+	var h XciHeader
+	if err := binary.Read(io.NewSectionReader(r, xciHeaderOffset, 1<<62), binary.LittleEndian, &h); err != nil {
+		return nil, err
+	}
+	if string(h.Magic[:]) != MagicXciHead {
+		return nil, fmt.Errorf("invalid magic: expected HEAD, got %s", h.Magic)
+	}
+	return &h, nil
+}
+
+// XciFileResult describes one file of a partition written by CompressXci or
+// DecompressXci.
+type XciFileResult struct {
+	Partition   string
+	Name        string
+	OutputName  string
+	InputSize   int64
+	OutputSize  int64
+	Compressed  bool   // Written as NCZ, or restored from NCZ when decompressing
+	ContentType string // Name of the content type of a compressed NCA, if known
+}
+
+// CompressXci writes an XCZ: the XCI r of the given size with the NCAs of
+// its secure partition compressed to NCZ. Everything before the root HFS0
+// (the gamecard header, certificate and initial data) is copied verbatim, as
+// are the other partitions; the HFS0 tree is rebuilt around the compressed
+// members with fresh hashes. Gamecard NCAs carry no rights ID, so no title
+// keys are needed.
+//
+// The gamecard header is signed and is not updated, so its root HFS0 hash and
+// valid data end no longer match the XCZ. The original layout (the HFS0
+// headers, the padding between files and after the last partition) goes in a
+// layout trailer after the root HFS0, from which DecompressXci restores the
+// exact image. A card whose layout cannot be recorded, with overlapping files
+// or more than 16 MB outside them, is compressed without one.
+// w must be readable as well as writable, as the HFS0 hashes are computed
+// from the written data.
+func CompressXci(r io.ReaderAt, w io.ReadWriteSeeker, size int64, opts CompressOptions) ([]XciFileResult, error) {
+	h, err := ParseXciHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	trailer, err := xczLayoutTrailer(r, size, int64(h.RootHfs0Offset))
+	if errors.Is(err, errXczLayout) {
+		trailer = nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	results, end, err := rebuildXci(r, w, func(hw *Hfs0Writer, i int, file Hfs0File, sr *io.SectionReader) (*XciFileResult, error) {
+		res := &XciFileResult{Name: file.Name, OutputName: file.Name, InputSize: sr.Size(), OutputSize: sr.Size()}
+		if hw.Name(i) == file.Name {
+			return res, hw.AddFile(i, sr, sr.Size(), file.Entry.HashedSize)
+		}
+
+		cr, err := hw.AddCompressedFile(i, sr, sr.Size(), nil, opts)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name, err)
+		}
+		res.OutputName = hw.Name(i)
+		res.OutputSize = cr.OutputSize
+		res.Compressed = !cr.Stored
+		if ct, ok := cr.ContentType(); ok {
+			res.ContentType = ContentTypeName(ct)
+		}
+		return res, nil
+	}, func(file Hfs0File, sr *io.SectionReader) string {
+		if !strings.EqualFold(filepath.Ext(file.Name), ".nca") {
+			return file.Name
+		}
+		ct, err := PeekContentTypeWithKey(sr, opts.HeaderKey)
+		if err != nil || !opts.ShouldCompressType(ct) || !opts.ShouldCompressSize(sr.Size()) {
+			return file.Name
+		}
+		return strings.TrimSuffix(file.Name, filepath.Ext(file.Name)) + ".ncz"
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := w.Seek(end, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(trailer); err != nil {
+		return nil, err
+	}
+	return results, truncateXci(w, end+int64(len(trailer)))
+}
+
+// DecompressXci restores the XCI from an XCZ of the given size written by
+// CompressXci, decompressing the NCZ members of the secure partition back to
+// NCA and laying the image out as its layout trailer records, so that it is
+// the original card image byte for byte. The result is checked against the
+// root HFS0 hash in the gamecard header, which was kept verbatim; a mismatch
+// (ErrXciHashMismatch) means the XCZ is damaged.
+//
+// Without a layout trailer, the HFS0 tree is rebuilt in a layout of its own
+// and ErrXczNoLayout is returned with the results: the files are complete,
+// but the image is not the original one.
+func DecompressXci(r io.ReaderAt, w io.ReadWriteSeeker, size int64) ([]XciFileResult, error) {
+	pieces, err := readXczLayoutTrailer(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if pieces != nil {
+		if _, err := w.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		results, err := restoreXczLayout(r, w, pieces)
+		if err != nil {
+			return nil, err
+		}
+		return results, verifyXciRootHash(w)
+	}
+
+	results, end, err := rebuildXci(r, w, func(hw *Hfs0Writer, i int, file Hfs0File, sr *io.SectionReader) (*XciFileResult, error) {
+		res := &XciFileResult{Name: file.Name, OutputName: hw.Name(i), InputSize: sr.Size()}
+		if hw.Name(i) == file.Name {
+			res.OutputSize = sr.Size()
+			return res, hw.AddFile(i, sr, sr.Size(), file.Entry.HashedSize)
+		}
+
+		if err := hw.AddDecompressedFile(i, sr, file.Entry.HashedSize); err != nil {
+			return nil, fmt.Errorf("%s: %w", file.Name, err)
+		}
+		res.OutputSize = int64(hw.entries[i].DataSize)
+		res.Compressed = true
+		return res, nil
+	}, func(file Hfs0File, sr *io.SectionReader) string {
+		if ext := filepath.Ext(file.Name); strings.EqualFold(ext, ".ncz") {
+			return strings.TrimSuffix(file.Name, ext) + ".nca"
+		}
+		return file.Name
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := truncateXci(w, end); err != nil {
+		return nil, err
+	}
+	err = verifyXciRootHash(w)
+	if errors.Is(err, ErrXciHashMismatch) {
+		err = ErrXczNoLayout
+	}
+	return results, err
+}
+
+// truncateXci drops anything left past size in w by a discarded compression
+// attempt, if w can be truncated.
+func truncateXci(w io.Writer, size int64) error {
+	if t, ok := w.(interface{ Truncate(int64) error }); ok {
+		return t.Truncate(size)
+	}
+	return nil
+}
+
+// verifyXciRootHash checks the root HFS0 header written to rw against the
+// hash recorded in the gamecard header.
+func verifyXciRootHash(rw io.ReadWriteSeeker) error {
+	if _, err := rw.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var prefix bytes.Buffer
+	if _, err := io.CopyN(&prefix, rw, xciHeaderOffset+int64(binary.Size(XciHeader{}))); err != nil {
+		return err
+	}
+	h, err := ParseXciHeader(bytes.NewReader(prefix.Bytes()))
+	if err != nil {
+		return err
+	}
+
+	root := make([]byte, h.RootHfs0HeaderSize)
+	if _, err := rw.Seek(int64(h.RootHfs0Offset), io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rw, root); err != nil {
+		return err
+	}
+	if sha256.Sum256(root) != h.RootHfs0HeaderHash {
+		return ErrXciHashMismatch
+	}
+	return nil
+}
+
+// xciFileFunc writes the i-th file of the secure partition to hw, whose
+// Name(i) is the output name chosen by the matching xciRenameFunc.
+type xciFileFunc func(hw *Hfs0Writer, i int, file Hfs0File, sr *io.SectionReader) (*XciFileResult, error)
+
+// xciRenameFunc returns the output name of a secure partition file.
+type xciRenameFunc func(file Hfs0File, sr *io.SectionReader) string
+
+// rebuildXci copies r to w, rewriting the secure partition's files with
+// writeFile under the names given by rename, and returns where the root HFS0
+// ends in w.
+func rebuildXci(r io.ReaderAt, w io.ReadWriteSeeker, writeFile xciFileFunc, rename xciRenameFunc) ([]XciFileResult, int64, error) {
+	h, err := ParseXciHeader(r)
+	if err != nil {
+		return nil, 0, err
+	}
+	rootOffset := int64(h.RootHfs0Offset)
+
+	// 1. Everything up to the root HFS0, verbatim
+	if _, err := w.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	if _, err := io.Copy(w, io.NewSectionReader(r, 0, rootOffset)); err != nil {
+		return nil, 0, fmt.Errorf("copy gamecard header: %w", err)
+	}
+
+	// 2. Root HFS0: one file per partition
+	partitions, rootHeaderSize, err := OpenHfs0(r, rootOffset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("root partition: %w", err)
+	}
+	names := make([]string, len(partitions))
+	for i, p := range partitions {
+		names[i] = p.Name
+	}
+	root, err := NewHfs0Writer(w, rootOffset, names)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var results []XciFileResult
+	for i, p := range partitions {
+		pOffset := rootOffset + rootHeaderSize + int64(p.Entry.DataOffset)
+		pSize := int64(p.Entry.DataSize)
+
+		if p.Name != "secure" {
+			if err := root.AddFile(i, io.NewSectionReader(r, pOffset, pSize), pSize, p.Entry.HashedSize); err != nil {
+				return nil, 0, fmt.Errorf("partition %s: %w", p.Name, err)
+			}
+			continue
+		}
+
+		// 3. Secure partition, rebuilt file by file
+		files, headerSize, err := OpenHfs0(r, pOffset)
+		if err != nil {
+			return nil, 0, fmt.Errorf("partition %s: %w", p.Name, err)
+		}
+		readers := make([]*io.SectionReader, len(files))
+		fileNames := make([]string, len(files))
+		for j, file := range files {
+			readers[j] = io.NewSectionReader(r, pOffset+headerSize+int64(file.Entry.DataOffset), int64(file.Entry.DataSize))
+			fileNames[j] = rename(file, readers[j])
+		}
+
+		start, err := root.BeginFile(i)
+		if err != nil {
+			return nil, 0, err
+		}
+		hw, err := NewHfs0Writer(w, start, fileNames)
+		if err != nil {
+			return nil, 0, err
+		}
+		for j, file := range files {
+			res, err := writeFile(hw, j, file, readers[j])
+			if err != nil {
+				return nil, 0, err
+			}
+			res.Partition = p.Name
+			results = append(results, *res)
+		}
+		if err := hw.Close(); err != nil {
+			return nil, 0, err
+		}
+		if err := root.EndFile(i, uint32(hw.HeaderSize())); err != nil {
+			return nil, 0, err
+		}
+	}
+
+	if err := root.Close(); err != nil {
+		return nil, 0, err
+	}
+	return results, rootOffset + root.Size(), nil
+}
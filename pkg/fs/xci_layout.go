@@ -0,0 +1,313 @@
+package fs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// MagicXCZLAYOUT ends the layout trailer of an XCZ, written after its root
+// HFS0 where card readers do not look. The trailer records the card image
+// from the root HFS0 on as a list of pieces: the original HFS0 headers and
+// the bytes between files as stored (or as a fill byte), and references to
+// the partitions and secure files of the XCZ. DecompressXci follows it to
+// restore the original image byte for byte.
+const MagicXCZLAYOUT = "XCZLAYT0"
+
+// xczLayoutFooterSize is the size of the footer that follows the pieces:
+// their size (uint64) and MagicXCZLAYOUT.
+const xczLayoutFooterSize = 16
+
+// maxXczLayoutRaw bounds the bytes a layout trailer stores as is. Card
+// images only have headers and short runs of padding between files; an
+// image that needs more is compressed without a trailer.
+const maxXczLayoutRaw = 1 << 24
+
+// xczLayoutChunk is the granularity at which the bytes between files are
+// stored as a fill byte or as is.
+const xczLayoutChunk = 1 << 20
+
+// Kinds of xczPiece
+const (
+	xczPieceRaw       = 0 // Size bytes that follow the piece in the trailer
+	xczPieceFill      = 1 // Size bytes of the value Index
+	xczPiecePartition = 2 // Partition Index of the XCZ root HFS0, as is
+	xczPieceFile      = 3 // File Index of the secure partition of the XCZ, restored
+)
+
+// xczPiece is a run of the card image, in order from the root HFS0 offset.
+type xczPiece struct {
+	Kind  uint32
+	Index uint32
+	Size  uint64
+}
+
+// errXczLayout is returned by xczLayoutTrailer for card images whose layout
+// cannot be recorded.
+var errXczLayout = errors.New("card layout cannot be recorded")
+
+// xczLayoutBuilder appends the pieces of a layout trailer.
+type xczLayoutBuilder struct {
+	r    io.ReaderAt
+	b    []byte
+	last int // Offset in b of the last piece if it can be extended, or -1
+	raw  int64
+}
+
+// gap records the bytes of r in [start, end), which belong to no file.
+func (l *xczLayoutBuilder) gap(start, end int64) error {
+	buf := make([]byte, xczLayoutChunk)
+	for start < end {
+		chunk := buf[:min(end-start, xczLayoutChunk)]
+		if n, err := l.r.ReadAt(chunk, start); n < len(chunk) {
+			return fmt.Errorf("read card image at 0x%x: %w", start, err)
+		}
+		start += int64(len(chunk))
+
+		if fill := chunk[0]; bytes.Count(chunk, chunk[:1]) == len(chunk) {
+			l.add(xczPiece{Kind: xczPieceFill, Index: uint32(fill), Size: uint64(len(chunk))}, nil)
+			continue
+		}
+		if l.raw += int64(len(chunk)); l.raw > maxXczLayoutRaw {
+			return fmt.Errorf("%w: more than %d bytes outside files", errXczLayout, maxXczLayoutRaw)
+		}
+		l.add(xczPiece{Kind: xczPieceRaw, Size: uint64(len(chunk))}, chunk)
+	}
+	return nil
+}
+
+// add appends p and the raw bytes that follow it. A fill or raw piece that
+// continues the last one is merged into it.
+func (l *xczLayoutBuilder) add(p xczPiece, raw []byte) {
+	if l.last >= 0 {
+		last := l.b[l.last:]
+		if binary.LittleEndian.Uint32(last) == p.Kind && binary.LittleEndian.Uint32(last[4:]) == p.Index {
+			binary.LittleEndian.PutUint64(last[8:], binary.LittleEndian.Uint64(last[8:])+p.Size)
+			l.b = append(l.b, raw...)
+			return
+		}
+	}
+	l.last = -1
+	if p.Kind == xczPieceRaw || p.Kind == xczPieceFill {
+		l.last = len(l.b)
+	}
+	l.b, _ = binary.Append(l.b, binary.LittleEndian, p)
+	l.b = append(l.b, raw...)
+}
+
+// xczLayoutTrailer returns the layout trailer of the card image r of the
+// given size, whose root HFS0 is at rootOffset. It returns an error wrapping
+// errXczLayout if files overlap or run past their partition, or too much of
+// the image lies outside files.
+func xczLayoutTrailer(r io.ReaderAt, size, rootOffset int64) ([]byte, error) {
+	l := &xczLayoutBuilder{r: r, last: -1}
+	partitions, rootHeaderSize, err := OpenHfs0(r, rootOffset)
+	if err != nil {
+		return nil, err
+	}
+	rootData := rootOffset + rootHeaderSize
+	if err := l.gap(rootOffset, rootData); err != nil {
+		return nil, err
+	}
+
+	pos := rootData
+	for _, i := range hfs0Order(partitions) {
+		p := partitions[i]
+		start := rootData + int64(p.Entry.DataOffset)
+		end := start + int64(p.Entry.DataSize)
+		if start < pos {
+			return nil, fmt.Errorf("%w: partition %s overlaps the one before", errXczLayout, p.Name)
+		}
+		if err := l.gap(pos, start); err != nil {
+			return nil, err
+		}
+		if p.Name != "secure" {
+			l.add(xczPiece{Kind: xczPiecePartition, Index: uint32(i), Size: p.Entry.DataSize}, nil)
+			pos = end
+			continue
+		}
+
+		files, headerSize, err := OpenHfs0(r, start)
+		if err != nil {
+			return nil, fmt.Errorf("partition %s: %w", p.Name, err)
+		}
+		pos = start + headerSize
+		if err := l.gap(start, pos); err != nil {
+			return nil, err
+		}
+		for _, j := range hfs0Order(files) {
+			fileStart := start + headerSize + int64(files[j].Entry.DataOffset)
+			if fileStart < pos {
+				return nil, fmt.Errorf("%w: %s overlaps the file before", errXczLayout, files[j].Name)
+			}
+			if err := l.gap(pos, fileStart); err != nil {
+				return nil, err
+			}
+			l.add(xczPiece{Kind: xczPieceFile, Index: uint32(j), Size: files[j].Entry.DataSize}, nil)
+			pos = fileStart + int64(files[j].Entry.DataSize)
+		}
+		if pos > end {
+			return nil, fmt.Errorf("%w: files run past partition %s", errXczLayout, p.Name)
+		}
+		if err := l.gap(pos, end); err != nil {
+			return nil, err
+		}
+		pos = end
+	}
+	if pos > size {
+		return nil, fmt.Errorf("%w: partitions end at 0x%x, past the image", errXczLayout, pos)
+	}
+	if err := l.gap(pos, size); err != nil {
+		return nil, err
+	}
+
+	b := binary.LittleEndian.AppendUint64(l.b, uint64(len(l.b)))
+	return append(b, MagicXCZLAYOUT...), nil
+}
+
+// hfs0Order returns the indices of files by data offset.
+func hfs0Order(files []Hfs0File) []int {
+	order := make([]int, len(files))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return files[order[a]].Entry.DataOffset < files[order[b]].Entry.DataOffset
+	})
+	return order
+}
+
+// readXczLayoutTrailer returns the pieces of the layout trailer at the end of
+// an XCZ of the given size, or nil if it has none.
+func readXczLayoutTrailer(r io.ReaderAt, size int64) ([]byte, error) {
+	if size < xczLayoutFooterSize {
+		return nil, nil
+	}
+	footer := make([]byte, xczLayoutFooterSize)
+	if n, err := r.ReadAt(footer, size-xczLayoutFooterSize); n < len(footer) {
+		return nil, fmt.Errorf("read layout footer: %w", err)
+	}
+	if string(footer[8:]) != MagicXCZLAYOUT {
+		return nil, nil
+	}
+
+	piecesSize := binary.LittleEndian.Uint64(footer)
+	if piecesSize > uint64(size-xczLayoutFooterSize) || piecesSize > maxXczLayoutRaw+1<<20 {
+		return nil, fmt.Errorf("layout trailer of %d bytes in a %d-byte file", piecesSize, size)
+	}
+	pieces := make([]byte, piecesSize)
+	if n, err := r.ReadAt(pieces, size-xczLayoutFooterSize-int64(piecesSize)); n < len(pieces) {
+		return nil, fmt.Errorf("read layout trailer: %w", err)
+	}
+	return pieces, nil
+}
+
+// restoreXczLayout writes to w the card image the layout trailer pieces
+// describe: everything before the root HFS0 of the XCZ r, then the pieces,
+// with the NCZ files of its secure partition decompressed.
+func restoreXczLayout(r io.ReaderAt, w io.Writer, pieces []byte) ([]XciFileResult, error) {
+	h, err := ParseXciHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	rootOffset := int64(h.RootHfs0Offset)
+	if _, err := io.Copy(w, io.NewSectionReader(r, 0, rootOffset)); err != nil {
+		return nil, fmt.Errorf("copy gamecard header: %w", err)
+	}
+
+	// The partitions and secure files of the XCZ, which pieces refer to
+	partitions, rootHeaderSize, err := OpenHfs0(r, rootOffset)
+	if err != nil {
+		return nil, fmt.Errorf("root partition: %w", err)
+	}
+	rootData := rootOffset + rootHeaderSize
+	var files []Hfs0File
+	var filesData int64
+	for _, p := range partitions {
+		if p.Name == "secure" {
+			start := rootData + int64(p.Entry.DataOffset)
+			var headerSize int64
+			if files, headerSize, err = OpenHfs0(r, start); err != nil {
+				return nil, fmt.Errorf("partition %s: %w", p.Name, err)
+			}
+			filesData = start + headerSize
+		}
+	}
+
+	var results []XciFileResult
+	fill := make([]byte, 0, xczLayoutChunk)
+	pr := bytes.NewReader(pieces)
+	for pr.Len() > 0 {
+		var p xczPiece
+		if err := binary.Read(pr, binary.LittleEndian, &p); err != nil {
+			return nil, fmt.Errorf("layout trailer: %w", err)
+		}
+		switch p.Kind {
+		case xczPieceRaw:
+			if _, err := io.CopyN(w, pr, int64(p.Size)); err != nil {
+				return nil, fmt.Errorf("layout trailer: %w", err)
+			}
+		case xczPieceFill:
+			fill = fill[:min(p.Size, xczLayoutChunk)]
+			for i := range fill {
+				fill[i] = byte(p.Index)
+			}
+			for left := int64(p.Size); left > 0; left -= int64(len(fill)) {
+				if _, err := w.Write(fill[:min(left, int64(len(fill)))]); err != nil {
+					return nil, err
+				}
+			}
+		case xczPiecePartition:
+			if int(p.Index) >= len(partitions) || partitions[p.Index].Entry.DataSize != p.Size {
+				return nil, fmt.Errorf("layout trailer: no partition %d of 0x%x bytes", p.Index, p.Size)
+			}
+			start := rootData + int64(partitions[p.Index].Entry.DataOffset)
+			if _, err := io.Copy(w, io.NewSectionReader(r, start, int64(p.Size))); err != nil {
+				return nil, fmt.Errorf("partition %s: %w", partitions[p.Index].Name, err)
+			}
+		case xczPieceFile:
+			if int(p.Index) >= len(files) {
+				return nil, fmt.Errorf("layout trailer: no secure file %d", p.Index)
+			}
+			res, err := restoreXczFile(r, w, files[p.Index], filesData, int64(p.Size))
+			if err != nil {
+				return nil, err
+			}
+			results = append(results, *res)
+		default:
+			return nil, fmt.Errorf("layout trailer: unknown piece kind %d", p.Kind)
+		}
+	}
+	return results, nil
+}
+
+// restoreXczFile writes the secure file of the XCZ r whose data starts at
+// filesData + its data offset, decompressed if it is an NCZ, and checks that
+// it restores to size bytes.
+func restoreXczFile(r io.ReaderAt, w io.Writer, file Hfs0File, filesData, size int64) (*XciFileResult, error) {
+	sr := io.NewSectionReader(r, filesData+int64(file.Entry.DataOffset), int64(file.Entry.DataSize))
+	res := &XciFileResult{Partition: "secure", Name: file.Name, OutputName: file.Name, InputSize: sr.Size()}
+
+	var n int64
+	var err error
+	if ext := filepath.Ext(file.Name); strings.EqualFold(ext, ".ncz") {
+		res.OutputName = strings.TrimSuffix(file.Name, ext) + ".nca"
+		res.Compressed = true
+		n, err = DecompressNca(sr, w)
+	} else {
+		n, err = io.Copy(w, sr)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", file.Name, err)
+	}
+	if n != size {
+		return nil, fmt.Errorf("%s: restored %d bytes, the card had %d", file.Name, n, size)
+	}
+	res.OutputSize = n
+	return res, nil
+}
@@ -0,0 +1,245 @@
+package fs_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/falk/nsz-go/internal/testutil"
+	"github.com/falk/nsz-go/pkg/fs"
+)
+
+// newTestXci returns a card image with a file in each of its update and
+// normal partitions, and in its secure partition a program NCA, which
+// compresses, and a short file that is not an NCA.
+func newTestXci(t testing.TB) []byte {
+	t.Helper()
+	if err := testutil.SetKeys(); err != nil {
+		t.Fatal(err)
+	}
+	nca, err := testutil.NewStandardCryptoNCA([]testutil.SectionSpec{
+		{Size: 0x30000, FsType: fs.FsTypePfs0, Counter: 1},
+		{Size: 0x50200, FsType: fs.FsTypeRomFs, Counter: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testutil.NewSyntheticXCI([]testutil.XciPartition{
+		{Name: "update", Files: []testutil.XciFile{
+			{Name: "0123456789abcdef0123456789abcdef.nca", Data: bytes.Repeat([]byte("update nca "), 0x300)},
+		}},
+		{Name: "normal", Files: []testutil.XciFile{
+			{Name: "fedcba9876543210fedcba9876543210.cnmt.nca", Data: bytes.Repeat([]byte{0x4e}, 0x1200)},
+		}},
+		{Name: "secure", Files: []testutil.XciFile{
+			{Name: "00112233445566778899aabbccddeeff.nca", Data: nca},
+			{Name: "card.cert", Data: []byte("not an nca")},
+		}},
+	}, 0x100000)
+}
+
+// compressTestXci compresses xci to a temporary XCZ and returns its bytes.
+func compressTestXci(t testing.TB, xci []byte) ([]byte, []fs.XciFileResult) {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "*.xcz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	results, err := fs.CompressXci(bytes.NewReader(xci), out, int64(len(xci)), testOptions())
+	if err != nil {
+		t.Fatalf("CompressXci: %v", err)
+	}
+	xcz, err := os.ReadFile(out.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return xcz, results
+}
+
+// checkHfs0Hashes checks every entry hash of the HFS0 at offset against the
+// data it covers, and returns its files and header size.
+func checkHfs0Hashes(t *testing.T, b []byte, offset int64) ([]fs.Hfs0File, int64) {
+	t.Helper()
+	files, headerSize, err := fs.OpenHfs0(bytes.NewReader(b), offset)
+	if err != nil {
+		t.Fatalf("HFS0 at 0x%x: %v", offset, err)
+	}
+	for _, f := range files {
+		start := offset + headerSize + int64(f.Entry.DataOffset)
+		if uint64(f.Entry.HashedSize) > f.Entry.DataSize {
+			t.Errorf("%s: hashed size 0x%x of 0x%x bytes", f.Name, f.Entry.HashedSize, f.Entry.DataSize)
+			continue
+		}
+		if sha256.Sum256(b[start:start+int64(f.Entry.HashedSize)]) != f.Entry.Hash {
+			t.Errorf("%s: hash does not match its first 0x%x bytes", f.Name, f.Entry.HashedSize)
+		}
+	}
+	return files, headerSize
+}
+
+func TestCompressXci(t *testing.T) {
+	xci := newTestXci(t)
+	xcz, results := compressTestXci(t, xci)
+
+	// The gamecard header, certificate and initial data are kept as is
+	if !bytes.Equal(xcz[:testutil.XciRootOffset], xci[:testutil.XciRootOffset]) {
+		t.Error("the area before the root HFS0 differs")
+	}
+
+	origRoot, origHeaderSize, err := fs.OpenHfs0(bytes.NewReader(xci), testutil.XciRootOffset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, headerSize := checkHfs0Hashes(t, xcz, testutil.XciRootOffset)
+	if len(root) != len(origRoot) {
+		t.Fatalf("root HFS0 has %d partitions, want %d", len(root), len(origRoot))
+	}
+	for i, p := range root {
+		orig := origRoot[i]
+		if p.Name != orig.Name {
+			t.Fatalf("partition %d is %s, want %s", i, p.Name, orig.Name)
+		}
+		start := testutil.XciRootOffset + headerSize + int64(p.Entry.DataOffset)
+		files, _ := checkHfs0Hashes(t, xcz, start)
+		if p.Name == "secure" {
+			if len(files) != 2 || !strings.HasSuffix(files[0].Name, ".ncz") || files[1].Name != "card.cert" {
+				t.Errorf("secure partition holds %+v", files)
+			}
+			continue
+		}
+
+		// Other partitions are copied verbatim
+		origStart := testutil.XciRootOffset + origHeaderSize + int64(orig.Entry.DataOffset)
+		got := xcz[start : start+int64(p.Entry.DataSize)]
+		if !bytes.Equal(got, xci[origStart:origStart+int64(orig.Entry.DataSize)]) {
+			t.Errorf("partition %s differs", p.Name)
+		}
+	}
+
+	if len(results) != 2 || !results[0].Compressed || results[0].OutputSize >= results[0].InputSize || results[1].Compressed {
+		t.Errorf("results = %+v", results)
+	}
+}
+
+func TestCompressXciUsesHeaderKey(t *testing.T) {
+	xci := newTestXci(t)
+	useWrongHeaderKey(t)
+	if _, results := compressTestXci(t, xci); !results[0].Compressed {
+		t.Errorf("the NCA was not compressed with CompressOptions.HeaderKey: %+v", results[0])
+	}
+}
+
+func TestHfs0WriterAlignsFiles(t *testing.T) {
+	f, err := os.CreateTemp(t.TempDir(), "*.hfs0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// An odd base and file sizes that are not sector multiples
+	const base = 0x10
+	contents := [][]byte{bytes.Repeat([]byte{1}, 0x321), bytes.Repeat([]byte{2}, 0x10), nil}
+	hw, err := fs.NewHfs0Writer(f, base, []string{"a", "bb", "empty"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, c := range contents {
+		if err := hw.AddFile(i, bytes.NewReader(c), int64(len(c)), fs.MediaSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := hw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if hw.HeaderSize()%fs.MediaSize != 0 {
+		t.Errorf("header is 0x%x bytes", hw.HeaderSize())
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, headerSize := checkHfs0Hashes(t, b, base)
+	for i, file := range files {
+		if file.Entry.DataOffset%fs.MediaSize != 0 {
+			t.Errorf("%s starts at 0x%x", file.Name, file.Entry.DataOffset)
+		}
+		start := base + headerSize + int64(file.Entry.DataOffset)
+		if !bytes.Equal(b[start:start+int64(file.Entry.DataSize)], contents[i]) {
+			t.Errorf("%s differs", file.Name)
+		}
+	}
+	if want := base + hw.Size(); int64(len(b)) != want {
+		t.Errorf("wrote 0x%x bytes, want 0x%x", len(b), want)
+	}
+}
+
+// decompressTestXcz decompresses xcz to a temporary XCI and returns its bytes.
+func decompressTestXcz(t *testing.T, xcz []byte) ([]byte, []fs.XciFileResult, error) {
+	t.Helper()
+	out, err := os.CreateTemp(t.TempDir(), "*.xci")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+	results, err := fs.DecompressXci(bytes.NewReader(xcz), out, int64(len(xcz)))
+	xci, readErr := os.ReadFile(out.Name())
+	if readErr != nil {
+		t.Fatal(readErr)
+	}
+	return xci, results, err
+}
+
+func TestXciRoundTrip(t *testing.T) {
+	xci := newTestXci(t)
+	xcz, _ := compressTestXci(t, xci)
+	if !bytes.HasSuffix(xcz, []byte(fs.MagicXCZLAYOUT)) {
+		t.Fatal("XCZ has no layout trailer")
+	}
+
+	got, results, err := decompressTestXcz(t, xcz)
+	if err != nil {
+		t.Fatalf("DecompressXci: %v", err)
+	}
+	if sha256.Sum256(got) != sha256.Sum256(xci) {
+		t.Fatalf("restored image (0x%x bytes) differs from the original (0x%x bytes)", len(got), len(xci))
+	}
+	if len(results) != 2 || !results[0].Compressed || !strings.HasSuffix(results[0].OutputName, ".nca") {
+		t.Errorf("results = %+v", results)
+	}
+
+	// A damaged trailer fails rather than restoring another image
+	damaged := bytes.Clone(xcz)
+	binary.LittleEndian.PutUint64(damaged[len(damaged)-16:], uint64(len(damaged)))
+	if _, _, err := decompressTestXcz(t, damaged); err == nil {
+		t.Error("DecompressXci accepted a layout trailer larger than the XCZ")
+	}
+}
+
+func TestXczWithoutLayout(t *testing.T) {
+	xci := newTestXci(t)
+	xcz, _ := compressTestXci(t, xci)
+	footer := xcz[len(xcz)-16:]
+	xcz = xcz[:len(xcz)-16-int(binary.LittleEndian.Uint64(footer))]
+
+	// The files come back, in a layout that is not the card's
+	got, results, err := decompressTestXcz(t, xcz)
+	if !errors.Is(err, fs.ErrXczNoLayout) {
+		t.Fatalf("got %v, want ErrXczNoLayout", err)
+	}
+	if len(results) != 2 || bytes.Equal(got, xci) {
+		t.Fatalf("results = %+v", results)
+	}
+	if !bytes.Equal(got[:testutil.XciRootOffset], xci[:testutil.XciRootOffset]) {
+		t.Error("the area before the root HFS0 differs")
+	}
+}
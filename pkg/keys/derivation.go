@@ -5,14 +5,21 @@ import (
 	"github.com/falk/nsz-go/pkg/crypto"
 )
 
-// Derived keys cache
+// Derived keys cache, rebuilt from the loaded keys on first use after Load or
+// Set changed them (see ensureDerived).
 var (
 	keyAreaKeys [32][3][]byte
 	titleKeks   [32][]byte
+	masterKeys  [32][]byte // Loaded, or derived by deriveMasterKey
+	stale       bool
 )
 
 // DecryptTitleKey decrypts a title key using the specified master key generation.
 func DecryptTitleKey(encryptedKey []byte, keyGen int) ([]byte, error) {
+	if keyGen < 0 || keyGen >= len(titleKeks) {
+		return nil, fmt.Errorf("invalid key generation %d", keyGen)
+	}
+	ensureDerived()
 	mu.RLock()
 	kek := titleKeks[keyGen]
 	mu.RUnlock()
@@ -41,12 +48,45 @@ func GenerateKek(src, masterKey, kekSeed, keySeed []byte) ([]byte, error) {
 	return srcKek, nil
 }
 
-// DeriveKeys generates the Key Area Keys and Title Keks for all available master keys.
-// Should be called after loading keys.
+// DeriveKeys generates the Key Area Keys and Title Keks for all available
+// master keys, replacing any derived before. The keys that need them derive
+// them on first use anyway; calling DeriveKeys after loading keys only adds
+// a warning if the generation sources are missing. It is safe to call again.
 func DeriveKeys() {
 	mu.Lock()
 	defer mu.Unlock()
 
+	if !deriveLocked() {
+		fmt.Println("Warning: Missing generation sources. Cannot derive keys.")
+	}
+}
+
+// ensureDerived derives the keys again if Load or Set changed them since.
+func ensureDerived() {
+	mu.RLock()
+	s := stale
+	mu.RUnlock()
+	if !s {
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if stale {
+		deriveLocked()
+	}
+}
+
+// deriveLocked rebuilds the derived keys with mu held for writing. It reports
+// false if the generation sources are missing, leaving the tables empty.
+func deriveLocked() bool {
+	stale = false
+	keyAreaKeys = [32][3][]byte{}
+	titleKeks = [32][]byte{}
+	for i := range masterKeys {
+		masterKeys[i] = deriveMasterKey(i)
+	}
+
 	aesKekGen := keys["aes_kek_generation_source"]
 	aesKeyGen := keys["aes_key_generation_source"]
 	titleKekSource := keys["titlekek_source"]
@@ -58,13 +98,11 @@ func DeriveKeys() {
 	}
 
 	if aesKekGen == nil || aesKeyGen == nil {
-		fmt.Println("Warning: Missing generation sources. Cannot derive keys.")
-		return
+		return false
 	}
 
 	for i := 0; i < 32; i++ {
-		masterKeyName := fmt.Sprintf("master_key_%02x", i)
-		masterKey := keys[masterKeyName]
+		masterKey := masterKeys[i]
 		if masterKey == nil {
 			continue
 		}
@@ -89,11 +127,47 @@ func DeriveKeys() {
 			}
 		}
 	}
+	return true
+}
+
+// deriveMasterKey returns master_key_XX for generation gen with mu held. A key
+// missing from the keys file is derived, if master_key_source is present, from
+// master_kek_XX, or else from mariko_master_kek_source_XX and mariko_kek.
+// Later master keys cannot be derived from earlier ones, so a generation
+// needs either its master key or its kek sources.
+func deriveMasterKey(gen int) []byte {
+	if k := keys[fmt.Sprintf("master_key_%02x", gen)]; k != nil {
+		return k
+	}
+	source := keys["master_key_source"]
+	if source == nil {
+		return nil
+	}
+
+	kek := keys[fmt.Sprintf("master_kek_%02x", gen)]
+	if kek == nil {
+		marikoKek := keys["mariko_kek"]
+		kekSource := keys[fmt.Sprintf("mariko_master_kek_source_%02x", gen)]
+		if marikoKek == nil || kekSource == nil {
+			return nil
+		}
+		var err error
+		if kek, err = crypto.ECBDecrypt(kekSource, marikoKek); err != nil {
+			return nil
+		}
+	}
+
+	masterKey, err := crypto.ECBDecrypt(source, kek)
+	if err != nil {
+		return nil
+	}
+	return masterKey
 }
 
 // UnwrapAesWrappedTitleKey unwraps the key from the NCA Key Area.
 // usually it is wrapped with Key Area Key Application.
 func UnwrapAesWrappedTitleKey(wrappedKey []byte, keyGen int) ([]byte, error) {
+	ensureDerived()
 	mu.RLock()
 	kak := keyAreaKeys[keyGen][0] // Application Key Area Key
 	mu.RUnlock()
@@ -104,3 +178,33 @@ func UnwrapAesWrappedTitleKey(wrappedKey []byte, keyGen int) ([]byte, error) {
 
 	return crypto.ECBDecrypt(wrappedKey, kak)
 }
+
+// Key area key types, selected by the NCA header's key area index.
+const (
+	KeyAreaKeyApplication = 0
+	KeyAreaKeyOcean       = 1
+	KeyAreaKeySystem      = 2
+)
+
+// DecryptKeyArea decrypts an NCA key area with the key area key of the given
+// generation and type.
+func DecryptKeyArea(keyArea []byte, keyGen, keyAreaType int) ([]byte, error) {
+	if keyGen < 0 || keyGen >= len(keyAreaKeys) {
+		return nil, fmt.Errorf("invalid key generation %d", keyGen)
+	}
+	if keyAreaType < 0 || keyAreaType >= len(keyAreaKeys[keyGen]) {
+		return nil, fmt.Errorf("invalid key area key type %d", keyAreaType)
+	}
+
+	ensureDerived()
+	mu.RLock()
+	kak := keyAreaKeys[keyGen][keyAreaType]
+	mu.RUnlock()
+
+	if kak == nil {
+		names := [3]string{"application", "ocean", "system"}
+		return nil, fmt.Errorf("key_area_key_%s_%02x not derived", names[keyAreaType], keyGen)
+	}
+
+	return crypto.ECBDecrypt(keyArea, kak)
+}
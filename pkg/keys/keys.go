@@ -2,7 +2,9 @@ package keys
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -15,75 +17,262 @@ var (
 	mu   sync.RWMutex
 )
 
+// ErrConflictingKey is returned in strict mode when a key is defined more
+// than once with different values.
+var ErrConflictingKey = errors.New("conflicting key definition")
+
+// LoadOptions controls how a keys file is read.
+type LoadOptions struct {
+	// Strict rejects the whole file if a key is defined with two different
+	// values, instead of letting the last definition win.
+	Strict bool
+}
+
+// LoadStats reports the outcome of loading a keys file.
+type LoadStats struct {
+	Loaded     int // Distinct keys read from the file
+	Duplicates int // Repeated definitions with the same value
+	Conflicts  int // Repeated definitions with a different value
+	// Warnings describes the lines that were skipped because they could not
+	// be parsed, with their line numbers.
+	Warnings []string
+}
+
 // Load reads keys from a file.
 // Format expected: key_name = HEXVALUE
+// Names are case-insensitive, the value may carry a 0x prefix, and
+// everything after a # or ; is a comment.
 func Load(path string) error {
+	_, err := LoadWithOptions(path, LoadOptions{})
+	return err
+}
+
+// LoadWithOptions reads keys from a file like Load and reports how many keys
+// were loaded and how many definitions repeated or conflicted, both within
+// the file and with keys loaded earlier. Keys are only stored if the whole
+// file is accepted.
+func LoadWithOptions(path string, opts LoadOptions) (LoadStats, error) {
+	var stats LoadStats
+
 	f, err := os.Open(path)
 	if err != nil {
-		return err
+		return stats, err
 	}
 	defer f.Close()
 
+	parsed := make(map[string][]byte)
+	var conflicts []string
+
+	mu.RLock()
 	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" || strings.HasPrefix(line, "#") {
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		name, val, err := parseLine(scanner.Text())
+		if err != nil {
+			stats.Warnings = append(stats.Warnings, fmt.Sprintf("line %d: %v", lineNo, err))
 			continue
 		}
-
-		parts := strings.SplitN(line, "=", 2)
-		if len(parts) != 2 {
+		if name == "" {
 			continue
 		}
 
-		name := strings.TrimSpace(parts[0])
-		valHex := strings.TrimSpace(parts[1])
-
-		val, err := hex.DecodeString(valHex)
-		if err != nil {
-			// Ignore invalid lines? Or log? For now ignore.
-			continue
+		prev, seen := parsed[name]
+		if !seen {
+			prev, seen = keys[name]
 		}
+		if seen {
+			if bytes.Equal(prev, val) {
+				stats.Duplicates++
+			} else {
+				stats.Conflicts++
+				conflicts = append(conflicts, name)
+			}
+		}
+		parsed[name] = val
+	}
+	mu.RUnlock()
 
-		mu.Lock()
+	if err := scanner.Err(); err != nil {
+		return stats, err
+	}
+	if opts.Strict && len(conflicts) > 0 {
+		return stats, fmt.Errorf("%w: %s", ErrConflictingKey, strings.Join(conflicts, ", "))
+	}
+
+	mu.Lock()
+	for name, val := range parsed {
 		keys[name] = val
-		mu.Unlock()
 	}
+	stale = true
+	mu.Unlock()
 
-	return scanner.Err()
+	stats.Loaded = len(parsed)
+	return stats, nil
 }
 
-// Get retrieves a key by name. Returns nil if not found.
+// parseLine parses a "name = value" line. It returns an empty name for blank
+// or comment-only lines and an error for malformed ones.
+func parseLine(line string) (string, []byte, error) {
+	if i := strings.IndexAny(line, "#;"); i >= 0 {
+		line = line[:i]
+	}
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return "", nil, nil
+	}
+
+	parts := strings.SplitN(line, "=", 2)
+	if len(parts) != 2 {
+		return "", nil, errors.New("expected name = value")
+	}
+
+	name := strings.ToLower(strings.TrimSpace(parts[0]))
+	valHex := strings.TrimSpace(parts[1])
+	valHex = strings.TrimPrefix(strings.TrimPrefix(valHex, "0x"), "0X")
+	if name == "" {
+		return "", nil, errors.New("missing key name")
+	}
+
+	val, err := hex.DecodeString(valHex)
+	if err != nil {
+		return "", nil, fmt.Errorf("%s: value is not hex", name)
+	}
+	return name, val, nil
+}
+
+// Get retrieves a key by name. Returns nil if not found. A master_key_XX
+// missing from the keys file is returned if it could be derived.
 func Get(name string) []byte {
+	name = strings.ToLower(name)
+	ensureDerived()
+
 	mu.RLock()
 	defer mu.RUnlock()
-	if k, ok := keys[name]; ok {
-		// Return a copy to prevent modification
-		dest := make([]byte, len(k))
-		copy(dest, k)
-		return dest
+	k, ok := keys[name]
+	if !ok {
+		k = derivedMasterKey(name)
+	}
+	if k == nil {
+		return nil
+	}
+	// Return a copy to prevent modification
+	dest := make([]byte, len(k))
+	copy(dest, k)
+	return dest
+}
+
+// derivedMasterKey returns the master key named master_key_XX, with mu held,
+// or nil if name is not one or it was not derived.
+func derivedMasterKey(name string) []byte {
+	gen, ok := strings.CutPrefix(name, "master_key_")
+	if !ok || len(gen) != 2 {
+		return nil
+	}
+	b, err := hex.DecodeString(gen)
+	if err != nil || int(b[0]) >= len(masterKeys) {
+		return nil
+	}
+	return masterKeys[b[0]]
+}
+
+// ErrKeyLength is returned by Set for a known key of the wrong length.
+var ErrKeyLength = errors.New("wrong key length")
+
+// keyLengths are the byte lengths of the known keys; keyPrefixLengths cover
+// the per-generation keys, whose names end in a two-digit hex generation.
+var (
+	keyLengths = map[string]int{
+		"header_key":                      32,
+		"header_key_source":               32,
+		"aes_kek_generation_source":       16,
+		"aes_key_generation_source":       16,
+		"titlekek_source":                 16,
+		"master_key_source":               16,
+		"mariko_kek":                      16,
+		"key_area_key_application_source": 16,
+		"key_area_key_ocean_source":       16,
+		"key_area_key_system_source":      16,
+	}
+	keyPrefixLengths = map[string]int{
+		"master_key_":               16,
+		"master_kek_":               16,
+		"mariko_master_kek_source_": 16,
+		"titlekek_":                 16,
+		"key_area_key_application_": 16,
+		"key_area_key_ocean_":       16,
+		"key_area_key_system_":      16,
 	}
+)
+
+// expectedKeyLength returns the byte length of a known key name.
+func expectedKeyLength(name string) (int, bool) {
+	if n, ok := keyLengths[name]; ok {
+		return n, true
+	}
+	for prefix, n := range keyPrefixLengths {
+		if gen := strings.TrimPrefix(name, prefix); gen != name && len(gen) == 2 {
+			if _, err := hex.DecodeString(gen); err == nil {
+				return n, true
+			}
+		}
+	}
+	return 0, false
+}
+
+// Set stores a single key, as if it had been read from a keys file, for
+// callers whose keys do not come from a file. Known keys must have their
+// expected length; other names are stored as given. Keys derived from the
+// sources and master keys are refreshed on first use.
+func Set(name string, value []byte) error {
+	name = strings.ToLower(name)
+	if n, ok := expectedKeyLength(name); ok && len(value) != n {
+		return fmt.Errorf("%w: %s is %d bytes, expected %d", ErrKeyLength, name, len(value), n)
+	}
+
+	mu.Lock()
+	keys[name] = append([]byte(nil), value...)
+	stale = true
+	mu.Unlock()
 	return nil
 }
 
-// LoadDefault tries to load keys from standard locations.
-func LoadDefault() error {
-	home, err := os.UserHomeDir()
+// LoadDefault loads keys from the first file FindDefault finds and returns
+// its path.
+func LoadDefault() (string, error) {
+	p, err := FindDefault()
 	if err != nil {
-		return err
+		return "", err
 	}
+	return p, Load(p)
+}
 
-	paths := []string{
-		"prod.keys",
-		"keys.txt",
-		filepath.Join(home, ".switch", "prod.keys"),
-		filepath.Join(home, ".switch", "keys.txt"),
+// FindDefault returns the first keys file found in the standard locations:
+// the files named by $NSZ_KEYS and $SWITCH_KEYS, prod.keys or keys.txt in the
+// current directory, in ~/.switch, in $XDG_CONFIG_HOME/nsz (~/.config/nsz),
+// and /switch/prod.keys on a mounted SD card.
+func FindDefault() (string, error) {
+	var paths []string
+	for _, env := range []string{"NSZ_KEYS", "SWITCH_KEYS"} {
+		if p := os.Getenv(env); p != "" {
+			paths = append(paths, p)
+		}
+	}
+	paths = append(paths, "prod.keys", "keys.txt")
+
+	if home, err := os.UserHomeDir(); err == nil {
+		paths = append(paths,
+			filepath.Join(home, ".switch", "prod.keys"),
+			filepath.Join(home, ".switch", "keys.txt"),
+		)
+	}
+	if config, err := os.UserConfigDir(); err == nil {
+		paths = append(paths, filepath.Join(config, "nsz", "prod.keys"))
 	}
+	paths = append(paths, filepath.Join(string(filepath.Separator), "switch", "prod.keys"))
 
 	for _, p := range paths {
 		if _, err := os.Stat(p); err == nil {
-			return Load(p)
+			return p, nil
 		}
 	}
-	return fmt.Errorf("no keys file found")
+	return "", fmt.Errorf("no keys file found")
 }
@@ -0,0 +1,58 @@
+package nsz
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// MagicNCZHASH ends the optional block hash trailer of a block-mode NCZ,
+// written right after its last block. Readers that follow the size table
+// never reach it, so the NCZ stays readable by other tools.
+const MagicNCZHASH = "NCZHASH0"
+
+// blockHashFooterSize is the size of the footer that follows the hashes:
+// the block count (uint64) and MagicNCZHASH.
+const blockHashFooterSize = 16
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// BlockHash returns the CRC-32C of a block as stored in the NCZ (compressed,
+// or raw for stored blocks), so blocks can be checked without decompressing.
+func BlockHash(block []byte) uint32 {
+	return crc32.Checksum(block, castagnoli)
+}
+
+// BlockHashTrailer returns the trailer for hashes, one per block in order:
+// the hashes as uint32s followed by the footer.
+func BlockHashTrailer(hashes []uint32) []byte {
+	b := make([]byte, 0, len(hashes)*4+blockHashFooterSize)
+	for _, h := range hashes {
+		b = binary.LittleEndian.AppendUint32(b, h)
+	}
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(hashes)))
+	return append(b, MagicNCZHASH...)
+}
+
+// ReadBlockHashTrailer returns the block hashes of an NCZ whose block data
+// ends at offset, or nil if it has no trailer.
+func ReadBlockHashTrailer(r io.ReaderAt, offset int64, blockCount uint32) ([]uint32, error) {
+	b := make([]byte, int64(blockCount)*4+blockHashFooterSize)
+	if n, _ := r.ReadAt(b, offset); n < len(b) {
+		return nil, nil
+	}
+	footer := b[len(b)-blockHashFooterSize:]
+	if string(footer[8:]) != MagicNCZHASH {
+		return nil, nil
+	}
+	if count := binary.LittleEndian.Uint64(footer); count != uint64(blockCount) {
+		return nil, fmt.Errorf("block hash trailer has %d hashes for %d blocks", count, blockCount)
+	}
+
+	hashes := make([]uint32, blockCount)
+	for i := range hashes {
+		hashes[i] = binary.LittleEndian.Uint32(b[i*4:])
+	}
+	return hashes, nil
+}
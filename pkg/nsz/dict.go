@@ -0,0 +1,49 @@
+package nsz
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// MagicNSZDICT ends the dictionary trailer of an NSZ whose blocks were
+// compressed against a shared zstd dictionary.
+const MagicNSZDICT = "NSZDICT0"
+
+// dictFooterSize is the size of the footer that follows the dictionary:
+// the dictionary size (uint64) and MagicNSZDICT.
+const dictFooterSize = 16
+
+// DictTrailer returns the trailer for dict: the dictionary followed by its
+// footer. It goes after the last PFS0 member, where PFS0 readers do not look.
+func DictTrailer(dict []byte) []byte {
+	b := make([]byte, 0, len(dict)+dictFooterSize)
+	b = append(b, dict...)
+	b = binary.LittleEndian.AppendUint64(b, uint64(len(dict)))
+	return append(b, MagicNSZDICT...)
+}
+
+// ReadDictTrailer returns the dictionary stored at the end of a file of the
+// given size, or nil if there is no trailer.
+func ReadDictTrailer(r io.ReaderAt, size int64) ([]byte, error) {
+	if size < dictFooterSize {
+		return nil, nil
+	}
+	footer := make([]byte, dictFooterSize)
+	if n, err := r.ReadAt(footer, size-dictFooterSize); n < len(footer) {
+		return nil, fmt.Errorf("read dictionary footer: %w", err)
+	}
+	if string(footer[8:]) != MagicNSZDICT {
+		return nil, nil
+	}
+
+	dictSize := binary.LittleEndian.Uint64(footer)
+	if dictSize > uint64(size-dictFooterSize) {
+		return nil, fmt.Errorf("dictionary size %d exceeds file size %d", dictSize, size)
+	}
+	dict := make([]byte, dictSize)
+	if n, err := r.ReadAt(dict, size-dictFooterSize-int64(dictSize)); n < len(dict) {
+		return nil, fmt.Errorf("read dictionary: %w", err)
+	}
+	return dict, nil
+}
@@ -0,0 +1,74 @@
+package nsz_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"os"
+	"testing"
+
+	"github.com/falk/nsz-go/internal/testutil"
+	"github.com/falk/nsz-go/pkg/fs"
+	"github.com/falk/nsz-go/pkg/nsz"
+)
+
+var ncaOut = flag.String("nca-out", "", "write the synthetic NCA of TestNczLayout to this file")
+
+// TestNczLayout compresses a synthetic NCA and compares its NCZ structures
+// with testdata/blocks.golden. The size table is checked for its length only,
+// as the compressed sizes depend on the zstd build.
+//
+// The golden blob is meant to be cut from the NCZ the reference nsz writes
+// for this NCA (see testdata/golden.py, and -nca-out to write the NCA). It has
+// not been captured from nsz yet: the blob in the tree is packed from a
+// reading of nsz's writer.
+func TestNczLayout(t *testing.T) {
+	golden, err := os.ReadFile("testdata/blocks.golden")
+	if err != nil {
+		t.Fatal(err)
+	}
+	nca, err := testutil.NewSyntheticNCA([]testutil.SectionSpec{
+		{Size: 0x30000, FsType: fs.FsTypePfs0, Counter: 1},
+		{Size: 0x50000, FsType: fs.FsTypeRomFs, Counter: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *ncaOut != "" {
+		if err := os.WriteFile(*ncaOut, nca, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var out bytes.Buffer
+	opts := fs.CompressOptions{Level: 3, BlockSizeExp: 16, PrecheckBlocks: -1, HeaderKey: testutil.HeaderKey}
+	if _, err := fs.CompressNca(bytes.NewReader(nca), &out, int64(len(nca)), testutil.TitleKey, opts); err != nil {
+		t.Fatalf("CompressNca: %v", err)
+	}
+	ncz := out.Bytes()
+
+	structures := ncz[nsz.HeaderSize:min(len(ncz), nsz.HeaderSize+len(golden))]
+	if !bytes.Equal(structures, golden) {
+		for i := range min(len(structures), len(golden)) {
+			if structures[i] != golden[i] {
+				t.Fatalf("NCZ structures differ from the golden blob at 0x%x: got %x, want %x",
+					nsz.HeaderSize+i, structures[i:min(len(structures), i+16)], golden[i:min(len(golden), i+16)])
+			}
+		}
+		t.Fatalf("NCZ structures are 0x%x bytes, want 0x%x", len(structures), len(golden))
+	}
+
+	// The size table follows, then the blocks it sizes
+	bh := &nsz.NczBlockHeader{}
+	if err := binary.Read(bytes.NewReader(golden[len(golden)-nsz.NczBlockHeaderSize:]), binary.LittleEndian, bh); err != nil {
+		t.Fatal(err)
+	}
+	table := ncz[nsz.HeaderSize+len(golden) : nsz.DataOffset(2, bh)]
+	end := nsz.DataOffset(2, bh)
+	for i := 0; i < len(table); i += 4 {
+		end += int64(binary.LittleEndian.Uint32(table[i:]))
+	}
+	if len(table) != 4*int(bh.BlockCount) || end != int64(len(ncz)) {
+		t.Errorf("%d-byte size table sizes blocks up to 0x%x, the NCZ ends at 0x%x", len(table), end, len(ncz))
+	}
+}
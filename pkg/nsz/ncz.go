@@ -2,19 +2,70 @@ package nsz
 
 import (
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
 const (
 	MagicNCZSECTN = "NCZSECTN"
 	MagicNCZBLOCK = "NCZBLOCK"
+
+	// MaxNczSections bounds the section count ReadNczHeader accepts. An NCA
+	// has at most four sections, but each BKTR subsection of an update NCA
+	// gets an entry of its own.
+	MaxNczSections = 0x10000
+
+	// MaxBlockSizeExp is the largest block size exponent: a stored 2^32-byte
+	// block would not fit its uint32 size table entry.
+	MaxBlockSizeExp = 31
+)
+
+// Sizes of the parts of an NCZ. As in the reference nsz, the parts follow
+// each other with no alignment or padding: the NCA header, the section
+// header and its entries, then for a block-mode NCZ the block header, the
+// block size table and the blocks, or for a solid one the zstd stream.
+const (
+	HeaderSize            = 0x4000 // The first 0x4000 bytes of the NCA, as stored
+	NczSectionHeaderSize  = 0x10
+	NczSectionEntrySize   = 0x40
+	NczBlockHeaderSize    = 0x18
+	nczBlockSizeEntrySize = 4 // A block size table entry
+)
+
+// DataOffset returns the offset in an NCZ with sectionCount sections of its
+// compressed data: the first block if bh is not nil, or else the zstd stream
+// of a solid NCZ.
+func DataOffset(sectionCount int, bh *NczBlockHeader) int64 {
+	offset := int64(HeaderSize + NczSectionHeaderSize + sectionCount*NczSectionEntrySize)
+	if bh != nil {
+		offset += NczBlockHeaderSize + int64(bh.BlockCount)*nczBlockSizeEntrySize
+	}
+	return offset
+}
+
+// Block types (NczBlockHeader.Type) name the codec of the compressed blocks.
+// Blocks that did not shrink are stored raw whatever the type.
+const (
+	BlockTypeStored = 0 // Every block is raw
+	BlockTypeZstd   = 1 // Written by nsz and nsz-go
+	// Other values are reserved for future codecs.
 )
 
+// NczSectionHeader structure (Little Endian), at HeaderSize
+// Offset 0x00: Magic "NCZSECTN" (8 bytes)
+// Offset 0x08: Section Count (8 bytes), followed by the entries
 type NczSectionHeader struct {
 	Magic        [8]byte // NCZSECTN
 	SectionCount uint64
 }
 
+// NczSectionEntry structure (Little Endian)
+// Offset 0x00: Offset in the NCA (8 bytes)
+// Offset 0x08: Size (8 bytes)
+// Offset 0x10: Crypto Type (8 bytes)
+// Offset 0x18: Padding (8 bytes)
+// Offset 0x20: Crypto Key (16 bytes)
+// Offset 0x30: Crypto Counter (16 bytes), the big-endian CTR IV of the section
 type NczSectionEntry struct {
 	Offset        uint64
 	Size          uint64
@@ -24,16 +75,72 @@ type NczSectionEntry struct {
 	CryptoCounter [16]byte
 }
 
+// NczBlockHeader precedes the block size table: BlockCount little-endian
+// uint32s, the size each block takes in the file, followed by the blocks.
+//
+// The table has no flag bits, as in the reference nsz. Whether a block is raw
+// follows from its size alone (see IsStored): a writer must store a block raw
+// whenever compressing it does not make it strictly smaller than its
+// decompressed size, and a table entry larger than that size is invalid.
+//
+// NczBlockHeader structure (Little Endian)
+// Offset 0x00: Magic "NCZBLOCK" (8 bytes)
+// Offset 0x08: Version (1 byte), 2
+// Offset 0x09: Type (1 byte)
+// Offset 0x0A: Unused (1 byte)
+// Offset 0x0B: Block Size Exponent (1 byte)
+// Offset 0x0C: Block Count (4 bytes)
+// Offset 0x10: Decompressed Size (8 bytes), the NCA without its header
 type NczBlockHeader struct {
 	Magic            [8]byte // NCZBLOCK
 	Version          uint8   // 2
-	Type             uint8   // 1
+	Type             uint8   // BlockTypeZstd
 	Unused           uint8
 	BlockSizeExp     uint8
 	BlockCount       uint32
 	DecompressedSize uint64
 }
 
+// BlockSize returns the decompressed size of a full block.
+func (h *NczBlockHeader) BlockSize() uint64 {
+	return uint64(1) << h.BlockSizeExp
+}
+
+// ExpectedBlockCount returns the number of blocks DecompressedSize splits into.
+func (h *NczBlockHeader) ExpectedBlockCount() uint64 {
+	return (h.DecompressedSize + h.BlockSize() - 1) / h.BlockSize()
+}
+
+// BlockDecompressedSize returns the decompressed size of block i: a full
+// block, or the remainder of DecompressedSize for the last block.
+func (h *NczBlockHeader) BlockDecompressedSize(i int) uint64 {
+	start := uint64(i) * h.BlockSize()
+	if start >= h.DecompressedSize {
+		return 0
+	}
+	if rest := h.DecompressedSize - start; rest < h.BlockSize() {
+		return rest
+	}
+	return h.BlockSize()
+}
+
+// IsStored reports whether block i, taking compressedSize bytes in the file,
+// holds raw data: exactly when compressedSize equals BlockDecompressedSize(i),
+// which for the last block is the remainder rather than BlockSize. Compressed
+// blocks are always strictly smaller, so the two cannot be confused.
+func (h *NczBlockHeader) IsStored(i int, compressedSize uint32) bool {
+	return uint64(compressedSize) == h.BlockDecompressedSize(i)
+}
+
+// CheckBlockSize reports an error if compressedSize cannot be the table
+// entry of block i, because it is larger than the block decompresses to.
+func (h *NczBlockHeader) CheckBlockSize(i int, compressedSize uint32) error {
+	if expected := h.BlockDecompressedSize(i); uint64(compressedSize) > expected {
+		return fmt.Errorf("block %d: %d bytes in the file, more than its %d decompressed bytes", i, compressedSize, expected)
+	}
+	return nil
+}
+
 func WriteNczHeader(w io.Writer, sections []NczSectionEntry) error {
 	var h NczSectionHeader
 	copy(h.Magic[:], MagicNCZSECTN)
@@ -50,3 +157,50 @@ func WriteNczHeader(w io.Writer, sections []NczSectionEntry) error {
 	}
 	return nil
 }
+
+// ReadNczHeader reads an NCZSECTN header and its section entries from r. The
+// section count must be at most MaxNczSections, and entries are read as they
+// come, so a count larger than what r holds fails without allocating it all.
+func ReadNczHeader(r io.Reader) ([]NczSectionEntry, error) {
+	var h NczSectionHeader
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("read section header: %w", err)
+	}
+	if string(h.Magic[:]) != MagicNCZSECTN {
+		return nil, fmt.Errorf("invalid magic: expected %s, got %q", MagicNCZSECTN, h.Magic)
+	}
+	if h.SectionCount > MaxNczSections {
+		return nil, fmt.Errorf("section header: %d sections, more than the maximum of %d", h.SectionCount, MaxNczSections)
+	}
+
+	sections := make([]NczSectionEntry, 0, min(h.SectionCount, 64))
+	for i := uint64(0); i < h.SectionCount; i++ {
+		var s NczSectionEntry
+		if err := binary.Read(r, binary.LittleEndian, &s); err != nil {
+			return nil, fmt.Errorf("read section entry %d of %d: %w", i, h.SectionCount, err)
+		}
+		sections = append(sections, s)
+	}
+	return sections, nil
+}
+
+// ReadNczBlockHeader reads an NCZBLOCK header from r and checks its magic,
+// its block size and that its block count matches its decompressed size,
+// which the size of every block is derived from. The block type is left to
+// the caller.
+func ReadNczBlockHeader(r io.Reader) (*NczBlockHeader, error) {
+	var h NczBlockHeader
+	if err := binary.Read(r, binary.LittleEndian, &h); err != nil {
+		return nil, fmt.Errorf("read block header: %w", err)
+	}
+	if string(h.Magic[:]) != MagicNCZBLOCK {
+		return nil, fmt.Errorf("invalid magic: expected %s, got %q", MagicNCZBLOCK, h.Magic)
+	}
+	if h.BlockSizeExp > MaxBlockSizeExp {
+		return nil, fmt.Errorf("block header: block size exponent %d is above the maximum of %d", h.BlockSizeExp, MaxBlockSizeExp)
+	}
+	if uint64(h.BlockCount) != h.ExpectedBlockCount() {
+		return nil, fmt.Errorf("block header: %d blocks for 0x%x bytes in 2^%d blocks", h.BlockCount, h.DecompressedSize, h.BlockSizeExp)
+	}
+	return &h, nil
+}
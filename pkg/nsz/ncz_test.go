@@ -0,0 +1,125 @@
+package nsz
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// sectionHeader returns a section header of count entries, all zero but
+// their offsets, with magic in place of NCZSECTN.
+func sectionHeader(magic string, count uint64, entries int) []byte {
+	var b bytes.Buffer
+	b.WriteString(magic)
+	binary.Write(&b, binary.LittleEndian, count)
+	for i := range entries {
+		binary.Write(&b, binary.LittleEndian, NczSectionEntry{Offset: uint64(0x4000 + i*0x1000)})
+	}
+	return b.Bytes()
+}
+
+// blockHeader returns a block header with magic in place of NCZBLOCK.
+func blockHeader(magic string, exp uint8, count uint32, size uint64) []byte {
+	h := NczBlockHeader{Version: 2, Type: BlockTypeZstd, BlockSizeExp: exp, BlockCount: count, DecompressedSize: size}
+	copy(h.Magic[:], magic)
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, h)
+	return b.Bytes()
+}
+
+func TestReadNczHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		count   int
+		wantErr string
+		wantIs  error
+	}{
+		{name: "two sections", data: sectionHeader(MagicNCZSECTN, 2, 2), count: 2},
+		{name: "no sections", data: sectionHeader(MagicNCZSECTN, 0, 0)},
+		{name: "bad magic", data: sectionHeader("NCZBLOCK", 2, 2), wantErr: "invalid magic"},
+		{name: "empty", data: nil, wantIs: io.EOF},
+		{name: "truncated header", data: sectionHeader(MagicNCZSECTN, 2, 2)[:0xC], wantIs: io.ErrUnexpectedEOF},
+		{name: "truncated entry", data: sectionHeader(MagicNCZSECTN, 2, 2)[:NczSectionHeaderSize+NczSectionEntrySize+0x20], wantIs: io.ErrUnexpectedEOF},
+		{name: "missing entry", data: sectionHeader(MagicNCZSECTN, 3, 2), wantIs: io.EOF},
+		{name: "too many sections", data: sectionHeader(MagicNCZSECTN, MaxNczSections+1, 1), wantErr: "more than the maximum"},
+		{name: "count past the data", data: sectionHeader(MagicNCZSECTN, MaxNczSections, 1), wantIs: io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sections, err := ReadNczHeader(bytes.NewReader(tt.data))
+			switch {
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got %v, want an error with %q", err, tt.wantErr)
+			case tt.wantIs != nil && !errors.Is(err, tt.wantIs):
+				t.Fatalf("got %v, want %v", err, tt.wantIs)
+			case tt.wantErr == "" && tt.wantIs == nil && err != nil:
+				t.Fatal(err)
+			}
+			if err == nil && len(sections) != tt.count {
+				t.Errorf("got %d sections, want %d", len(sections), tt.count)
+			}
+		})
+	}
+}
+
+func TestWriteReadNczHeader(t *testing.T) {
+	want := []NczSectionEntry{
+		{Offset: 0x4000, Size: 0x20000, CryptoType: 3, CryptoKey: [16]byte{1}, CryptoCounter: [16]byte{7: 1}},
+		{Offset: 0x24000, Size: 0x8000, CryptoType: 1},
+	}
+	var b bytes.Buffer
+	if err := WriteNczHeader(&b, want); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() != NczSectionHeaderSize+len(want)*NczSectionEntrySize {
+		t.Fatalf("wrote %d bytes", b.Len())
+	}
+	got, err := ReadNczHeader(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Errorf("read %+v, want %+v", got, want)
+	}
+}
+
+func TestReadNczBlockHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		wantErr string
+		wantIs  error
+	}{
+		{name: "full blocks", data: blockHeader(MagicNCZBLOCK, 20, 4, 4<<20)},
+		{name: "short last block", data: blockHeader(MagicNCZBLOCK, 20, 5, 4<<20+1)},
+		{name: "empty NCA", data: blockHeader(MagicNCZBLOCK, 20, 0, 0)},
+		{name: "largest exponent", data: blockHeader(MagicNCZBLOCK, MaxBlockSizeExp, 1, 1)},
+		{name: "bad magic", data: blockHeader(MagicNCZSECTN, 20, 4, 4<<20), wantErr: "invalid magic"},
+		{name: "empty", data: nil, wantIs: io.EOF},
+		{name: "truncated", data: blockHeader(MagicNCZBLOCK, 20, 4, 4<<20)[:0x10], wantIs: io.ErrUnexpectedEOF},
+		{name: "bad exponent", data: blockHeader(MagicNCZBLOCK, MaxBlockSizeExp+1, 1, 1), wantErr: "exponent"},
+		{name: "too few blocks", data: blockHeader(MagicNCZBLOCK, 20, 4, 4<<20+1), wantErr: "blocks for"},
+		{name: "too many blocks", data: blockHeader(MagicNCZBLOCK, 20, 5, 4<<20), wantErr: "blocks for"},
+		{name: "blocks for no data", data: blockHeader(MagicNCZBLOCK, 20, 1, 0), wantErr: "blocks for"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bh, err := ReadNczBlockHeader(bytes.NewReader(tt.data))
+			switch {
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("got %v, want an error with %q", err, tt.wantErr)
+			case tt.wantIs != nil && !errors.Is(err, tt.wantIs):
+				t.Fatalf("got %v, want %v", err, tt.wantIs)
+			case tt.wantErr == "" && tt.wantIs == nil && err != nil:
+				t.Fatal(err)
+			}
+			if err == nil && uint64(bh.BlockCount) != bh.ExpectedBlockCount() {
+				t.Errorf("read %+v", bh)
+			}
+		})
+	}
+}
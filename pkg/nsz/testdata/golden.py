@@ -0,0 +1,98 @@
+#!/usr/bin/env python3
+"""Writes blocks.golden from an NCZ written by the reference nsz.
+
+The golden blob is the NCZ section header, its entries and the block header
+of the synthetic NCA of TestNczLayout, as nsz writes them; the block size
+table and the blocks depend on the zstd build and are left out.
+
+STATUS: the blocks.golden in the tree has NOT been captured from nsz yet. It
+was packed by documented_layout() below from a reading of nsz's writer
+(nsz/BlockCompressor.py), so for now it only checks this repo against that
+reading. Replace it by running the steps below where nsz is installed.
+
+To regenerate:
+
+ 1. Write the synthetic NCA:
+        go test ./pkg/nsz -run TestNczLayout -args -nca-out /tmp/synthetic.nca
+    It is two CTR sections under the title key "synthetic-title!" (rights ID
+    01000000000010000000000000000001, key generation 0): a PFS0 of 0x30000
+    bytes at 0x4000 with counter 1, then a RomFS of 0x50000 bytes with
+    counter 2. Its header is encrypted with the header_key of
+    internal/testutil.HeaderKey.
+ 2. Put it in an NSP with a ticket for that rights ID whose title key
+    decrypts to "synthetic-title!" under the keys file given to nsz, and
+    compress it with nsz in block mode, with 64 KB blocks (block size
+    exponent 16).
+ 3. Take the NCZ member out of the NSZ and run
+        golden.py <the NCZ>
+    which cuts the structures out of it into blocks.golden, and reports
+    whether they differ from documented_layout().
+"""
+
+import os
+import struct
+import sys
+
+HEADER_SIZE = 0x4000
+SECTION_HEADER_SIZE = 0x10
+SECTION_ENTRY_SIZE = 0x40
+BLOCK_HEADER_SIZE = 0x18
+
+TITLE_KEY = b"synthetic-title!"
+SECTIONS = [  # offset, size, counter
+    (0x4000, 0x30000, 1),
+    (0x34000, 0x50000, 2),
+]
+BLOCK_SIZE_EXP = 16
+CRYPTO_TYPE_CTR = 3
+
+
+def structures(ncz):
+    """Returns the section header, entries and block header of ncz."""
+    if ncz[HEADER_SIZE:HEADER_SIZE + 8] != b"NCZSECTN":
+        raise ValueError("no NCZSECTN after the NCA header")
+    (count,) = struct.unpack_from("<Q", ncz, HEADER_SIZE + 8)
+    end = HEADER_SIZE + SECTION_HEADER_SIZE + count * SECTION_ENTRY_SIZE
+    if ncz[end:end + 8] != b"NCZBLOCK":
+        raise ValueError("no NCZBLOCK after the sections; compress in block mode")
+    return ncz[HEADER_SIZE:end + BLOCK_HEADER_SIZE]
+
+
+def documented_layout():
+    """Packs the structures field by field as nsz's writer is documented to."""
+    out = bytearray()
+
+    # NCZSECTN: the magic, the section count, then 0x40 bytes per section
+    out += b"NCZSECTN"
+    out += struct.pack("<Q", len(SECTIONS))
+    for offset, size, counter in SECTIONS:
+        out += struct.pack("<QQQQ", offset, size, CRYPTO_TYPE_CTR, 0)
+        out += TITLE_KEY
+        # The counter is the IV of the section: big-endian, block number zero
+        out += struct.pack(">QQ", counter, 0)
+
+    # NCZBLOCK: version 2, zstd, the block size exponent, the block count and
+    # the size of the NCA after its 0x4000-byte header
+    body = SECTIONS[-1][0] + SECTIONS[-1][1] - HEADER_SIZE
+    block_size = 1 << BLOCK_SIZE_EXP
+    out += b"NCZBLOCK"
+    out += struct.pack("<BBBBI", 2, 1, 0, BLOCK_SIZE_EXP, (body + block_size - 1) // block_size)
+    out += struct.pack("<Q", body)
+    return bytes(out)
+
+
+def main():
+    if len(sys.argv) != 2:
+        sys.exit("usage: golden.py <NCZ written by nsz>")
+    with open(sys.argv[1], "rb") as f:
+        golden = structures(f.read())
+    if golden != documented_layout():
+        print("note: nsz's structures differ from documented_layout()")
+
+    path = os.path.join(os.path.dirname(os.path.abspath(__file__)), "blocks.golden")
+    with open(path, "wb") as f:
+        f.write(golden)
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,91 @@
+package zstd
+
+import (
+	"hash/crc32"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Raw dictionaries: plain content that frames may reference, identified by
+// the dictionary ID written into each frame header.
+
+var (
+	dictDecoders   = make(map[uint32]*zstd.Decoder)
+	dictDecodersMu sync.Mutex
+)
+
+// DictID returns the frame dictionary ID used for dict, derived from its
+// content. IDs below 32768 and from 2^31 up are reserved by the zstd format.
+func DictID(dict []byte) uint32 {
+	return 32768 + crc32.ChecksumIEEE(dict)%(1<<31-32768)
+}
+
+// BuildRawDict builds a raw dictionary of at most maxSize bytes from samples.
+// zstd matches recent history best, so earlier samples are trimmed first and
+// the last sample ends up closest to the data.
+func BuildRawDict(samples [][]byte, maxSize int) []byte {
+	var dict []byte
+	for i := len(samples) - 1; i >= 0 && len(dict) < maxSize; i-- {
+		s := samples[i]
+		if room := maxSize - len(dict); len(s) > room {
+			s = s[len(s)-room:]
+		}
+		dict = append(append([]byte(nil), s...), dict...)
+	}
+	return dict
+}
+
+// CompressWithDict compresses src against the raw dictionary dict.
+// A nil dict is the same as Compress.
+func CompressWithDict(src, dict []byte, level int) []byte {
+	pool := getEncoderPool(level, dict)
+	enc := pool.Get().(*zstd.Encoder)
+	defer pool.Put(enc)
+
+	return enc.EncodeAll(src, make([]byte, 0, len(src)))
+}
+
+// DecompressWithDict decompresses src, which may reference the raw
+// dictionary dict. A nil dict is the same as Decompress.
+func DecompressWithDict(src, dict []byte) ([]byte, error) {
+	if dict == nil {
+		return Decompress(src)
+	}
+	d, err := dictDecoder(dict)
+	if err != nil {
+		return nil, err
+	}
+	return d.DecodeAll(src, nil)
+}
+
+// NewReaderWithDict is NewReader for streams that may reference dict.
+func NewReaderWithDict(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	if dict == nil {
+		return NewReader(r)
+	}
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderDictRaw(DictID(dict), dict))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}
+
+// dictDecoder returns a shared decoder that knows dict.
+func dictDecoder(dict []byte) (*zstd.Decoder, error) {
+	id := DictID(dict)
+
+	dictDecodersMu.Lock()
+	defer dictDecodersMu.Unlock()
+
+	if d, ok := dictDecoders[id]; ok {
+		return d, nil
+	}
+	d, err := zstd.NewReader(nil, zstd.WithDecoderDictRaw(id, dict))
+	if err != nil {
+		return nil, err
+	}
+	dictDecoders[id] = d
+	return d, nil
+}
@@ -1,22 +1,45 @@
 package zstd
 
 import (
+	"io"
 	"sync"
 
 	"github.com/klauspost/compress/zstd"
 )
 
+// Window sizes for zstd's ultra levels 20-22 (window logs 25-27).
+// klauspost/compress maps every level from 11 up to SpeedBestCompression with
+// an 8MB window, so a larger window is the only thing the ultra levels add.
+// It only makes a difference for inputs larger than 8MB, i.e. blocks of 2^24
+// bytes or more. 128MB is also the largest window libzstd decoders accept
+// without raising their limit.
+var ultraWindowSizes = map[int]int{
+	20: 32 << 20,
+	21: 64 << 20,
+	22: 128 << 20,
+}
+
 var (
 	decoder, _ = zstd.NewReader(nil)
 
-	// Encoder pools by compression level
-	encoderPools = make(map[int]*sync.Pool)
+	// Encoder pools by compression level and dictionary
+	encoderPools = make(map[poolKey]*sync.Pool)
 	poolMu       sync.RWMutex
 )
 
-func getEncoderPool(level int) *sync.Pool {
+type poolKey struct {
+	level  int
+	dictID uint32 // 0 without a dictionary
+}
+
+func getEncoderPool(level int, dict []byte) *sync.Pool {
+	key := poolKey{level: level}
+	if dict != nil {
+		key.dictID = DictID(dict)
+	}
+
 	poolMu.RLock()
-	pool, ok := encoderPools[level]
+	pool, ok := encoderPools[key]
 	poolMu.RUnlock()
 	if ok {
 		return pool
@@ -25,26 +48,50 @@ func getEncoderPool(level int) *sync.Pool {
 	poolMu.Lock()
 	defer poolMu.Unlock()
 
-	if pool, ok = encoderPools[level]; ok {
+	if pool, ok = encoderPools[key]; ok {
 		return pool
 	}
 
+	opts := []zstd.EOption{
+		zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
+		zstd.WithEncoderConcurrency(1),
+	}
+	if window, ok := ultraWindowSizes[level]; ok {
+		opts = append(opts, zstd.WithWindowSize(window))
+	}
+	if dict != nil {
+		opts = append(opts, zstd.WithEncoderDictRaw(key.dictID, dict))
+	}
+
 	pool = &sync.Pool{
 		New: func() interface{} {
-			enc, _ := zstd.NewWriter(nil,
-				zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)),
-				zstd.WithEncoderConcurrency(1),
-			)
+			enc, _ := zstd.NewWriter(nil, opts...)
 			return enc
 		},
 	}
-	encoderPools[level] = pool
+	encoderPools[key] = pool
 	return pool
 }
 
+// EffectiveLevel returns the reference zstd level that the encoder used for
+// level roughly corresponds to. klauspost/compress has four encoder speeds,
+// comparable to zstd levels 1, 3, 7 and 11, so for example levels 11-22 all
+// compress about like level 11 (levels 20-22 with a larger window).
+func EffectiveLevel(level int) int {
+	switch zstd.EncoderLevelFromZstd(level) {
+	case zstd.SpeedFastest:
+		return 1
+	case zstd.SpeedDefault:
+		return 3
+	case zstd.SpeedBetterCompression:
+		return 7
+	}
+	return 11
+}
+
 // Compress compresses data using Zstd with encoder pooling.
 func Compress(src []byte, level int) []byte {
-	pool := getEncoderPool(level)
+	pool := getEncoderPool(level, nil)
 	enc := pool.Get().(*zstd.Encoder)
 	defer pool.Put(enc)
 
@@ -55,3 +102,12 @@ func Compress(src []byte, level int) []byte {
 func Decompress(src []byte) ([]byte, error) {
 	return decoder.DecodeAll(src, nil)
 }
+
+// NewReader returns a streaming Zstd decompressor reading from r.
+func NewReader(r io.Reader) (io.ReadCloser, error) {
+	d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, err
+	}
+	return d.IOReadCloser(), nil
+}